@@ -3,12 +3,12 @@ module sshProxy
 go 1.16
 
 require (
-	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da // indirect
-	github.com/boltdb/bolt v1.3.1 // indirect
-	github.com/bybzmt/bolthold v0.0.0-20190514011116-2990f200cb1c // indirect
-	github.com/hashicorp/golang-lru v0.5.4 // indirect
-	github.com/integrii/flaggy v1.4.4 // indirect
-	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e // indirect
-	golang.org/x/sys v0.0.0-20220209214540-3681064d5158 // indirect
-	h12.io/socks v1.0.3 // indirect
+	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da
+	github.com/boltdb/bolt v1.3.1
+	github.com/bybzmt/bolthold v0.0.0-20190514011116-2990f200cb1c
+	github.com/hashicorp/golang-lru v0.5.4
+	github.com/integrii/flaggy v1.4.4
+	github.com/oschwald/maxminddb-golang v1.10.0
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	h12.io/socks v1.0.3
 )
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	ss "sshProxy/shadowsocks"
@@ -24,6 +27,17 @@ type flg struct {
 	timeout      int
 	LDNS         []string
 	RDNS         []string
+	geoIP        string
+	target, from string
+	resolve      bool
+	acl          string
+	sniff        int
+	mode         string
+	dns          string
+	hosts        string
+	fakeIP       string
+	ipPref       string
+	dnsStrategy  string
 }
 
 func main() {
@@ -38,10 +52,12 @@ func main() {
 	server := flaggy.NewSubcommand("server")
 	client := flaggy.NewSubcommand("client")
 	ui := flaggy.NewSubcommand("clientUI")
+	explain := flaggy.NewSubcommand("explain")
 
 	server.Description = "shadowsocks server"
 	client.Description = "shadowsocks client"
 	ui.Description = "shadowsocks client with http ui. default"
+	explain.Description = "show which route clientUI would take for host:port"
 
 	server.String(&f.addr, "a", "addr", "shadowsocks listen on addr:port. default :1080")
 	server.String(&f.cipher, "c", "cipher", "cipher: "+strings.Join(ss.AllCiphers(), " "))
@@ -56,16 +72,33 @@ func main() {
 	client.String(&f.passwd, "p", "passwd", "server password")
 	client.Int(&f.timeout, "t", "timeout", "timeout in seconds. default 65s")
 	client.StringSlice(&f.rules, "", "rule", "pac rule file")
-	client.StringSlice(&f.LDNS, "", "LDNS", "local direct dns")
-	client.StringSlice(&f.RDNS, "", "RDNS", "remote proxy dns")
+	client.StringSlice(&f.LDNS, "", "LDNS", "local direct dns: ip, https://host/dns-query or tls://host:853")
+	client.StringSlice(&f.RDNS, "", "RDNS", "remote proxy dns: ip, https://host/dns-query or tls://host:853")
+	client.String(&f.geoIP, "", "geoip", "MaxMind .mmdb file for GEOIP rules")
+	client.String(&f.acl, "", "acl", "allowed client ips or cidrs")
+	client.Bool(&f.resolve, "", "resolve", "match ip rules against local resolved domains")
+	client.String(&f.dns, "", "dns", "dns listen on addr:port, udp and tcp, other than loopback needs --acl")
+	client.String(&f.ipPref, "", "ip", "ipv6, ipv4 or ipv4only, the family tried first. default ipv6")
+	client.String(&f.dnsStrategy, "", "dnsstrategy", "sequential, race or health, how the dns servers are asked. default sequential")
+	client.String(&f.fakeIP, "", "fakeip", "dns inbound answers with fake ips of this range, like 198.18.0.0/15")
+	client.String(&f.hosts, "", "hosts", "hosts file asked before the dns, *.domain entries allowed")
+	client.String(&f.mode, "m", "mode", "rule, global or direct. default rule")
+	client.Int(&f.sniff, "", "sniff", "ms to wait for the TLS/HTTP host of ip destinations. default 0 disabled")
 
 	ui.String(&f.addr, "a", "addr", "shadowsocks listen on addr:port")
 	ui.String(&f.db, "", "db", "database file. default: ./sshProxy.db")
 	ui.String(&f.host, "", "host", "web ui host default: shadowsocks")
 
+	explain.AddPositionalValue(&f.target, "host:port", 1, true, "destination")
+	explain.String(&f.db, "", "db", "database file. default: ./sshProxy.db")
+	explain.String(&f.from, "", "from", "client address")
+	explain.String(&f.addr, "a", "addr", "addr:port of the running clientUI, the database is read when nothing listens. default 127.0.0.1:1080")
+	explain.String(&f.host, "", "host", "web ui host of the running clientUI. default: shadowsocks")
+
 	flaggy.AttachSubcommand(client, 1)
 	flaggy.AttachSubcommand(server, 1)
 	flaggy.AttachSubcommand(ui, 1)
+	flaggy.AttachSubcommand(explain, 1)
 	flaggy.DefaultParser.HelpTemplate = newHelpTemplate()
 
 	flaggy.Parse()
@@ -92,6 +125,8 @@ func main() {
 		runClient(f)
 	} else if server.Used {
 		runServer(f)
+	} else if explain.Used {
+		runExplain(f)
 	} else {
 		runClientUI(f)
 	}
@@ -131,7 +166,17 @@ func runClient(f flg) {
 			log.Println("Load Rule", err)
 			os.Exit(1)
 		}
-		client.AddRules(ts, "")
+		r := ss.NewRules(0, ts, "")
+		r.Resolve = f.resolve
+		client.SetRules(r)
+	}
+	if f.dnsStrategy != "" {
+		strategy, err := ss.ParseDNSStrategy(f.dnsStrategy)
+		if err != nil {
+			log.Println("DNS Strategy", err)
+			os.Exit(1)
+		}
+		client.SetDNSStrategy(strategy, 0)
 	}
 	for _, t := range f.LDNS {
 		client.SetLocalDNS(t)
@@ -139,6 +184,56 @@ func runClient(f flg) {
 	for _, t := range f.RDNS {
 		client.SetRemoteDNS(t)
 	}
+	if f.hosts != "" {
+		text, err := ss.LoadHostsFile(f.hosts)
+		if err != nil {
+			log.Println("Hosts", err)
+			os.Exit(1)
+		}
+		client.SetHosts(ss.ParseHosts(text))
+	}
+	if f.acl != "" {
+		client.SetACL(f.acl)
+	}
+	if f.mode != "" {
+		mode, err := ss.ParseMode(f.mode)
+		if err != nil {
+			log.Println("Mode", err)
+			os.Exit(1)
+		}
+		client.SetMode(mode, "")
+	}
+	if f.sniff > 0 {
+		client.SetSniff(time.Duration(f.sniff) * time.Millisecond)
+	}
+	if f.geoIP != "" {
+		if err := client.SetGeoIP(f.geoIP); err != nil {
+			log.Println("GeoIP", err)
+			os.Exit(1)
+		}
+	}
+
+	if f.ipPref != "" {
+		pref, err := ss.ParseIPPref(f.ipPref)
+		if err != nil {
+			log.Println("IP", err)
+			os.Exit(1)
+		}
+		client.SetIPPref(pref)
+	}
+	if f.fakeIP != "" {
+		if err := client.SetFakeIP(f.fakeIP, ""); err != nil {
+			log.Println("FakeIP", err)
+			os.Exit(1)
+		}
+	}
+	if f.dns != "" {
+		if err := client.ListenDNS(f.dns); err != nil {
+			log.Println("DNS Listen", err)
+			os.Exit(1)
+		}
+		log.Println("Starting DNS At", f.dns)
+	}
 
 	log.Println("Starting Client At", f.c_addr)
 
@@ -165,11 +260,35 @@ func cliState(c *ss.Client) {
 	}
 }
 
+func runExplain(f flg) {
+	if f.addr == "" {
+		f.addr = "127.0.0.1:1080"
+	}
+
+	t, err := ui.Explain(f.db, f.addr, f.host, f.target, f.from)
+	if err != nil {
+		log.Println("Explain", err)
+		os.Exit(1)
+	}
+
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	e.Encode(t)
+}
+
 func runClientUI(f flg) {
 	log.Println("Starting Database", f.db)
 
 	u := ui.NewUI(f.db, f.addr, f.host)
 
+	//saves the dns cache before exiting
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		u.Close()
+	}()
+
 	err := u.Run()
 	if err != nil {
 		log.Println(err)
@@ -0,0 +1,244 @@
+package shadowsocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// auto retries direct connections that fail or are reset right after
+// connect through a default server, and remembers their hosts.
+type auto struct {
+	server uint64
+	window time.Duration
+	ttl    time.Duration
+
+	l     sync.Mutex
+	hosts map[string]time.Time
+}
+
+// SetAuto enables auto mode: hosts not covered by any rule whose direct
+// connection fails, or is reset within window after connect, are retried
+// through the server id and go through it for ttl afterwards.
+func (c *Client) SetAuto(id uint64, window, ttl time.Duration) {
+	c.auto.Store(&auto{
+		server: id,
+		window: window,
+		ttl:    ttl,
+		hosts:  make(map[string]time.Time),
+	})
+}
+
+func (c *Client) getAuto() *auto {
+	a, _ := c.auto.Load().(*auto)
+	return a
+}
+
+// Learn adds a host to the auto mode list, e.g. when loading a saved list.
+func (c *Client) Learn(host string, expire time.Time) {
+	a := c.getAuto()
+	if a == nil {
+		return
+	}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	a.hosts[host] = expire
+}
+
+// Forget removes a host from the auto mode list.
+func (c *Client) Forget(host string) {
+	a := c.getAuto()
+	if a == nil {
+		return
+	}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	delete(a.hosts, host)
+}
+
+func (c *Client) learned(host string) bool {
+	a := c.getAuto()
+	if a == nil {
+		return false
+	}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	expire, ok := a.hosts[host]
+	if ok && time.Now().After(expire) {
+		delete(a.hosts, host)
+		return false
+	}
+	return ok
+}
+
+func (c *Client) learn(a *auto, host string) {
+	expire := time.Now().Add(a.ttl)
+
+	a.l.Lock()
+	a.hosts[host] = expire
+	a.l.Unlock()
+
+	Debug.Println("Auto Learn", host, expire)
+
+	c.Watcher.OnAutoLearn(host, expire)
+}
+
+func (c *Client) autoServer() *Shadow {
+	a := c.getAuto()
+	if a == nil {
+		return nil
+	}
+
+	for _, s := range c.getShadows() {
+		if s.ID == a.server {
+			return s
+		}
+	}
+	return nil
+}
+
+// autoRetry dials addr through the auto server and replays what the
+// client has already sent on the failed direct connection.
+func (c *Client) autoRetry(m *Meta, addr RawAddr, data []byte) (net.Conn, error) {
+	a := c.getAuto()
+	s := c.autoServer()
+	if a == nil || s == nil {
+		return nil, ErrServerNotFound
+	}
+
+	to, err := c.dialShadow(context.Background(), s, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > 0 {
+		if _, err := to.Write(data); err != nil {
+			to.Close()
+			return nil, err
+		}
+	}
+
+	c.learn(a, m.To.Host())
+
+	return to, nil
+}
+
+// client data kept for a retry at most
+const autoReplayMax = 64 * 1024
+
+// autoConn is the server side of an auto relay, while the direct
+// connection is judged the client data is kept for a retry and write
+// errors wait for the judgement
+type autoConn struct {
+	l       sync.Mutex
+	to      net.Conn
+	judging bool
+	sent    []byte
+	over    bool
+	err     error
+}
+
+func (a *autoConn) Write(b []byte) (int, error) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	if !a.judging {
+		return a.to.Write(b)
+	}
+
+	if len(a.sent)+len(b) > autoReplayMax {
+		a.over = true
+	} else {
+		a.sent = append(a.sent, b...)
+	}
+	if a.err == nil {
+		_, a.err = a.to.Write(b)
+	}
+	return len(b), nil
+}
+
+// autoRelay relays a direct connection without waiting: when the server
+// resets or closes it within the window before any answer, the client
+// data so far is replayed through the auto server and the relay goes on
+// there. It reports whether it did, both connections are closed.
+func (c *Client) autoRelay(m *Meta, from net.Conn, to net.Conn, addr RawAddr) (bool, error) {
+	defer from.Close()
+
+	start := time.Now()
+	to.SetDeadline(start.Add(c.getAuto().window))
+
+	a := &autoConn{to: to, judging: true}
+
+	ch := make(chan error, 2)
+	go func() {
+		_, e := io.Copy(a, from)
+		ch <- e
+	}()
+
+	buf := make([]byte, 16*1024)
+	n, err := to.Read(buf)
+
+	a.l.Lock()
+	if n > 0 && a.err != nil {
+		//answered, but client data was lost
+		a.l.Unlock()
+		to.Close()
+		return false, a.err
+	}
+
+	retried := false
+	if n == 0 && (!isTimeout(err) || a.err != nil) {
+		if a.err != nil {
+			err = a.err
+		}
+		Debug.Println("Auto Direct Failed", addr, time.Since(start), err)
+		to.Close()
+
+		if a.over {
+			a.l.Unlock()
+			return false, err
+		}
+
+		to, err = c.autoRetry(m, addr, a.sent)
+		if err != nil {
+			a.l.Unlock()
+			return false, err
+		}
+		retried = true
+	} else {
+		//answered, or slow but not blocked
+		to.SetDeadline(time.Time{})
+	}
+	a.to = c.tickConn(to, 0)
+	a.judging = false
+	a.sent = nil
+	a.l.Unlock()
+
+	defer to.Close()
+
+	if n > 0 {
+		if _, err := from.Write(buf[:n]); err != nil {
+			return retried, err
+		}
+	}
+
+	go func() {
+		_, e := io.Copy(from, a.to)
+		ch <- e
+	}()
+
+	//first err
+	return retried, <-ch
+}
+func isTimeout(err error) bool {
+	t, ok := err.(net.Error)
+	return ok && t.Timeout()
+}
@@ -0,0 +1,224 @@
+package shadowsocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type learnWatcher struct {
+	*defaultWatcher
+
+	l      sync.Mutex
+	hosts  []string
+	expire time.Time
+}
+
+func (w *learnWatcher) OnAutoLearn(host string, expire time.Time) {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	w.hosts = append(w.hosts, host)
+	w.expire = expire
+}
+
+// autoClient has auto mode on server 7, whose connections are sent to
+// the returned channel
+func autoClient(window time.Duration) (*Client, *learnWatcher, chan net.Conn) {
+	c := NewClient("", 5, 5)
+	w := &learnWatcher{defaultWatcher: DefaultWatcher}
+	c.Watcher = w
+
+	proxied := make(chan net.Conn, 1)
+	s := &Shadow{ID: 7, Dial: func(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+		a, b := net.Pipe()
+		proxied <- b
+		return a, nil
+	}}
+	c.shadows.Store([]*Shadow{s})
+
+	c.SetAuto(7, window, time.Hour)
+	return c, w, proxied
+}
+
+func TestAutoLearn(t *testing.T) {
+	c := NewClient("", 5, 5)
+
+	//off until SetAuto
+	c.Learn("a.example", time.Now().Add(time.Hour))
+	if c.learned("a.example") || c.autoServer() != nil {
+		t.Errorf("learned without auto mode")
+	}
+	if _, err := c.autoRetry(&Meta{}, nil, nil); err != ErrServerNotFound {
+		t.Errorf("autoRetry without auto mode: %v", err)
+	}
+
+	c, w, _ := autoClient(time.Second)
+
+	c.Learn("a.example", time.Now().Add(time.Hour))
+	c.Learn("old.example", time.Now().Add(-time.Second))
+
+	if !c.learned("a.example") {
+		t.Errorf("a.example not learned")
+	}
+	if c.learned("old.example") {
+		t.Errorf("expired host learned")
+	}
+	if _, ok := c.getAuto().hosts["old.example"]; ok {
+		t.Errorf("expired host kept")
+	}
+
+	c.Forget("a.example")
+	if c.learned("a.example") {
+		t.Errorf("forgotten host learned")
+	}
+
+	c.learn(c.getAuto(), "b.example")
+	if !c.learned("b.example") {
+		t.Errorf("b.example not learned")
+	}
+	if len(w.hosts) != 1 || w.hosts[0] != "b.example" || time.Until(w.expire) < 59*time.Minute {
+		t.Errorf("watcher told %v %v", w.hosts, w.expire)
+	}
+
+	//a new setting starts a new list
+	c.SetAuto(7, time.Second, time.Hour)
+	if c.learned("b.example") {
+		t.Errorf("list kept by SetAuto")
+	}
+}
+
+type autoResult struct {
+	retried bool
+	err     error
+}
+
+// startRelay runs autoRelay between two pipes, it returns the client
+// end, the direct server end and the result
+func startRelay(c *Client) (net.Conn, net.Conn, chan autoResult) {
+	client, from := net.Pipe()
+	to, direct := net.Pipe()
+
+	addr, _ := Parse2RawAddr("a.example:443")
+	done := make(chan autoResult, 1)
+	go func() {
+		retried, err := c.autoRelay(&Meta{To: addr}, from, to, addr)
+		done <- autoResult{retried, err}
+	}()
+	return client, direct, done
+}
+
+func expectRead(t *testing.T, what string, conn net.Conn, want string) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != want {
+		t.Fatalf("%s read %q %v, want %q", what, buf, err, want)
+	}
+}
+
+func expectDone(t *testing.T, client net.Conn, done chan autoResult, retried bool) {
+	t.Helper()
+
+	client.Close()
+	select {
+	case r := <-done:
+		if r.retried != retried || r.err != nil {
+			t.Errorf("autoRelay = %v %v, want retried %v", r.retried, r.err, retried)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("autoRelay did not end")
+	}
+}
+
+func TestAutoRelayAnswered(t *testing.T) {
+	c, w, _ := autoClient(time.Second)
+	client, direct, done := startRelay(c)
+
+	client.Write([]byte("GET"))
+	expectRead(t, "direct", direct, "GET")
+	direct.Write([]byte("OK"))
+	expectRead(t, "client", client, "OK")
+
+	//relayed as usual after the answer
+	client.Write([]byte("MORE"))
+	expectRead(t, "direct", direct, "MORE")
+
+	expectDone(t, client, done, false)
+	if c.learned("a.example") || len(w.hosts) > 0 {
+		t.Errorf("answered host learned")
+	}
+}
+
+func TestAutoRelayReset(t *testing.T) {
+	c, w, proxied := autoClient(time.Second)
+	client, direct, done := startRelay(c)
+
+	client.Write([]byte("GET"))
+	expectRead(t, "direct", direct, "GET")
+	direct.Close()
+
+	//the request is sent again through the server
+	var p net.Conn
+	select {
+	case p = <-proxied:
+	case <-time.After(time.Second):
+		t.Fatalf("not retried through the server")
+	}
+	expectRead(t, "server", p, "GET")
+	p.Write([]byte("OK"))
+	expectRead(t, "client", client, "OK")
+
+	client.Write([]byte("MORE"))
+	expectRead(t, "server", p, "MORE")
+
+	expectDone(t, client, done, true)
+	if !c.learned("a.example") || len(w.hosts) != 1 {
+		t.Errorf("reset host not learned")
+	}
+}
+
+func TestAutoRelayNoWait(t *testing.T) {
+	//the server speaks first, nothing waits for the window
+	c, _, _ := autoClient(time.Hour)
+	client, direct, done := startRelay(c)
+
+	go direct.Write([]byte("HELLO"))
+
+	start := time.Now()
+	expectRead(t, "client", client, "HELLO")
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("greeting waited %v", time.Since(start))
+	}
+
+	expectDone(t, client, done, false)
+}
+
+func TestAutoRelaySlow(t *testing.T) {
+	//no answer within the window is slow, not blocked
+	c, _, proxied := autoClient(50 * time.Millisecond)
+	client, direct, done := startRelay(c)
+
+	client.Write([]byte("GET"))
+	expectRead(t, "direct", direct, "GET")
+	time.Sleep(150 * time.Millisecond)
+	direct.Write([]byte("OK"))
+	expectRead(t, "client", client, "OK")
+
+	//closed after the window is not retried
+	direct.Close()
+	select {
+	case <-proxied:
+		t.Errorf("retried after the window")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	expectDone(t, client, done, false)
+	if c.learned("a.example") {
+		t.Errorf("slow host learned")
+	}
+}
@@ -1,29 +1,78 @@
 package shadowsocks
 
 import (
+	"context"
 	"errors"
 	"net"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	pac "sshProxy/shadowsocks/pac"
+
+	lru "github.com/hashicorp/golang-lru"
 )
 
 var ErrAllServerUnavailable = errors.New("Failed connect to all available shadowsocks server")
 var ErrDial = errors.New("Dial Error")
+var ErrServerNotFound = errors.New("shadowsocks server not found")
+var ErrACL = errors.New("client address not allowed")
 
 type Client struct {
 	addr     string
 	idx      uint32
-	shadows  []*Shadow
 	listener net.Listener
 
-	localDNS  *dns
-	remoteDNS *dns
+	//[]*Shadow and []*Rules, copied on write and replaced as a whole
+	//so match never takes a lock or sees a half update
+	shadows atomic.Value
+	rules   atomic.Value
+	rl      sync.Mutex
+
+	//*modeState, switched at runtime
+	mode atomic.Value
+
+	//*dns, replaced as a whole when the settings change
+	localDNS  atomic.Value
+	remoteDNS atomic.Value
+	//[]*dnsRoute, longest domain first
+	dnsRoutes atomic.Value
+	//DNSCache and dnsStrategy of all of them
+	dnsCache    atomic.Value
+	dnsStrategy atomic.Value
+	//*Hosts, asked before any dns
+	hosts atomic.Value
+	//*fakeIP of the dns inbound, nil is disabled
+	fakeIP atomic.Value
+
+	//IPPref, order resolved addresses are raced in
+	ipPref atomic.Value
+
+	//*geoIP of GEOIP rules, nil is disabled
+	geoIP atomic.Value
+
+	dnsServer *dnsServer
+
+	//allowed client addresses, nil allows all
+	acl pac.IPNets
+
+	//*auto, nil is disabled
+	auto atomic.Value
+
+	//how long to wait for a server name, 0 disables sniffing
+	sniffTimeout time.Duration
+
+	//decisions of rules matched against resolved addresses
+	matchCache *lru.Cache
 
 	Watcher Watcher
 
 	Traffic Traffic
 
+	//1 when a rule looks at the local process, it is not looked up otherwise
+	needProcess int32
+
 	idleTimeout time.Duration
 	timeout     time.Duration
 }
@@ -35,6 +84,10 @@ func NewClient(addr string, timeout, idleTimeout int) *Client {
 	c.timeout = time.Duration(timeout) * time.Second
 	c.idleTimeout = time.Duration(idleTimeout) * time.Second
 	c.Watcher = DefaultWatcher
+	c.matchCache, _ = lru.New(2000)
+	c.dnsCache.Store(DefaultDNSCache)
+	c.dnsStrategy.Store(dnsStrategy{DNSSequential, dnsTimeout})
+	c.ipPref.Store(PreferIPv6)
 
 	return c
 }
@@ -46,75 +99,390 @@ func (c *Client) AddServer(id uint64, addr, cipher, user, passwd string) error {
 	}
 	t.ID = id
 
-	c.shadows = append(c.shadows, t)
+	c.rl.Lock()
+	defer c.rl.Unlock()
+
+	c.shadows.Store(append(c.getShadows(), t))
 	return nil
 }
 
-func (s *Client) SetLocalDNS(dns string) {
-	var ips []string
-	for _, t := range StrSplit(dns) {
-		if ip := net.ParseIP(t); ip != nil {
-			ips = append(ips, ip.String())
+// SetServer replaces the server with the same id, or adds it. Only the
+// replaced server is closed, other connections are not touched.
+func (c *Client) SetServer(id uint64, addr, cipher, user, passwd string) error {
+	t, err := NewShadow("tcp", addr, cipher, user, passwd)
+	if err != nil {
+		return err
+	}
+	t.ID = id
+
+	c.rl.Lock()
+	defer c.rl.Unlock()
+
+	old := c.getShadows()
+	shadows := make([]*Shadow, 0, len(old)+1)
+	var replaced *Shadow
+
+	for _, s := range old {
+		if s.ID == id {
+			replaced = s
+			shadows = append(shadows, t)
+		} else {
+			shadows = append(shadows, s)
 		}
 	}
+	if replaced == nil {
+		shadows = append(shadows, t)
+	}
 
-	if len(ips) == 0 {
-		return
+	c.shadows.Store(shadows)
+
+	if replaced != nil {
+		replaced.Close()
 	}
+	return nil
+}
+
+// RemoveServer removes and closes the server with the given id.
+func (c *Client) RemoveServer(id uint64) {
+	c.rl.Lock()
+	defer c.rl.Unlock()
 
-	s.localDNS = NewDNS(ips)
+	old := c.getShadows()
+	shadows := make([]*Shadow, 0, len(old))
+	var removed []*Shadow
+
+	for _, s := range old {
+		if s.ID == id {
+			removed = append(removed, s)
+		} else {
+			shadows = append(shadows, s)
+		}
+	}
+
+	c.shadows.Store(shadows)
+
+	for _, s := range removed {
+		s.Close()
+	}
 }
 
-func (s *Client) SetRemoteDNS(dns string) {
-	var ips []string
+func (c *Client) getShadows() []*Shadow {
+	shadows, _ := c.shadows.Load().([]*Shadow)
+	return shadows
+}
+
+// parseDNS keeps the valid servers: ips, https:// and tls:// urls
+func parseDNS(dns string) (servers []string) {
 	for _, t := range StrSplit(dns) {
-		if ip := net.ParseIP(t); ip != nil {
-			ips = append(ips, ip.String())
+		if ValidDNSUpstream(t) {
+			servers = append(servers, t)
+		} else {
+			Debug.Println("DNS Invalid", t)
 		}
 	}
+	return
+}
+
+// newDNS is a dns with the cache settings of the client, logging its
+// lookups to the Watcher as label
+func (c *Client) newDNS(servers []string, label string) *dns {
+	d := NewDNS(servers)
+	d.SetCache(c.dnsCache.Load().(DNSCache))
+	conf := c.dnsStrategy.Load().(dnsStrategy)
+	d.SetStrategy(conf.strategy, conf.timeout)
+
+	d.label = label
+	d.log = func(l *DNSLog) {
+		c.Watcher.OnDNSLog(l)
+	}
+	return d
+}
+
+// swapDNS stores d, nil disables it, and closes the one it replaced
+func swapDNS(v *atomic.Value, d *dns) {
+	old, _ := v.Load().(*dns)
+	v.Store(d)
+
+	if old != nil {
+		old.Close()
+	}
+}
+
+// SetLocalDNS sets the dns servers of direct connections: ips,
+// https://host/dns-query or tls://host:853. An empty list goes back to
+// the system resolver.
+func (s *Client) SetLocalDNS(dns string) {
+	servers := parseDNS(dns)
+	if len(servers) == 0 {
+		swapDNS(&s.localDNS, nil)
+		return
+	}
+
+	swapDNS(&s.localDNS, s.newDNS(servers, "local"))
+}
 
-	if len(ips) == 0 {
+// SetRemoteDNS sets the dns servers of proxied connections, queried
+// through the matching server. An empty list lets the server resolve.
+func (s *Client) SetRemoteDNS(dns string) {
+	servers := parseDNS(dns)
+	if len(servers) == 0 {
+		swapDNS(&s.remoteDNS, nil)
 		return
 	}
 
-	s.remoteDNS = NewDNS(ips)
-	s.remoteDNS.Dial = func(n, addr string) (net.Conn, error) {
-		host, _, _ := net.SplitHostPort(addr)
+	d := s.newDNS(servers, "remote")
+	d.Dial = func(ctx context.Context, n, addr string) (net.Conn, error) {
+		raw, _ := Parse2RawAddr(addr)
 
-		server := s.match(host)
+		server := s.match(&Meta{}, raw)
 		if server != nil {
-			return server.Dial(addr, s.timeout)
+			return server.Dial(ctx, addr, s.timeout)
 		} else {
-			return net.DialTimeout(n, addr, s.timeout)
+			d := net.Dialer{Timeout: s.timeout}
+			return d.DialContext(ctx, n, addr)
 		}
 	}
+
+	swapDNS(&s.remoteDNS, d)
+}
+
+// SetDNSCache sets the ttl clamps, negative ttl and stale window of the
+// local and remote dns, zero fields keep the defaults.
+func (s *Client) SetDNSCache(conf DNSCache) {
+	if conf.MinTTL <= 0 {
+		conf.MinTTL = DefaultDNSCache.MinTTL
+	}
+	if conf.MaxTTL <= 0 {
+		conf.MaxTTL = DefaultDNSCache.MaxTTL
+	}
+	if conf.MaxTTL < conf.MinTTL {
+		conf.MaxTTL = conf.MinTTL
+	}
+	if conf.NegTTL <= 0 {
+		conf.NegTTL = DefaultDNSCache.NegTTL
+	}
+	if conf.Stale <= 0 {
+		conf.Stale = DefaultDNSCache.Stale
+	}
+
+	s.rl.Lock()
+	defer s.rl.Unlock()
+
+	s.dnsCache.Store(conf)
+
+	if d := s.getLocalDNS(); d != nil {
+		d.SetCache(conf)
+	}
+	if d := s.getRemoteDNS(); d != nil {
+		d.SetCache(conf)
+	}
+	for _, r := range s.getDNSRoutes() {
+		r.d.SetCache(conf)
+	}
+}
+
+// SetDNSStrategy sets how the upstreams of the local, remote and route
+// dns are asked and how long one of them is waited for, 0 is 5s.
+func (s *Client) SetDNSStrategy(strategy DNSStrategy, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = dnsTimeout
+	}
+
+	s.rl.Lock()
+	defer s.rl.Unlock()
+
+	s.dnsStrategy.Store(dnsStrategy{strategy, timeout})
+
+	if d := s.getLocalDNS(); d != nil {
+		d.SetStrategy(strategy, timeout)
+	}
+	if d := s.getRemoteDNS(); d != nil {
+		d.SetStrategy(strategy, timeout)
+	}
+	for _, r := range s.getDNSRoutes() {
+		r.d.SetStrategy(strategy, timeout)
+	}
+}
+
+// DNSStats returns the cache and upstream counters of the local and
+// remote dns, nil for the ones not set.
+func (c *Client) DNSStats() (local, remote *DNSStats) {
+	if d := c.getLocalDNS(); d != nil {
+		t := d.Stats()
+		local = &t
+	}
+	if d := c.getRemoteDNS(); d != nil {
+		t := d.Stats()
+		remote = &t
+	}
+	return
+}
+
+func (c *Client) getLocalDNS() *dns {
+	d, _ := c.localDNS.Load().(*dns)
+	return d
+}
+
+func (c *Client) getRemoteDNS() *dns {
+	d, _ := c.remoteDNS.Load().(*dns)
+	return d
+}
+
+// SetGeoIP enables GEOIP rules with the given .mmdb database.
+func (s *Client) SetGeoIP(file string) error {
+	g, err := NewGeoIP(file)
+	if err != nil {
+		return err
+	}
+
+	old := s.getGeoIP()
+	s.geoIP.Store(g)
+
+	//the one replaced stops reloading
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (s *Client) getGeoIP() *geoIP {
+	g, _ := s.geoIP.Load().(*geoIP)
+	return g
+}
+
+// SetACL limits the clients allowed to use the listener to the given
+// ips or cidrs, loopback addresses are always allowed.
+func (s *Client) SetACL(cidrs string) {
+	var acl pac.IPNets
+
+	for _, t := range StrSplit(cidrs) {
+		ipnet, ok := parseIPNet(t)
+		if !ok {
+			Debug.Println("ACL", t)
+			continue
+		}
+		if acl == nil {
+			acl = pac.NewIPNets()
+		}
+		acl.Add(ipnet)
+	}
+
+	s.acl = acl
+}
+
+func (s *Client) allow(from net.Addr) bool {
+	if s.acl == nil {
+		return true
+	}
+
+	ip := AddrIP(from)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || s.acl.Match(ip)
 }
 
 func (c *Client) AddRules(itmes, serverIds string) {
-	var ids []uint64
+	c.rl.Lock()
+	defer c.rl.Unlock()
+
+	rules := append(c.getRules(), NewRules(0, itmes, serverIds))
+	c.storeRules(rules)
+}
+
+// SetRules replaces the rules with the same id, or appends them when
+// there is none yet. It is safe to call while the client is serving.
+func (c *Client) SetRules(r *Rules) {
+	c.rl.Lock()
+	defer c.rl.Unlock()
+
+	id := r.ID
+
+	old := c.getRules()
+	rules := make([]*Rules, 0, len(old)+1)
+	found := false
 
+	for _, t := range old {
+		if id != 0 && t.ID == id {
+			rules = append(rules, r)
+			found = true
+		} else {
+			rules = append(rules, t)
+		}
+	}
+	if !found {
+		rules = append(rules, r)
+	}
+
+	c.storeRules(rules)
+}
+
+// RemoveRules removes the rules with the given id.
+func (c *Client) RemoveRules(id uint64) {
+	c.rl.Lock()
+	defer c.rl.Unlock()
+
+	old := c.getRules()
+	rules := make([]*Rules, 0, len(old))
+
+	for _, t := range old {
+		if t.ID != id {
+			rules = append(rules, t)
+		}
+	}
+
+	c.storeRules(rules)
+}
+
+// ReplaceRules swaps all rules at once, matched in the given order.
+func (c *Client) ReplaceRules(rules []*Rules) {
+	c.rl.Lock()
+	defer c.rl.Unlock()
+
+	c.storeRules(append([]*Rules(nil), rules...))
+}
+
+// storeRules publishes rules, the caller holds rl
+func (c *Client) storeRules(rules []*Rules) {
+	var need int32
+	for _, r := range rules {
+		if r.needProcess() {
+			need = 1
+			break
+		}
+	}
+
+	c.rules.Store(rules)
+	atomic.StoreInt32(&c.needProcess, need)
+}
+
+func (c *Client) getRules() []*Rules {
+	rules, _ := c.rules.Load().([]*Rules)
+	return rules
+}
+
+func parseIds(serverIds string) (ids []uint64) {
 	for _, r := range StrSplit(serverIds) {
 		id, err := strconv.ParseUint(r, 10, 64)
 		if err == nil {
 			ids = append(ids, id)
 		}
 	}
+	return
+}
 
-	if len(ids) < 1 {
-		for _, s := range c.shadows {
-			ids = append(ids, s.ID)
-		}
-	}
+// DialServer connects to addr through the server with the given id.
+func (c *Client) DialServer(id uint64, addr string) (net.Conn, error) {
+	return c.dialServer(context.Background(), id, addr)
+}
 
-	for _, id := range ids {
-		for _, s := range c.shadows {
-			if s.ID == id {
-				for _, r := range StrSplit(itmes) {
-					s.Rule.Add(r)
-				}
-			}
+func (c *Client) dialServer(ctx context.Context, id uint64, addr string) (net.Conn, error) {
+	for _, s := range c.getShadows() {
+		if s.ID == id {
+			return s.Dial(ctx, addr, c.timeout)
 		}
 	}
+	return nil, ErrServerNotFound
 }
 
 func (s *Client) ListenAndServe() (e error) {
@@ -134,18 +502,37 @@ func (s *Client) ListenAndServe() (e error) {
 }
 
 func (s *Client) Close() {
-	s.listener.Close()
-	if s.localDNS != nil {
-		s.localDNS.Close()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if d := s.getLocalDNS(); d != nil {
+		d.Close()
+	}
+	if d := s.getRemoteDNS(); d != nil {
+		d.Close()
+	}
+	for _, r := range s.getDNSRoutes() {
+		r.d.Close()
 	}
-	if s.remoteDNS != nil {
-		s.remoteDNS.Close()
+	if g := s.getGeoIP(); g != nil {
+		g.Close()
+	}
+	if s.dnsServer != nil {
+		s.dnsServer.Close()
+	}
+	for _, t := range s.getShadows() {
+		t.Close()
 	}
 }
 
 func (s *Client) Serve(from net.Conn) {
 	defer from.Close()
 
+	if !s.allow(from.RemoteAddr()) {
+		s.Watcher.OnSocksInvalid(from.RemoteAddr(), ErrACL)
+		return
+	}
+
 	from.SetReadDeadline(time.Now().Add(s.timeout))
 
 	addr, err := HandShake(from)
@@ -154,16 +541,54 @@ func (s *Client) Serve(from net.Conn) {
 		return
 	}
 
+	//a fake ip of the dns inbound goes by its name
+	addr, ok := s.unfake(addr)
+	if !ok {
+		s.Watcher.OnSocksInvalid(from.RemoteAddr(), ErrFakeIPUnknown)
+		return
+	}
+
 	host := addr.Host()
 
 	if s.Watcher.Hijacker(host, from) {
 		return
 	}
 
+	m := &Meta{
+		From: from.RemoteAddr(),
+		To:   addr,
+	}
+
+	if ip := AddrIP(m.From); ip != nil && ip.IsLoopback() && atomic.LoadInt32(&s.needProcess) == 1 {
+		var e error
+		m.PID, m.UID, m.Process, e = lookupProcess(from.RemoteAddr(), from.LocalAddr())
+		m.UIDKnown = m.UID >= 0
+		if e != nil {
+			Debug.Println("Lookup Process", from.RemoteAddr(), e)
+		}
+	}
+
 	from = s.trafficConn(from, &s.Traffic, nil)
-	to, ac, err := s.dial(addr)
 
-	s.Watcher.OnProxyStart(ac, from.RemoteAddr(), addr)
+	if s.sniffTimeout > 0 && addr.ToIP() != nil && s.getMode().mode == ModeRule {
+		from, m.Sniffed = s.sniff(from)
+		if m.Sniffed != "" {
+			Debug.Println("Sniffed", addr, m.Sniffed)
+		}
+	}
+
+	to, ac, err := s.dial(context.Background(), m, addr)
+
+	probe := s.getAuto() != nil && !ac && !m.Matched
+	if probe && err != nil {
+		Debug.Println("Auto Direct Failed", addr, err)
+
+		to, err = s.autoRetry(m, addr, nil)
+		ac = err == nil
+		probe = false
+	}
+
+	s.Watcher.OnProxyStart(ac, from.RemoteAddr(), addr, m)
 	defer func() {
 		s.Watcher.OnProxyStop(ac, from.RemoteAddr(), addr, err)
 	}()
@@ -172,94 +597,154 @@ func (s *Client) Serve(from net.Conn) {
 		Debug.Println("Dial", err)
 		return
 	}
-	defer to.Close()
 
-	err = Relay(s.tickConn(from, time.Second), s.tickConn(to, 0))
+	if probe {
+		//judged while relaying
+		ac, err = s.autoRelay(m, s.tickConn(from, time.Second), to, addr)
+	} else {
+		defer to.Close()
+		err = Relay(s.tickConn(from, time.Second), s.tickConn(to, 0))
+	}
 	if err != nil {
 		Debug.Println("Relay", err)
 	}
 }
 
-func (c *Client) match(addr string) *Shadow {
-	for i := 0; i < len(c.shadows); i++ {
-		idx := int(atomic.AddUint32(&c.idx, 1) % uint32(len(c.shadows)))
-
-		s := c.shadows[idx]
+func (s *Client) dial(ctx context.Context, m *Meta, addr RawAddr) (conn net.Conn, ac bool, err error) {
+	switch md := s.getMode(); md.mode {
+	case ModeGlobal:
+		m.Matched = true
 
-		if s.Rule.Match(addr) {
-			return s
+		server := s.pick(s.candidates(md.servers))
+		if server == nil {
+			return nil, true, ErrAllServerUnavailable
 		}
+		conn, err = s.dialShadow(ctx, server, addr)
+		return conn, true, err
+
+	case ModeDirect:
+		m.Matched = true
+		return s.dialLocal(ctx, m, addr)
 	}
 
-	return nil
-}
+	var server *Shadow
+
+	//the sniffed name comes first so domain rules win over ip rules
+	if m.Sniffed != "" {
+		if raw, err := Parse2RawAddr(net.JoinHostPort(m.Sniffed, addr.PortString())); err == nil {
+			server = s.match(m, raw)
+		}
+	}
+	if server == nil {
+		server = s.match(m, addr)
+	}
 
-func (s *Client) dial(addr RawAddr) (conn net.Conn, ac bool, err error) {
-	server := s.match(addr.String())
+	if server == nil && (s.learned(m.To.Host()) || s.learned(addr.Host()) || s.learned(m.Sniffed)) {
+		server = s.autoServer()
+		m.Matched = server != nil
+	}
 
 	Debug.Println("Match", server != nil, addr.String())
 
 	if server != nil {
-		conn, err = s.dialShadow(server, addr)
+		conn, err = s.dialShadow(ctx, server, addr)
 		ac = true
 		return
 	}
 
-	return s.dialLocal(addr)
+	return s.dialLocal(ctx, m, addr)
 }
 
-func (c *Client) dialShadow(s *Shadow, addr RawAddr) (net.Conn, error) {
-	var addrs []RawAddr
+func (c *Client) dialShadow(ctx context.Context, s *Shadow, addr RawAddr) (net.Conn, error) {
+	var ipaddr []net.IPAddr
 
-	if addr.ToIP() == nil && c.remoteDNS != nil {
-		ipaddr, err := c.remoteDNS.LookupIPAddr(addr.Host())
-		if err != nil {
-			return nil, err
-		}
+	//hosts entries come before the dns
+	if addr.ToIP() == nil {
+		ipaddr = c.lookupHosts(addr.Host())
 
-		t := make([]RawAddr, len(ipaddr))
-		for i, p := range ipaddr {
-			t[i] = IP2RawAddr(p.IP, addr.Port())
+		if d := c.resolver(addr.Host(), true); ipaddr == nil && d != nil {
+			var err error
+			ipaddr, err = d.LookupIPAddr(addr.Host())
+			if err != nil {
+				return nil, err
+			}
 		}
-		addrs = t
-	} else {
-		addrs = append(addrs, addr)
 	}
 
-	for _, add := range addrs {
-		to, err := s.Dial(add.String(), c.timeout)
-		if err == nil {
-			return to, nil
+	//the server resolves it
+	if ipaddr == nil {
+		to, err := s.Dial(ctx, addr.String(), c.timeout)
+		if err != nil {
+			return nil, ErrDial
 		}
+		return to, nil
 	}
 
-	return nil, ErrDial
+	ips := sortAddrs(ipaddr, c.getIPPref())
+
+	to, _, err := race(ctx, len(ips), func(ctx context.Context, i int) (net.Conn, error) {
+		return s.Dial(ctx, IP2RawAddr(ips[i], addr.Port()).String(), c.timeout)
+	})
+	if err != nil {
+		return nil, ErrDial
+	}
+	return to, nil
 }
 
-func (c *Client) dialLocal(addr RawAddr) (net.Conn, bool, error) {
-	var addrs []RawAddr
+func (c *Client) dialLocal(ctx context.Context, m *Meta, addr RawAddr) (net.Conn, bool, error) {
+	pref := c.getIPPref()
 
-	if addr.ToIP() == nil && c.localDNS != nil {
-		ipaddr, err := c.localDNS.LookupIPAddr(addr.Host())
-		if err != nil {
-			return nil, false, err
+	var ipaddr []net.IPAddr
+
+	//hosts entries come before the dns
+	if addr.ToIP() == nil {
+		ipaddr = c.lookupHosts(addr.Host())
+
+		if d := c.resolver(addr.Host(), false); ipaddr == nil && d != nil {
+			var err error
+			ipaddr, err = d.LookupIPAddr(addr.Host())
+			if err != nil {
+				return nil, false, err
+			}
 		}
+	}
 
-		t := make([]RawAddr, len(ipaddr))
-		for i, p := range ipaddr {
-			t[i] = IP2RawAddr(p.IP, addr.Port())
+	if ipaddr != nil {
+		ips := sortAddrs(ipaddr, pref)
+		if len(ips) == 0 {
+			return nil, false, ErrNoIPv4
 		}
-		addrs = t
 
-		for _, add := range addrs {
-			to, ac, err := c.dial(add)
-			if err == nil {
-				return to, ac, nil
-			}
+		//each attempt matches the rules on its own copy
+		base := *m
+		base.geoDone = false
+
+		metas := make([]Meta, len(ips))
+		acs := make([]bool, len(ips))
+
+		to, i, err := race(ctx, len(ips), func(ctx context.Context, i int) (net.Conn, error) {
+			metas[i] = base
+
+			to, ac, err := c.dial(ctx, &metas[i], IP2RawAddr(ips[i], addr.Port()))
+			acs[i] = ac
+			return to, err
+		})
+		if err != nil {
+			return nil, false, err
 		}
+
+		*m = metas[i]
+		return to, acs[i], nil
+	}
+
+	//an ip, or a name left to the system resolver
+	network := "tcp"
+	if pref == IPv4Only {
+		network = "tcp4"
 	}
 
-	to, err := net.DialTimeout("tcp", addr.String(), c.timeout)
+	d := net.Dialer{Timeout: c.timeout}
+	to, err := d.DialContext(ctx, network, addr.String())
 	return to, false, err
 }
 
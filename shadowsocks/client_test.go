@@ -0,0 +1,120 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientACL(t *testing.T) {
+	c := NewClient("", 5, 5)
+
+	tcp := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 5000}
+	}
+
+	//no acl allows all
+	if !c.allow(tcp("203.0.113.9")) {
+		t.Errorf("denied without an acl")
+	}
+
+	c.SetACL("192.168.1.0/24\n10.0.0.5\nfd00::/8\nnot-a-cidr")
+
+	tests := []struct {
+		from net.Addr
+		want bool
+	}{
+		{tcp("192.168.1.20"), true},
+		{tcp("192.168.2.20"), false},
+		{tcp("10.0.0.5"), true},
+		{tcp("10.0.0.6"), false},
+		{tcp("fd00::9"), true},
+		{tcp("2001:db8::9"), false},
+		//loopback always
+		{tcp("127.0.0.1"), true},
+		{tcp("::1"), true},
+		//an address without an ip
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := c.allow(tt.from); got != tt.want {
+			t.Errorf("allow(%v) = %v, want %v", tt.from, got, tt.want)
+		}
+	}
+
+	//only invalid entries is no acl
+	c.SetACL("not-a-cidr")
+	if !c.allow(tcp("203.0.113.9")) {
+		t.Errorf("denied by an acl of invalid entries")
+	}
+}
+
+type invalidWatcher struct {
+	*defaultWatcher
+	err chan error
+}
+
+func (w *invalidWatcher) OnSocksInvalid(from net.Addr, err error) {
+	w.err <- err
+}
+
+func TestServeACL(t *testing.T) {
+	c := NewClient("", 5, 5)
+	w := &invalidWatcher{defaultWatcher: DefaultWatcher, err: make(chan error, 1)}
+	c.Watcher = w
+	c.SetACL("10.0.0.0/8")
+
+	//a pipe has no ip, it is not an allowed client
+	a, b := net.Pipe()
+	defer b.Close()
+	go c.Serve(a)
+
+	select {
+	case err := <-w.err:
+		if err != ErrACL {
+			t.Errorf("rejected with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("not rejected")
+	}
+}
+
+func TestMatchSource(t *testing.T) {
+	c := NewClient("", 5, 5)
+
+	src := NewRules(1, "src:192.168.1.0/24", "")
+	both := NewRules(2, "src:192.168.1.0/24\nexample.com", "")
+
+	tests := []struct {
+		r    *Rules
+		from string
+		to   string
+		want string
+	}{
+		//a rule of only sources matches every destination
+		{src, "192.168.1.5:5000", "other.net:443", "client"},
+		{src, "192.168.2.5:5000", "other.net:443", ""},
+		{src, "", "other.net:443", ""},
+		//with destinations both have to match
+		{both, "192.168.1.5:5000", "www.example.com:443", "domain"},
+		{both, "192.168.1.5:5000", "other.net:443", ""},
+		{both, "192.168.2.5:5000", "www.example.com:443", ""},
+	}
+
+	for _, tt := range tests {
+		m := &Meta{}
+		if tt.from != "" {
+			m.From, _ = net.ResolveTCPAddr("tcp", tt.from)
+		}
+		addr, err := Parse2RawAddr(tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := c.matchRules(m, tt.r, addr); got != tt.want {
+			t.Errorf("rule %d from %q to %s: %q, want %q", tt.r.ID, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
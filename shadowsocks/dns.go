@@ -2,16 +2,83 @@ package shadowsocks
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
 )
 
+// one attempt at an upstream
+const dnsTimeout = 5 * time.Second
+
+// DNSCache tunes how long answers are kept.
+type DNSCache struct {
+	//clamps of the record ttl
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	//NXDOMAIN and empty answers, a shorter SOA ttl wins
+	NegTTL time.Duration
+	//an expired answer is still served this long while it is refreshed
+	Stale time.Duration
+}
+
+var DefaultDNSCache = DNSCache{
+	MinTTL: 30 * time.Second,
+	MaxTTL: time.Hour,
+	NegTTL: 30 * time.Second,
+	Stale:  10 * time.Minute,
+}
+
+// cache state of a lookup
+const (
+	dnsCacheHit      = "hit"
+	dnsCacheNegative = "negative"
+	dnsCacheStale    = "stale"
+	dnsCacheMiss     = "miss"
+)
+
+// DNSLog is one lookup, for Watcher.OnDNSLog.
+type DNSLog struct {
+	Name string
+	//local, remote, route <domain> or system
+	Resolver string
+	IPs      []net.IPAddr
+	Latency  time.Duration
+	//hit, negative, stale or miss, empty for the system resolver
+	Cache string
+	Err   error
+}
+
+// DNSStats counts the lookups of a dns.
+type DNSStats struct {
+	Hits     uint64
+	Stale    uint64
+	Negative uint64
+	Misses   uint64
+	Errors   uint64
+	Size     int
+	//in the order they were given
+	Upstreams []DNSUpstreamStats
+}
+
 type dnsVal struct {
+	//lookups answered from the cache, atomic
+	hits uint64
+
 	ipaddr []net.IPAddr
-	expire time.Time
+	//NXDOMAIN or no records
+	negative bool
+	expire   time.Time
+}
+
+// ttl is the seconds left, rounded up
+func (v *dnsVal) ttl(now time.Time) uint32 {
+	return uint32((v.expire.Sub(now) + time.Second - 1) / time.Second)
 }
 
 type dnsLocker struct {
@@ -20,85 +87,288 @@ type dnsLocker struct {
 }
 
 type dns struct {
-	dns      []string
+	//atomic counters first for 64 bit alignment
+	stats DNSStats
+
+	dns      []*dnsUpstream
 	lru      *lru.Cache
-	job      chan string
-	idx      uint16
-	resolver net.Resolver
-	l        sync.Mutex
-	lh       map[string]*dnsLocker
+	cache    atomic.Value
+	strategy atomic.Value
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	l          sync.Mutex
+	lh         map[string]*dnsLocker
+	refreshing map[string]bool
+	closed     bool
+
+	//Resolver of its DNSLog
+	label string
+	log   func(*DNSLog)
 
-	Dial func(n, addr string) (net.Conn, error)
+	Dial func(ctx context.Context, n, addr string) (net.Conn, error)
 }
 
-func NewDNS(ips []string) *dns {
+// NewDNS resolves with the given servers, plain ips, DNS over HTTPS
+// urls like https://host/dns-query or DNS over TLS like tls://host:853.
+// Invalid servers are skipped, the valid ones are asked in order until
+// SetStrategy says otherwise.
+func NewDNS(servers []string) *dns {
 	lru, _ := lru.New(2000)
 
 	d := &dns{
-		dns: ips,
-		lru: lru,
-		job: make(chan string, 100),
-		lh:  make(map[string]*dnsLocker),
+		lru:        lru,
+		lh:         make(map[string]*dnsLocker),
+		refreshing: make(map[string]bool),
 	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.cache.Store(DefaultDNSCache)
+	d.SetStrategy(DNSSequential, dnsTimeout)
 
-	d.resolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
-		ip := d.dns[int(d.idx)%len(d.dns)]
-		d.idx++
-
-		_, port, _ := net.SplitHostPort(address)
-		addr := net.JoinHostPort(ip, port)
-
-		if d.Dial != nil {
-			return d.Dial(network, addr)
-		} else {
-			return net.Dial(network, addr)
+	for _, s := range servers {
+		if u := parseDNSUpstream(d, s); u != nil {
+			d.dns = append(d.dns, u)
 		}
 	}
 
-	go d.run()
-
 	return d
 }
 
+// Close stops the background refreshes and fails the lookups in flight.
 func (d *dns) Close() {
-	close(d.job)
+	d.l.Lock()
+	d.closed = true
+	d.l.Unlock()
+
+	d.cancel()
+
+	for _, u := range d.dns {
+		u.Close()
+	}
 }
 
-func (d *dns) run() {
-	for {
-		host, ok := <-d.job
-		if !ok {
-			break
-		}
+func (d *dns) SetCache(c DNSCache) {
+	d.cache.Store(c)
+}
+
+func (d *dns) getCache() DNSCache {
+	return d.cache.Load().(DNSCache)
+}
+
+func (d *dns) Stats() DNSStats {
+	t := DNSStats{
+		Hits:     atomic.LoadUint64(&d.stats.Hits),
+		Stale:    atomic.LoadUint64(&d.stats.Stale),
+		Negative: atomic.LoadUint64(&d.stats.Negative),
+		Misses:   atomic.LoadUint64(&d.stats.Misses),
+		Errors:   atomic.LoadUint64(&d.stats.Errors),
+		Size:     d.lru.Len(),
+	}
+	for _, u := range d.dns {
+		t.Upstreams = append(t.Upstreams, u.stats())
+	}
+	return t
+}
+
+// dial connects to an upstream through the Dial hook
+func (d *dns) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.Dial != nil {
+		return d.Dial(ctx, network, addr)
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func dnsID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
 
-		if t, ok := d.lru.Get(host); ok {
-			if time.Now().Before(t.(dnsVal).expire) {
-				continue
+// query resolves A and AAAA together, negative answers are returned as
+// a dnsVal too so they get cached
+func (d *dns) query(host string) (*dnsVal, error) {
+	types := []uint16{dnsTypeA, dnsTypeAAAA}
+	answers := make([]*dnsAnswer, len(types))
+	errs := make([]error, len(types))
+
+	var wg sync.WaitGroup
+	for i, qtype := range types {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+
+			query, err := dnsQuery(dnsID(), host, qtype)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			resp, err := d.exchange(d.ctx, query)
+			if err != nil {
+				errs[i] = err
+				return
 			}
+			answers[i], errs[i] = parseDNSAnswer(resp, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	conf := d.getCache()
+
+	v := &dnsVal{}
+	ttl := ^uint32(0)
+	nx := false
+	var err error
+
+	for i, a := range answers {
+		if a == nil {
+			err = errs[i]
+			continue
+		}
+
+		switch a.rcode {
+		case 0:
+		case dnsRcodeNXDomain:
+			nx = true
+			continue
+		default:
+			err = &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+			continue
 		}
 
-		go d._lookupIPAddr(host)
+		for _, ip := range a.ips {
+			v.ipaddr = append(v.ipaddr, net.IPAddr{IP: ip})
+		}
+		if len(a.ips) > 0 && a.ttl < ttl {
+			ttl = a.ttl
+		}
 	}
+
+	now := time.Now()
+
+	if len(v.ipaddr) > 0 {
+		t := time.Duration(ttl) * time.Second
+		if t < conf.MinTTL {
+			t = conf.MinTTL
+		}
+		if conf.MaxTTL > 0 && t > conf.MaxTTL {
+			t = conf.MaxTTL
+		}
+		v.expire = now.Add(t)
+		return v, nil
+	}
+
+	//the name does not exist, or both types answered without records
+	if nx || err == nil {
+		t := conf.NegTTL
+		for _, a := range answers {
+			if a != nil && a.negTTL >= 0 && time.Duration(a.negTTL)*time.Second < t {
+				t = time.Duration(a.negTTL) * time.Second
+			}
+		}
+		v.negative = true
+		v.expire = now.Add(t)
+		return v, nil
+	}
+
+	return nil, err
+}
+
+func (d *dns) notFound(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
 }
 
-func (d *dns) _lookupIPAddr(host string) ([]net.IPAddr, error) {
-	ipaddr, err := d.resolver.LookupIPAddr(context.Background(), host)
+// resolve queries host and stores the answer
+func (d *dns) resolve(host string) (*dnsVal, error) {
+	v, err := d.query(host)
 	if err != nil {
+		atomic.AddUint64(&d.stats.Errors, 1)
 		Debug.Println("Lookup", host, err)
 		return nil, err
 	}
 
-	v := dnsVal{
-		ipaddr: ipaddr,
-		expire: time.Now().Add(2 * time.Minute),
+	if v.expire.After(time.Now()) {
+		if t, ok := d.lru.Peek(host); ok {
+			v.hits = atomic.LoadUint64(&t.(*dnsVal).hits)
+		}
+		d.lru.Add(host, v)
+	}
+	return v, nil
+}
+
+// refresh resolves host again in the background, once at a time
+func (d *dns) refresh(host string) {
+	d.l.Lock()
+	if d.closed || d.refreshing[host] {
+		d.l.Unlock()
+		return
 	}
+	d.refreshing[host] = true
+	d.l.Unlock()
 
-	d.lru.Add(host, v)
+	go func() {
+		d.resolve(host)
 
-	return ipaddr, nil
+		d.l.Lock()
+		delete(d.refreshing, host)
+		d.l.Unlock()
+	}()
 }
 
 func (d *dns) LookupIPAddr(host string) ([]net.IPAddr, error) {
+	ipaddr, _, err := d.lookupTTL(host)
+	return ipaddr, err
+}
+
+// lookupTTL also returns the seconds the answer stays valid
+func (d *dns) lookupTTL(host string) (ipaddr []net.IPAddr, ttl uint32, err error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, 0, nil
+	}
+
+	start := time.Now()
+
+	v, ttl, cache := d.cached(host)
+	switch cache {
+	case dnsCacheHit:
+		atomic.AddUint64(&d.stats.Hits, 1)
+	case dnsCacheNegative:
+		atomic.AddUint64(&d.stats.Negative, 1)
+	case dnsCacheStale:
+		atomic.AddUint64(&d.stats.Stale, 1)
+	default:
+		cache = dnsCacheMiss
+		v, ttl, err = d.lookupMiss(host)
+	}
+
+	if err == nil && v.negative {
+		err = d.notFound(host)
+	}
+	if err == nil {
+		ipaddr = v.ipaddr
+	}
+
+	if d.log != nil {
+		d.log(&DNSLog{
+			Name:     host,
+			Resolver: d.label,
+			IPs:      ipaddr,
+			Latency:  time.Since(start),
+			Cache:    cache,
+			Err:      err,
+		})
+	}
+
+	return ipaddr, ttl, err
+}
+
+// lookupMiss resolves host once for all lookups waiting on it
+func (d *dns) lookupMiss(host string) (*dnsVal, uint32, error) {
 	d.l.Lock()
 	l, ok := d.lh[host]
 	if !ok {
@@ -124,18 +394,62 @@ func (d *dns) LookupIPAddr(host string) ([]net.IPAddr, error) {
 	l.l.Lock()
 	defer l.l.Unlock()
 
-	if t, ok := d.lru.Get(host); ok {
-		v := t.(dnsVal)
+	atomic.AddUint64(&d.stats.Misses, 1)
+
+	//answered while waiting for the lock
+	if v, ttl, cache := d.cached(host); cache != "" {
+		return v, ttl, nil
+	}
+
+	v, err := d.resolve(host)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, v.ttl(time.Now()), nil
+}
+
+// cached returns an answer that is fresh or within the stale window
+// and which of them it is, a stale one is refreshed in the background
+func (d *dns) cached(host string) (*dnsVal, uint32, string) {
+	t, ok := d.lru.Get(host)
+	if !ok {
+		return nil, 0, ""
+	}
+	v := t.(*dnsVal)
 
-		if time.Now().After(v.expire) {
-			d.job <- host
-			Debug.Println("Lookup Refresh", host, v.ipaddr)
-		} else {
-			Debug.Println("Lookup Cached", host, v.ipaddr)
+	now := time.Now()
+
+	if now.Before(v.expire) {
+		Debug.Println("Lookup Cached", host, v.ipaddr)
+		atomic.AddUint64(&v.hits, 1)
+
+		if v.negative {
+			return v, v.ttl(now), dnsCacheNegative
 		}
+		return v, v.ttl(now), dnsCacheHit
+	}
 
-		return v.ipaddr, nil
+	if v.negative || now.After(v.expire.Add(d.getCache().Stale)) {
+		return nil, 0, ""
 	}
 
-	return d._lookupIPAddr(host)
+	Debug.Println("Lookup Refresh", host, v.ipaddr)
+	atomic.AddUint64(&v.hits, 1)
+	d.refresh(host)
+
+	//RFC 8767 suggests 30s for stale answers
+	return v, 30, dnsCacheStale
+}
+
+// Exchange sends a raw query to one of the servers and returns the raw
+// answer, for the record types LookupIPAddr does not cover.
+func (d *dns) Exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, ErrDNSMsg
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx, timeout)
+	defer cancel()
+
+	return d.exchange(ctx, query)
 }
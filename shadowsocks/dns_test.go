@@ -0,0 +1,263 @@
+package shadowsocks
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testUpstream is a dns server answering with reply, d.Dial reaches it
+// whatever the address. The queries it got are counted.
+func testUpstream(t *testing.T, reply func(query []byte, q *dnsQuestion) []byte) (func(context.Context, string, string) (net.Conn, error), *int32) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	var queries int32
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			n, from, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&queries, 1)
+
+			query := append([]byte(nil), b[:n]...)
+			go func() {
+				q, err := parseDNSQuery(query)
+				if err != nil {
+					return
+				}
+				pc.WriteTo(reply(query, q), from)
+			}()
+		}
+	}()
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, pc.LocalAddr().String())
+	}
+	return dial, &queries
+}
+
+// cacheDNS is a dns of a testUpstream
+func cacheDNS(t *testing.T, reply func(query []byte, q *dnsQuestion) []byte) (*dns, *int32) {
+	d := NewDNS([]string{"10.0.0.9"})
+	t.Cleanup(d.Close)
+
+	var queries *int32
+	d.Dial, queries = testUpstream(t, reply)
+	return d, queries
+}
+
+// answerTTL answers A queries with 1.2.3.4 for ttl seconds
+func answerTTL(ttl uint32) func([]byte, *dnsQuestion) []byte {
+	return func(query []byte, q *dnsQuestion) []byte {
+		return dnsReply(query, q, 0, []net.IP{net.IPv4(1, 2, 3, 4)}, ttl)
+	}
+}
+
+// cachedFor is how long host stays in the cache of d
+func cachedFor(t *testing.T, d *dns, host string) time.Duration {
+	v, ok := d.lru.Peek(host)
+	if !ok {
+		t.Fatalf("%s not cached", host)
+	}
+	return time.Until(v.(*dnsVal).expire)
+}
+
+// near reports whether got is want, less what the test took
+func near(got, want time.Duration) bool {
+	return got <= want && got > want-5*time.Second
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	conf := DNSCache{MinTTL: 30 * time.Second, MaxTTL: time.Hour, NegTTL: 30 * time.Second, Stale: 10 * time.Minute}
+
+	tests := []struct {
+		ttl  uint32
+		want time.Duration
+	}{
+		{5, 30 * time.Second},
+		{300, 300 * time.Second},
+		{7200, time.Hour},
+	}
+
+	for _, tt := range tests {
+		d, _ := cacheDNS(t, answerTTL(tt.ttl))
+		d.SetCache(conf)
+
+		ipaddr, ttl, err := d.lookupTTL("a.example")
+		if err != nil || len(ipaddr) != 1 {
+			t.Fatalf("ttl %d: %v %v", tt.ttl, ipaddr, err)
+		}
+		if got := cachedFor(t, d, "a.example"); !near(got, tt.want) {
+			t.Errorf("ttl %d cached for %v, want %v", tt.ttl, got, tt.want)
+		}
+		if time.Duration(ttl)*time.Second != tt.want {
+			t.Errorf("ttl %d returned as %d, want %v", tt.ttl, ttl, tt.want)
+		}
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	//no such name, with a soa minimum of soaTTL when it is not 0
+	nxdomain := func(soaTTL uint32) func([]byte, *dnsQuestion) []byte {
+		return func(query []byte, q *dnsQuestion) []byte {
+			b := dnsReply(query, q, dnsRcodeNXDomain, nil, 0)
+			if soaTTL > 0 {
+				soa := append([]byte{0, 0}, make([]byte, 20)...)
+				binary.BigEndian.PutUint32(soa[18:], soaTTL)
+				b = append(b, dnsRR([]byte{0xc0, 12}, 6, 900, soa)...)
+				binary.BigEndian.PutUint16(b[8:], 1)
+			}
+			return b
+		}
+	}
+
+	d, queries := cacheDNS(t, nxdomain(0))
+
+	if _, err := d.LookupIPAddr("nope.example"); !isNotFound(err) {
+		t.Fatalf("got %v", err)
+	}
+	if got := cachedFor(t, d, "nope.example"); !near(got, DefaultDNSCache.NegTTL) {
+		t.Errorf("cached for %v, want the negative ttl", got)
+	}
+
+	//answered from the cache
+	before := atomic.LoadInt32(queries)
+	if _, err := d.LookupIPAddr("nope.example"); !isNotFound(err) {
+		t.Errorf("cached got %v", err)
+	}
+	if atomic.LoadInt32(queries) != before {
+		t.Errorf("negative answer not cached")
+	}
+
+	//expired, it is asked again and never served stale
+	v, _ := d.lru.Peek("nope.example")
+	v.(*dnsVal).expire = time.Now().Add(-time.Second)
+	if _, err := d.LookupIPAddr("nope.example"); !isNotFound(err) {
+		t.Errorf("expired got %v", err)
+	}
+	if atomic.LoadInt32(queries) == before {
+		t.Errorf("expired negative answer served")
+	}
+
+	//a shorter soa minimum wins
+	d, _ = cacheDNS(t, nxdomain(5))
+	d.LookupIPAddr("nope.example")
+	if got := cachedFor(t, d, "nope.example"); !near(got, 5*time.Second) {
+		t.Errorf("cached for %v, want the soa ttl", got)
+	}
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*net.DNSError)
+	return ok && e.IsNotFound
+}
+
+func TestDNSCacheStale(t *testing.T) {
+	var ttl uint32 = 300
+	var l sync.Mutex
+
+	d, queries := cacheDNS(t, func(query []byte, q *dnsQuestion) []byte {
+		l.Lock()
+		defer l.Unlock()
+		return answerTTL(ttl)(query, q)
+	})
+
+	var logs []string
+	d.log = func(t *DNSLog) {
+		l.Lock()
+		defer l.Unlock()
+		logs = append(logs, t.Cache)
+	}
+	lastLog := func() string {
+		l.Lock()
+		defer l.Unlock()
+		return logs[len(logs)-1]
+	}
+
+	if _, err := d.LookupIPAddr("a.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	//expired within the stale window: the old answer at once, refreshed
+	//in the background
+	l.Lock()
+	ttl = 600
+	l.Unlock()
+
+	v, _ := d.lru.Peek("a.example")
+	v.(*dnsVal).expire = time.Now().Add(-time.Minute)
+	before := atomic.LoadInt32(queries)
+
+	ipaddr, got, err := d.lookupTTL("a.example")
+	if err != nil || len(ipaddr) != 1 || got != 30 || lastLog() != dnsCacheStale {
+		t.Errorf("stale lookup %v ttl %d %v, logged %s", ipaddr, got, err, lastLog())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !near(cachedFor(t, d, "a.example"), 600*time.Second) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := cachedFor(t, d, "a.example"); !near(got, 600*time.Second) {
+		t.Errorf("not refreshed, cached for %v", got)
+	}
+	if n := atomic.LoadInt32(queries) - before; n != 2 {
+		t.Errorf("refresh sent %d queries, want a and aaaa", n)
+	}
+
+	//past the stale window it is a miss again
+	v, _ = d.lru.Peek("a.example")
+	v.(*dnsVal).expire = time.Now().Add(-DefaultDNSCache.Stale - time.Second)
+	if _, err := d.LookupIPAddr("a.example"); err != nil || lastLog() != dnsCacheMiss {
+		t.Errorf("past the stale window: %v, logged %s", err, lastLog())
+	}
+}
+
+func TestDNSSingleFlight(t *testing.T) {
+	d, queries := cacheDNS(t, func(query []byte, q *dnsQuestion) []byte {
+		time.Sleep(100 * time.Millisecond)
+		return answerTTL(300)(query, q)
+	})
+
+	lookups := func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := d.LookupIPAddr("a.example"); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	//one miss for all of them
+	lookups()
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Errorf("%d queries for concurrent misses, want a and aaaa", n)
+	}
+
+	//and one refresh of a stale answer
+	v, _ := d.lru.Peek("a.example")
+	v.(*dnsVal).expire = time.Now().Add(-time.Minute)
+	lookups()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for cachedFor(t, d, "a.example") < 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(queries); n != 4 {
+		t.Errorf("%d queries after concurrent stale lookups, want 4", n)
+	}
+}
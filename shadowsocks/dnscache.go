@@ -0,0 +1,138 @@
+package shadowsocks
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// names refreshed in the background after RestoreDNSCache
+const dnsRefreshTop = 20
+
+// snapshots older than this are not restored
+const dnsRestoreMax = 24 * time.Hour
+
+// DNSCacheEntry is a cached answer saved across restarts.
+type DNSCacheEntry struct {
+	//local, remote or route <domain>
+	Resolver string
+	Name     string
+	IPs      []net.IP
+	Expire   time.Time
+	Hits     uint64
+}
+
+// snapshot returns the positive answers still within the stale window
+func (d *dns) snapshot() []DNSCacheEntry {
+	stale := d.getCache().Stale
+	now := time.Now()
+
+	var es []DNSCacheEntry
+	for _, k := range d.lru.Keys() {
+		t, ok := d.lru.Peek(k)
+		if !ok {
+			continue
+		}
+		v := t.(*dnsVal)
+
+		if v.negative || now.After(v.expire.Add(stale)) {
+			continue
+		}
+
+		e := DNSCacheEntry{
+			Resolver: d.label,
+			Name:     k.(string),
+			Expire:   v.expire,
+			Hits:     atomic.LoadUint64(&v.hits),
+		}
+		for _, ip := range v.ipaddr {
+			e.IPs = append(e.IPs, ip.IP)
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+// restore puts saved answers back as stale, so they are served while
+// refreshed, and refreshes the most used names right away
+func (d *dns) restore(es []DNSCacheEntry) {
+	now := time.Now()
+
+	var top []DNSCacheEntry
+	for _, e := range es {
+		if len(e.IPs) == 0 || now.After(e.Expire.Add(dnsRestoreMax)) {
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimSuffix(e.Name, "."))
+
+		v := &dnsVal{hits: e.Hits, expire: now}
+		for _, ip := range e.IPs {
+			v.ipaddr = append(v.ipaddr, net.IPAddr{IP: ip})
+		}
+
+		//answers resolved since the start win
+		if ok, _ := d.lru.ContainsOrAdd(name, v); ok {
+			continue
+		}
+
+		if e.Hits > 0 {
+			top = append(top, e)
+		}
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].Hits > top[j].Hits
+	})
+	if len(top) > dnsRefreshTop {
+		top = top[:dnsRefreshTop]
+	}
+
+	for _, e := range top {
+		d.refresh(strings.ToLower(strings.TrimSuffix(e.Name, ".")))
+	}
+}
+
+// resolvers are the dns of the client with a cache, by label
+func (c *Client) resolvers() map[string]*dns {
+	ds := make(map[string]*dns)
+
+	if d := c.getLocalDNS(); d != nil {
+		ds[d.label] = d
+	}
+	if d := c.getRemoteDNS(); d != nil {
+		ds[d.label] = d
+	}
+	for _, r := range c.getDNSRoutes() {
+		ds[r.d.label] = r.d
+	}
+	return ds
+}
+
+// DNSCacheSnapshot returns the cached answers of the local, remote and
+// route dns, for RestoreDNSCache after a restart.
+func (c *Client) DNSCacheSnapshot() []DNSCacheEntry {
+	var es []DNSCacheEntry
+	for _, d := range c.resolvers() {
+		es = append(es, d.snapshot()...)
+	}
+	return es
+}
+
+// RestoreDNSCache puts back a DNSCacheSnapshot. The answers are served
+// as stale until refreshed, entries of resolvers no longer set are
+// skipped.
+func (c *Client) RestoreDNSCache(es []DNSCacheEntry) {
+	by := make(map[string][]DNSCacheEntry)
+	for _, e := range es {
+		by[e.Resolver] = append(by[e.Resolver], e)
+	}
+
+	for label, d := range c.resolvers() {
+		if t := by[label]; len(t) > 0 {
+			d.restore(t)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// localDNSClient is a client whose local dns answers 1.2.3.4 for 300s
+func localDNSClient(t *testing.T) (*Client, *dns, *int32) {
+	c := NewClient("", 5, 5)
+	c.SetLocalDNS("10.0.0.9")
+	d := c.getLocalDNS()
+	t.Cleanup(d.Close)
+
+	var queries *int32
+	d.Dial, queries = testUpstream(t, answerTTL(300))
+	return c, d, queries
+}
+
+func cacheIP(ip string) []net.IPAddr {
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}
+}
+
+// waitQueries waits for the upstream to have got n queries, and a bit
+// longer for any more
+func waitQueries(queries *int32, n int32) int32 {
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(queries) < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	return atomic.LoadInt32(queries)
+}
+
+func TestDNSCacheSnapshot(t *testing.T) {
+	c, d, _ := localDNSClient(t)
+	now := time.Now()
+
+	d.lru.Add("fresh.example", &dnsVal{ipaddr: cacheIP("10.0.0.1"), expire: now.Add(time.Hour), hits: 3})
+	d.lru.Add("stale.example", &dnsVal{ipaddr: cacheIP("10.0.0.2"), expire: now.Add(-time.Minute)})
+	d.lru.Add("old.example", &dnsVal{ipaddr: cacheIP("10.0.0.3"), expire: now.Add(-DefaultDNSCache.Stale - time.Minute)})
+	d.lru.Add("gone.example", &dnsVal{negative: true, expire: now.Add(time.Minute)})
+
+	es := c.DNSCacheSnapshot()
+	sort.Slice(es, func(i, j int) bool { return es[i].Name < es[j].Name })
+
+	got := fmt.Sprint(es)
+	want := fmt.Sprint([]DNSCacheEntry{
+		{Resolver: "local", Name: "fresh.example", IPs: []net.IP{net.ParseIP("10.0.0.1")}, Expire: now.Add(time.Hour), Hits: 3},
+		{Resolver: "local", Name: "stale.example", IPs: []net.IP{net.ParseIP("10.0.0.2")}, Expire: now.Add(-time.Minute)},
+	})
+	if got != want {
+		t.Errorf("snapshot %s\nwant %s", got, want)
+	}
+}
+
+func TestDNSCacheRestore(t *testing.T) {
+	c, d, queries := localDNSClient(t)
+	now := time.Now()
+
+	//resolved since the start
+	d.lru.Add("fresh.example", &dnsVal{ipaddr: cacheIP("10.9.9.9"), expire: now.Add(time.Hour)})
+
+	c.RestoreDNSCache([]DNSCacheEntry{
+		{Resolver: "local", Name: "Top.Example.", IPs: []net.IP{net.ParseIP("10.0.0.1")}, Expire: now.Add(-time.Hour), Hits: 5},
+		{Resolver: "local", Name: "cold.example", IPs: []net.IP{net.ParseIP("10.0.0.2")}, Expire: now.Add(time.Hour)},
+		{Resolver: "local", Name: "ancient.example", IPs: []net.IP{net.ParseIP("10.0.0.3")}, Expire: now.Add(-dnsRestoreMax - time.Hour), Hits: 9},
+		{Resolver: "local", Name: "empty.example", Expire: now.Add(time.Hour), Hits: 9},
+		{Resolver: "local", Name: "fresh.example", IPs: []net.IP{net.ParseIP("10.0.0.4")}, Expire: now.Add(time.Hour), Hits: 9},
+		{Resolver: "remote", Name: "r.example", IPs: []net.IP{net.ParseIP("10.0.0.5")}, Expire: now.Add(time.Hour), Hits: 9},
+	})
+
+	//only the used name that was restored is refreshed, a and aaaa
+	if n := waitQueries(queries, 2); n != 2 {
+		t.Errorf("%d queries after the restore, want 2", n)
+	}
+	if cachedFor(t, d, "top.example") <= 0 {
+		t.Errorf("top.example not refreshed")
+	}
+
+	for _, name := range []string{"ancient.example", "empty.example"} {
+		if _, ok := d.lru.Peek(name); ok {
+			t.Errorf("%s restored", name)
+		}
+	}
+	if v, _ := d.lru.Peek("fresh.example"); v.(*dnsVal).ipaddr[0].IP.String() != "10.9.9.9" {
+		t.Errorf("restore replaced a new answer")
+	}
+
+	//served stale until refreshed, whatever the saved expire
+	ipaddr, ttl, err := d.lookupTTL("cold.example")
+	if err != nil || len(ipaddr) != 1 || ipaddr[0].IP.String() != "10.0.0.2" || ttl != 30 {
+		t.Errorf("restored answer %v ttl %d %v", ipaddr, ttl, err)
+	}
+	v, _ := d.lru.Peek("cold.example")
+	if atomic.LoadUint64(&v.(*dnsVal).hits) == 0 {
+		t.Errorf("restored answer not counted")
+	}
+}
+
+func TestDNSCacheRestoreTop(t *testing.T) {
+	c, _, queries := localDNSClient(t)
+
+	var es []DNSCacheEntry
+	for i := 0; i < dnsRefreshTop+5; i++ {
+		es = append(es, DNSCacheEntry{
+			Resolver: "local",
+			Name:     fmt.Sprintf("n%d.example", i),
+			IPs:      []net.IP{net.ParseIP("10.0.0.1")},
+			Expire:   time.Now(),
+			Hits:     uint64(i + 1),
+		})
+	}
+	c.RestoreDNSCache(es)
+
+	if n := waitQueries(queries, 2*dnsRefreshTop); n != 2*dnsRefreshTop {
+		t.Errorf("%d queries, want the top %d names refreshed", n, dnsRefreshTop)
+	}
+
+	//the least used are left stale
+	d := c.getLocalDNS()
+	if cachedFor(t, d, "n0.example") > 0 || cachedFor(t, d, fmt.Sprintf("n%d.example", dnsRefreshTop+4)) <= 0 {
+		t.Errorf("refreshed names are not the most used")
+	}
+}
@@ -0,0 +1,311 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+var ErrDNSMsg = errors.New("invalid dns message")
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+)
+
+// dnsQuestion is the single question of a query
+type dnsQuestion struct {
+	id     uint16
+	flags  uint16
+	name   string
+	qtype  uint16
+	qclass uint16
+	//end of the question section
+	end int
+}
+
+func parseDNSQuery(b []byte) (*dnsQuestion, error) {
+	if len(b) < 12 {
+		return nil, ErrDNSMsg
+	}
+
+	q := &dnsQuestion{
+		id:    binary.BigEndian.Uint16(b[0:]),
+		flags: binary.BigEndian.Uint16(b[2:]),
+	}
+
+	//a query with exactly one question
+	if q.flags&0x8000 != 0 || binary.BigEndian.Uint16(b[4:]) != 1 {
+		return nil, ErrDNSMsg
+	}
+
+	var labels []string
+	i := 12
+	for {
+		if i >= len(b) {
+			return nil, ErrDNSMsg
+		}
+		n := int(b[i])
+		i++
+
+		if n == 0 {
+			break
+		}
+		//no compression in the question of a query
+		if n > 63 || i+n > len(b) {
+			return nil, ErrDNSMsg
+		}
+		labels = append(labels, string(b[i:i+n]))
+		i += n
+	}
+
+	if i+4 > len(b) {
+		return nil, ErrDNSMsg
+	}
+
+	q.name = strings.ToLower(strings.Join(labels, "."))
+	q.qtype = binary.BigEndian.Uint16(b[i:])
+	q.qclass = binary.BigEndian.Uint16(b[i+2:])
+	q.end = i + 4
+
+	return q, nil
+}
+
+// dnsReply answers query with ips of the question type, other records
+// and the additional section of the query are dropped
+func dnsReply(query []byte, q *dnsQuestion, rcode int, ips []net.IP, ttl uint32) []byte {
+	b := make([]byte, 12, q.end+len(ips)*28)
+
+	//response, opcode and rd of the query, recursion available
+	flags := 0x8000 | q.flags&0x7900 | 0x0080 | uint16(rcode&0xf)
+
+	binary.BigEndian.PutUint16(b[0:], q.id)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], 1)
+
+	b = append(b, query[12:q.end]...)
+
+	n := 0
+	for _, ip := range ips {
+		data := ip.To4()
+		typ := uint16(dnsTypeA)
+		if data == nil {
+			data = ip.To16()
+			typ = dnsTypeAAAA
+		}
+		if typ != q.qtype || data == nil {
+			continue
+		}
+
+		rr := make([]byte, 12, 12+len(data))
+		//name points to the question
+		binary.BigEndian.PutUint16(rr[0:], 0xc00c)
+		binary.BigEndian.PutUint16(rr[2:], typ)
+		binary.BigEndian.PutUint16(rr[4:], 1)
+		binary.BigEndian.PutUint32(rr[6:], ttl)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(data)))
+
+		b = append(b, append(rr, data...)...)
+		n++
+	}
+
+	binary.BigEndian.PutUint16(b[6:], uint16(n))
+
+	return b
+}
+
+// readDNSStream reads a length prefixed message of dns over tcp
+func readDNSStream(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func writeDNSStream(w io.Writer, b []byte) error {
+	t := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(t, uint16(len(b)))
+	copy(t[2:], b)
+
+	_, err := w.Write(t)
+	return err
+}
+
+// dnsQuery builds a recursive query for name, with an EDNS0 record so
+// udp answers may be larger than 512 bytes
+func dnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := make([]byte, 12, 12+len(name)+2+4+11)
+
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], 0x0100)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[10:], 1)
+
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return nil, ErrDNSMsg
+	}
+	for _, l := range strings.Split(name, ".") {
+		if l == "" || len(l) > 63 {
+			return nil, ErrDNSMsg
+		}
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	b = append(b, 0, byte(qtype>>8), byte(qtype), 0, 1)
+
+	//OPT: root name, type 41, udp size 1232
+	b = append(b, 0, 0, 41, 0x04, 0xd0, 0, 0, 0, 0, 0, 0)
+
+	return b, nil
+}
+
+// dnsAnswer is what a lookup keeps of a response
+type dnsAnswer struct {
+	rcode int
+	ips   []net.IP
+	//lowest ttl of the answer section
+	ttl uint32
+	//ttl for a negative answer from the SOA of the authority section,
+	//-1 without one
+	negTTL int64
+}
+
+func dnsTruncated(b []byte) bool {
+	return len(b) >= 12 && b[2]&0x02 != 0
+}
+
+// dnsAnswers reports whether resp is the answer to query, same id and
+// question
+func dnsAnswers(query, resp []byte) bool {
+	return len(query) >= 12 && len(resp) >= 12 && bytes.Equal(query[:2], resp[:2]) && dnsSameQuestion(query, resp)
+}
+
+// dnsSameQuestion reports whether resp answers the question of query,
+// the name compared case insensitively as servers may change its case
+func dnsSameQuestion(query, resp []byte) bool {
+	if len(query) < 12 || len(resp) < 12 || !bytes.Equal(query[4:6], resp[4:6]) {
+		return false
+	}
+
+	qend, err := skipDNSName(query, 12)
+	if err != nil || qend+4 > len(query) {
+		return false
+	}
+	rend, err := skipDNSName(resp, 12)
+	if err != nil || rend+4 > len(resp) || rend != qend {
+		return false
+	}
+
+	return bytes.EqualFold(query[12:qend], resp[12:rend]) &&
+		bytes.Equal(query[qend:qend+4], resp[rend:rend+4])
+}
+
+// skipDNSName returns the end of the possibly compressed name at i
+func skipDNSName(b []byte, i int) (int, error) {
+	for {
+		if i >= len(b) {
+			return 0, ErrDNSMsg
+		}
+		n := int(b[i])
+
+		switch {
+		case n == 0:
+			return i + 1, nil
+		case n&0xc0 == 0xc0:
+			if i+2 > len(b) {
+				return 0, ErrDNSMsg
+			}
+			return i + 2, nil
+		case n > 63:
+			return 0, ErrDNSMsg
+		}
+		i += 1 + n
+	}
+}
+
+// parseDNSAnswer reads the records of qtype out of a response, cnames
+// before them count for the ttl
+func parseDNSAnswer(b []byte, qtype uint16) (*dnsAnswer, error) {
+	if len(b) < 12 || b[2]&0x80 == 0 {
+		return nil, ErrDNSMsg
+	}
+
+	a := &dnsAnswer{
+		rcode:  int(b[3] & 0xf),
+		ttl:    ^uint32(0),
+		negTTL: -1,
+	}
+
+	qd := int(binary.BigEndian.Uint16(b[4:]))
+	an := int(binary.BigEndian.Uint16(b[6:]))
+	ns := int(binary.BigEndian.Uint16(b[8:]))
+
+	i := 12
+	for ; qd > 0; qd-- {
+		end, err := skipDNSName(b, i)
+		if err != nil || end+4 > len(b) {
+			return nil, ErrDNSMsg
+		}
+		i = end + 4
+	}
+
+	for n := 0; n < an+ns; n++ {
+		end, err := skipDNSName(b, i)
+		if err != nil || end+10 > len(b) {
+			return nil, ErrDNSMsg
+		}
+
+		typ := binary.BigEndian.Uint16(b[end:])
+		ttl := binary.BigEndian.Uint32(b[end+4:])
+		size := int(binary.BigEndian.Uint16(b[end+8:]))
+
+		data := end + 10
+		if data+size > len(b) {
+			return nil, ErrDNSMsg
+		}
+		rdata := b[data : data+size]
+		i = data + size
+
+		if n >= an {
+			//SOA, the minimum field is last
+			if typ == 6 && size >= 4 {
+				neg := binary.BigEndian.Uint32(rdata[size-4:])
+				if ttl < neg {
+					neg = ttl
+				}
+				a.negTTL = int64(neg)
+			}
+			continue
+		}
+
+		switch {
+		case typ == qtype && typ == dnsTypeA && size == 4,
+			typ == qtype && typ == dnsTypeAAAA && size == 16:
+			a.ips = append(a.ips, net.IP(append([]byte(nil), rdata...)))
+		case typ != 5:
+			//only cnames lead to the records
+			continue
+		}
+
+		if ttl < a.ttl {
+			a.ttl = ttl
+		}
+	}
+
+	return a, nil
+}
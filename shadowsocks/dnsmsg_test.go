@@ -0,0 +1,224 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+)
+
+// dnsName encodes a name without compression
+func dnsName(name string) []byte {
+	var b []byte
+	for _, l := range strings.Split(name, ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+// dnsRR encodes a record with an already encoded name
+func dnsRR(name []byte, typ uint16, ttl uint32, data []byte) []byte {
+	b := append([]byte(nil), name...)
+	t := make([]byte, 10)
+	binary.BigEndian.PutUint16(t[0:], typ)
+	binary.BigEndian.PutUint16(t[2:], 1)
+	binary.BigEndian.PutUint32(t[4:], ttl)
+	binary.BigEndian.PutUint16(t[8:], uint16(len(data)))
+	return append(append(b, t...), data...)
+}
+
+func dnsHeader(id, flags uint16, qd, an, ns int) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(qd))
+	binary.BigEndian.PutUint16(b[6:], uint16(an))
+	binary.BigEndian.PutUint16(b[8:], uint16(ns))
+	return b
+}
+
+// compressedResponse answers www.example.com with a cname to
+// cdn.example.com and its address, both names compressed
+func compressedResponse() []byte {
+	b := dnsHeader(7, 0x8180, 1, 2, 0)
+	b = append(b, dnsName("www.example.com")...)
+	b = append(b, 0, dnsTypeA, 0, 1)
+
+	//cdn + pointer to example.com in the question
+	cname := []byte{3, 'c', 'd', 'n', 0xc0, 12 + 4}
+	b = append(b, dnsRR([]byte{0xc0, 12}, 5, 300, cname)...)
+
+	//the cname data starts after name, type, class, ttl and length
+	at := len(b) - len(cname)
+	b = append(b, dnsRR([]byte{0xc0, byte(at)}, dnsTypeA, 60, []byte{1, 2, 3, 4})...)
+	return b
+}
+
+func TestParseDNSQuery(t *testing.T) {
+	query, err := dnsQuery(0x1234, "WWW.Example.com.", dnsTypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := parseDNSQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.id != 0x1234 || q.name != "www.example.com" || q.qtype != dnsTypeAAAA || q.qclass != 1 || q.end != 12+17+4 {
+		t.Errorf("got %+v", q)
+	}
+
+	//every truncated query is rejected
+	for i := 0; i < q.end; i++ {
+		if _, err := parseDNSQuery(query[:i]); err == nil {
+			t.Errorf("%d of %d bytes accepted", i, q.end)
+		}
+	}
+
+	question := append(dnsName("example.com"), 0, 1, 0, 1)
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"response", append(dnsHeader(1, 0x8100, 1, 0, 0), question...)},
+		{"two questions", append(dnsHeader(1, 0x0100, 2, 0, 0), append(question, question...)...)},
+		{"no question", dnsHeader(1, 0x0100, 0, 0, 0)},
+		{"compressed", append(dnsHeader(1, 0x0100, 1, 0, 0), 0xc0, 12, 0, 1, 0, 1)},
+		{"long label", append(dnsHeader(1, 0x0100, 1, 0, 0), append([]byte{64}, make([]byte, 70)...)...)},
+		{"label past end", append(dnsHeader(1, 0x0100, 1, 0, 0), 10, 'a', 'b')},
+	}
+	for _, tt := range tests {
+		if _, err := parseDNSQuery(tt.msg); err != ErrDNSMsg {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
+
+func TestParseDNSAnswer(t *testing.T) {
+	resp := compressedResponse()
+
+	a, err := parseDNSAnswer(resp, dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.ips) != 1 || !a.ips[0].Equal(net.IPv4(1, 2, 3, 4)) || a.ttl != 60 || a.rcode != 0 {
+		t.Errorf("got %+v", a)
+	}
+
+	//asked for aaaa the cname alone is left
+	if a, err := parseDNSAnswer(resp, dnsTypeAAAA); err != nil || len(a.ips) != 0 || a.ttl != 300 {
+		t.Errorf("aaaa got %+v %v", a, err)
+	}
+
+	for i := 0; i < len(resp); i++ {
+		if _, err := parseDNSAnswer(resp[:i], dnsTypeA); err == nil {
+			t.Errorf("%d of %d bytes accepted", i, len(resp))
+		}
+	}
+
+	//nxdomain with the negative ttl from the soa minimum
+	soa := append([]byte{0, 0}, make([]byte, 20)...)
+	binary.BigEndian.PutUint32(soa[18:], 30)
+	nx := dnsHeader(7, 0x8183, 1, 0, 1)
+	nx = append(nx, dnsName("nope.example.com")...)
+	nx = append(nx, 0, dnsTypeA, 0, 1)
+	nx = append(nx, dnsRR([]byte{0xc0, 12 + 5}, 6, 900, soa)...)
+
+	a, err = parseDNSAnswer(nx, dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.rcode != dnsRcodeNXDomain || len(a.ips) != 0 || a.negTTL != 30 {
+		t.Errorf("nxdomain got %+v", a)
+	}
+
+	if _, err := parseDNSAnswer(dnsHeader(7, 0x0100, 0, 0, 0), dnsTypeA); err != ErrDNSMsg {
+		t.Errorf("query parsed as an answer: %v", err)
+	}
+}
+
+func TestDNSSameQuestion(t *testing.T) {
+	query, _ := dnsQuery(7, "www.example.com", dnsTypeA)
+	resp := compressedResponse()
+
+	if !dnsSameQuestion(query, resp) {
+		t.Error("same question not matched")
+	}
+
+	upper := append([]byte(nil), resp...)
+	upper[13] = 'W'
+	if !dnsSameQuestion(query, upper) {
+		t.Error("case change not matched")
+	}
+
+	other, _ := dnsQuery(7, "www.example.org", dnsTypeA)
+	aaaa, _ := dnsQuery(7, "www.example.com", dnsTypeAAAA)
+	for _, q := range [][]byte{other, aaaa, query[:20]} {
+		if dnsSameQuestion(q, resp) {
+			t.Errorf("%q matched", q)
+		}
+	}
+}
+
+// TestDNSGarbage feeds random and bit flipped messages to the parsers,
+// they must fail and not panic
+func TestDNSGarbage(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	resp := compressedResponse()
+
+	for i := 0; i < 20000; i++ {
+		var b []byte
+		if i%2 == 0 {
+			b = make([]byte, r.Intn(64))
+			r.Read(b)
+		} else {
+			b = append([]byte(nil), resp...)
+			b[r.Intn(len(b))] ^= byte(1 << uint(r.Intn(8)))
+			b = b[:r.Intn(len(b)+1)]
+		}
+
+		parseDNSQuery(b)
+		parseDNSAnswer(b, dnsTypeA)
+		dnsSameQuestion(resp, b)
+	}
+}
+
+func TestDNSReply(t *testing.T) {
+	query, _ := dnsQuery(0x4321, "example.com", dnsTypeA)
+	q, err := parseDNSQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rcode := range []int{dnsRcodeRefused, dnsRcodeNotImp, dnsRcodeNXDomain, dnsRcodeServFail} {
+		b := dnsReply(query, q, rcode, nil, 0)
+
+		a, err := parseDNSAnswer(b, q.qtype)
+		if err != nil {
+			t.Fatal(rcode, err)
+		}
+		if a.rcode != rcode || len(a.ips) != 0 {
+			t.Errorf("rcode %d: got %+v", rcode, a)
+		}
+		if binary.BigEndian.Uint16(b) != 0x4321 || b[2]&0x01 == 0 || !dnsSameQuestion(query, b) {
+			t.Errorf("rcode %d: id, rd or question lost % x", rcode, b[:12])
+		}
+		//the edns record of the query is not echoed
+		if len(b) != q.end {
+			t.Errorf("rcode %d: %d bytes, want %d", rcode, len(b), q.end)
+		}
+	}
+
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1"), net.ParseIP("10.0.0.2")}
+	b := dnsReply(query, q, 0, ips, 120)
+
+	a, err := parseDNSAnswer(b, dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.ips) != 2 || !a.ips[1].Equal(ips[2]) || a.ttl != 120 {
+		t.Errorf("got %+v", a)
+	}
+}
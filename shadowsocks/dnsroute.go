@@ -0,0 +1,106 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+)
+
+var ErrDNSRoute = errors.New("invalid dns route")
+
+// DNSRoute sends the lookups of a domain and its subdomains to their
+// own dns servers, reached through the server Via or directly when 0.
+type DNSRoute struct {
+	//corp.example or *.corp.example
+	Domain string
+	//ips, https:// or tls:// urls like SetLocalDNS
+	DNS string
+	Via uint64
+}
+
+type dnsRoute struct {
+	suffix string
+	d      *dns
+}
+
+func dnsRouteDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, "*")
+	domain = strings.Trim(domain, ".")
+	return domain
+}
+
+// CheckDNSRoute reports why r can not be used.
+func CheckDNSRoute(r DNSRoute) error {
+	if dnsRouteDomain(r.Domain) == "" || len(parseDNS(r.DNS)) == 0 {
+		return ErrDNSRoute
+	}
+	return nil
+}
+
+// SetDNSRoutes replaces the domain routes, the longest matching domain
+// wins over the local and remote dns.
+func (c *Client) SetDNSRoutes(routes []DNSRoute) {
+	c.rl.Lock()
+	defer c.rl.Unlock()
+
+	var rs []*dnsRoute
+	for _, r := range routes {
+		if err := CheckDNSRoute(r); err != nil {
+			Debug.Println("DNS Route", r.Domain, err)
+			continue
+		}
+
+		d := c.newDNS(parseDNS(r.DNS), "route "+dnsRouteDomain(r.Domain))
+
+		if via := r.Via; via != 0 {
+			d.Dial = func(ctx context.Context, n, addr string) (net.Conn, error) {
+				return c.dialServer(ctx, via, addr)
+			}
+		}
+
+		rs = append(rs, &dnsRoute{suffix: dnsRouteDomain(r.Domain), d: d})
+	}
+
+	sort.SliceStable(rs, func(i, j int) bool {
+		return len(rs[i].suffix) > len(rs[j].suffix)
+	})
+
+	old := c.getDNSRoutes()
+	c.dnsRoutes.Store(rs)
+
+	for _, r := range old {
+		r.d.Close()
+	}
+}
+
+func (c *Client) getDNSRoutes() []*dnsRoute {
+	rs, _ := c.dnsRoutes.Load().([]*dnsRoute)
+	return rs
+}
+
+func (c *Client) routeDNS(host string) *dnsRoute {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, r := range c.getDNSRoutes() {
+		if host == r.suffix || strings.HasSuffix(host, "."+r.suffix) {
+			return r
+		}
+	}
+	return nil
+}
+
+// resolver is the dns host is looked up with: a route first, then the
+// remote dns for proxied connections or the local one. Nil leaves it to
+// the server or the system.
+func (c *Client) resolver(host string, proxy bool) *dns {
+	if r := c.routeDNS(host); r != nil {
+		return r.d
+	}
+	if proxy {
+		return c.getRemoteDNS()
+	}
+	return c.getLocalDNS()
+}
@@ -0,0 +1,103 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckDNSRoute(t *testing.T) {
+	tests := []struct {
+		r  DNSRoute
+		ok bool
+	}{
+		{DNSRoute{Domain: "corp.example", DNS: "10.0.0.53"}, true},
+		{DNSRoute{Domain: "*.corp.example", DNS: "tls://dns.example"}, true},
+		{DNSRoute{Domain: " Corp.Example. ", DNS: "https://dns.example/dns-query", Via: 1}, true},
+		{DNSRoute{Domain: "", DNS: "10.0.0.53"}, false},
+		{DNSRoute{Domain: "*.", DNS: "10.0.0.53"}, false},
+		{DNSRoute{Domain: "corp.example", DNS: ""}, false},
+	}
+
+	for _, tt := range tests {
+		if err := CheckDNSRoute(tt.r); (err == nil) != tt.ok {
+			t.Errorf("CheckDNSRoute(%+v) = %v", tt.r, err)
+		}
+	}
+}
+
+func TestResolver(t *testing.T) {
+	c := NewClient("", 5, 5)
+	defer c.SetDNSRoutes(nil)
+
+	//nothing set is the server or the system
+	if c.resolver("a.example", true) != nil || c.resolver("a.example", false) != nil {
+		t.Errorf("resolver without dns")
+	}
+
+	c.SetLocalDNS("10.0.0.1")
+	c.SetRemoteDNS("10.0.0.2")
+	c.SetDNSRoutes([]DNSRoute{
+		{Domain: "*.corp.example", DNS: "10.0.0.3"},
+		{Domain: "lab.corp.example", DNS: "10.0.0.4"},
+		{Domain: "", DNS: "10.0.0.5"},
+	})
+
+	if n := len(c.getDNSRoutes()); n != 2 {
+		t.Errorf("%d routes, the invalid one kept", n)
+	}
+
+	tests := []struct {
+		host  string
+		proxy bool
+		want  string
+	}{
+		{"corp.example", false, "route corp.example"},
+		{"www.corp.example", true, "route corp.example"},
+		{"WWW.Corp.Example.", false, "route corp.example"},
+		//the longest domain wins
+		{"git.lab.corp.example", false, "route lab.corp.example"},
+		{"notcorp.example", false, c.getLocalDNS().label},
+		{"other.example", true, c.getRemoteDNS().label},
+	}
+
+	for _, tt := range tests {
+		d := c.resolver(tt.host, tt.proxy)
+		if d == nil || d.label != tt.want {
+			t.Errorf("resolver(%q, %v) = %v, want %s", tt.host, tt.proxy, d, tt.want)
+		}
+	}
+
+	//replaced, not added to
+	c.SetDNSRoutes([]DNSRoute{{Domain: "other.example", DNS: "10.0.0.6"}})
+	if d := c.resolver("www.corp.example", false); d != c.getLocalDNS() {
+		t.Errorf("old route kept")
+	}
+}
+
+func TestDNSRouteVia(t *testing.T) {
+	c := NewClient("", 5, 5)
+	defer c.SetDNSRoutes(nil)
+
+	dialed := make(chan string, 4)
+	c.shadows.Store([]*Shadow{{ID: 3, Dial: func(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+		dialed <- addr
+		return nil, errors.New("offline")
+	}}})
+
+	c.SetDNSRoutes([]DNSRoute{{Domain: "corp.example", DNS: "10.0.0.53", Via: 3}})
+
+	//asked through the server
+	c.resolver("corp.example", false).LookupIPAddr("www.corp.example")
+
+	select {
+	case addr := <-dialed:
+		if addr != "10.0.0.53:53" {
+			t.Errorf("dialed %s through the server", addr)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("route not asked through its server")
+	}
+}
@@ -0,0 +1,191 @@
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var ErrDNSOpen = errors.New("dns listen on a non loopback address needs an acl")
+
+// dnsServer is the dns inbound of the client
+type dnsServer struct {
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+func (s *dnsServer) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+// ListenDNS answers dns queries on addr over udp and tcp. Names routed
+// through a server are resolved with the remote dns, the others with the
+// local dns, so names only the remote side knows resolve as well.
+// When resolv.conf points here the local dns has to be set, the system
+// resolver would send the queries back.
+// An addr without a host listens on loopback, other addresses need an
+// acl set first so it does not become an open resolver.
+func (c *Client) ListenDNS(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) && c.acl == nil {
+		return ErrDNSOpen
+	}
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	c.dnsServer = &dnsServer{udp: pc, tcp: l}
+
+	go c.serveDNSPacket(pc)
+	go c.serveDNSStream(l)
+
+	return nil
+}
+
+func (c *Client) serveDNSPacket(pc net.PacketConn) {
+	for {
+		b := make([]byte, 4096)
+
+		n, from, err := pc.ReadFrom(b)
+		if err != nil {
+			Debug.Println("DNS Listen", err)
+			return
+		}
+
+		go func() {
+			if resp := c.answerDNS(from, b[:n]); resp != nil {
+				pc.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+func (c *Client) serveDNSStream(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			Debug.Println("DNS Listen", err)
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			for {
+				conn.SetDeadline(time.Now().Add(c.idleTimeout))
+
+				query, err := readDNSStream(conn)
+				if err != nil {
+					return
+				}
+
+				resp := c.answerDNS(conn.RemoteAddr(), query)
+				if resp == nil || writeDNSStream(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// answerDNS returns the answer to a raw query, nil drops it
+func (c *Client) answerDNS(from net.Addr, query []byte) []byte {
+	q, err := parseDNSQuery(query)
+	if err != nil {
+		Debug.Println("DNS Query", from, err)
+		return nil
+	}
+
+	if !c.allow(from) {
+		return dnsReply(query, q, dnsRcodeRefused, nil, 0)
+	}
+	if q.qclass != 1 {
+		return dnsReply(query, q, dnsRcodeNotImp, nil, 0)
+	}
+
+	if ips, ok := c.fakeIPAnswer(q.name, q.qtype); ok {
+		Debug.Println("DNS", from, q.name, q.qtype, "fake", ips)
+		return dnsReply(query, q, 0, ips, fakeIPTTL)
+	}
+
+	proxy := c.dnsProxied(from, q.name)
+
+	d := c.resolver(q.name, proxy)
+	if d == nil && proxy {
+		d = c.getLocalDNS()
+	}
+
+	Debug.Println("DNS", from, q.name, q.qtype, "proxy", proxy)
+
+	if q.qtype != dnsTypeA && q.qtype != dnsTypeAAAA {
+		if d == nil {
+			return dnsReply(query, q, dnsRcodeNotImp, nil, 0)
+		}
+
+		resp, err := d.Exchange(query, c.timeout)
+		if err != nil {
+			Debug.Println("DNS Exchange", q.name, err)
+			return dnsReply(query, q, dnsRcodeServFail, nil, 0)
+		}
+		return resp
+	}
+
+	ipaddr := c.lookupHosts(q.name)
+	var ttl uint32 = dnsDefaultTTL
+	switch {
+	case ipaddr != nil:
+		//pinned by a hosts entry
+	case d != nil:
+		ipaddr, ttl, err = d.lookupTTL(q.name)
+	default:
+		ipaddr, ttl, err = c.lookupLocal(q.name)
+	}
+
+	if err != nil {
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			return dnsReply(query, q, dnsRcodeNXDomain, nil, 0)
+		}
+		return dnsReply(query, q, dnsRcodeServFail, nil, 0)
+	}
+
+	ips := make([]net.IP, len(ipaddr))
+	for i, t := range ipaddr {
+		ips[i] = t.IP
+	}
+
+	return dnsReply(query, q, 0, ips, ttl)
+}
+
+// dnsProxied reports whether connections to name would go through a
+// server, rules with a port do not take part
+func (c *Client) dnsProxied(from net.Addr, name string) bool {
+	switch c.getMode().mode {
+	case ModeGlobal:
+		return true
+	case ModeDirect:
+		return false
+	}
+
+	raw, err := Parse2RawAddr(net.JoinHostPort(name, "0"))
+	if err != nil {
+		return false
+	}
+
+	m := &Meta{From: from, To: raw}
+
+	return c.match(m, raw) != nil || c.learned(name)
+}
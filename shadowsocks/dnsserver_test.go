@@ -0,0 +1,71 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestAnswerDNS(t *testing.T) {
+	c := NewClient("", 5, 5)
+	c.SetACL("10.0.0.0/8")
+
+	query, _ := dnsQuery(9, "example.com", dnsTypeA)
+	chaos := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(chaos[12+13+2:], 3)
+
+	tests := []struct {
+		name  string
+		from  string
+		query []byte
+		rcode int
+	}{
+		{"not in acl", "192.168.1.5:53", query, dnsRcodeRefused},
+		{"chaos class", "10.1.1.1:53", chaos, dnsRcodeNotImp},
+		{"loopback", "127.0.0.1:53", chaos, dnsRcodeNotImp},
+	}
+
+	for _, tt := range tests {
+		from, _ := net.ResolveUDPAddr("udp", tt.from)
+		b := c.answerDNS(from, tt.query)
+
+		a, err := parseDNSAnswer(b, dnsTypeA)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if a.rcode != tt.rcode {
+			t.Errorf("%s: rcode %d, want %d", tt.name, a.rcode, tt.rcode)
+		}
+	}
+
+	from, _ := net.ResolveUDPAddr("udp", "127.0.0.1:53")
+	if b := c.answerDNS(from, query[:20]); b != nil {
+		t.Errorf("malformed query answered % x", b)
+	}
+}
+
+func TestListenDNS(t *testing.T) {
+	c := NewClient("", 5, 5)
+
+	for _, addr := range []string{"0.0.0.0:0", "[::]:0", "192.0.2.1:0", "example.com:0"} {
+		if err := c.ListenDNS(addr); err != ErrDNSOpen {
+			t.Errorf("%s without an acl: got %v", addr, err)
+		}
+	}
+
+	//no host is loopback
+	if err := c.ListenDNS(":0"); err != nil {
+		t.Fatal(err)
+	}
+	if ip := AddrIP(c.dnsServer.udp.LocalAddr()); !ip.IsLoopback() {
+		t.Errorf("listening on %s", ip)
+	}
+	c.dnsServer.Close()
+
+	c.SetACL("10.0.0.0/8")
+	if err := c.ListenDNS("0.0.0.0:0"); err != nil {
+		t.Fatal(err)
+	}
+	c.dnsServer.Close()
+}
@@ -0,0 +1,220 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var ErrDNSStrategy = errors.New("unknown dns strategy, use sequential, race or health")
+
+// DNSStrategy decides how the upstreams of a dns are asked.
+type DNSStrategy int
+
+const (
+	//in the given order, the next one after a failure or timeout
+	DNSSequential DNSStrategy = iota
+	//all at once, the first answer wins
+	DNSRace
+	//sequential, the fastest and least failing first
+	DNSHealth
+)
+
+var dnsStrategyNames = []string{"sequential", "race", "health"}
+
+func (s DNSStrategy) String() string {
+	if s < 0 || int(s) >= len(dnsStrategyNames) {
+		return ""
+	}
+	return dnsStrategyNames[s]
+}
+
+func ParseDNSStrategy(s string) (DNSStrategy, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return DNSSequential, nil
+	}
+
+	for i, n := range dnsStrategyNames {
+		if n == s {
+			return DNSStrategy(i), nil
+		}
+	}
+	return DNSSequential, ErrDNSStrategy
+}
+
+// failures older than this no longer lower an upstream for DNSHealth,
+// so one that was down gets tried again
+const dnsHealthRetry = time.Minute
+
+type dnsStrategy struct {
+	strategy DNSStrategy
+	//one upstream attempt
+	timeout time.Duration
+}
+
+// DNSUpstreamStats is the health of one upstream of a dns.
+type DNSUpstreamStats struct {
+	Server  string
+	Queries uint64
+	Errors  uint64
+	//moving average of the answer time
+	Latency time.Duration
+	LastErr string
+}
+
+// record counts an answer or failure of the upstream
+func (u *dnsUpstream) record(took time.Duration, err error) {
+	atomic.AddUint64(&u.queries, 1)
+
+	if err != nil {
+		atomic.AddUint64(&u.errors, 1)
+		atomic.AddInt32(&u.fails, 1)
+		atomic.StoreInt64(&u.failedAt, time.Now().UnixNano())
+		u.lastErr.Store(err.Error())
+		return
+	}
+
+	atomic.StoreInt32(&u.fails, 0)
+
+	for {
+		old := atomic.LoadInt64(&u.latency)
+		t := int64(took)
+		if old != 0 {
+			t = old + (t-old)/4
+		}
+		if atomic.CompareAndSwapInt64(&u.latency, old, t) {
+			return
+		}
+	}
+}
+
+func (u *dnsUpstream) stats() DNSUpstreamStats {
+	t := DNSUpstreamStats{
+		Server:  u.String(),
+		Queries: atomic.LoadUint64(&u.queries),
+		Errors:  atomic.LoadUint64(&u.errors),
+		Latency: time.Duration(atomic.LoadInt64(&u.latency)),
+	}
+	t.LastErr, _ = u.lastErr.Load().(string)
+	return t
+}
+
+// score orders upstreams for DNSHealth, lower is better. Every recent
+// failure in a row costs a timeout, untried upstreams get a chance first.
+func (u *dnsUpstream) score(timeout time.Duration) time.Duration {
+	score := time.Duration(atomic.LoadInt64(&u.latency))
+
+	failedAt := time.Unix(0, atomic.LoadInt64(&u.failedAt))
+	if time.Since(failedAt) < dnsHealthRetry {
+		score += time.Duration(atomic.LoadInt32(&u.fails)) * timeout
+	}
+	return score
+}
+
+// SetStrategy sets how the upstreams are asked and how long one attempt
+// may take, 0 is the default 5s.
+func (d *dns) SetStrategy(s DNSStrategy, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = dnsTimeout
+	}
+	d.strategy.Store(dnsStrategy{strategy: s, timeout: timeout})
+}
+
+func (d *dns) getStrategy() dnsStrategy {
+	return d.strategy.Load().(dnsStrategy)
+}
+
+// upstreams in the order they are asked
+func (d *dns) upstreams(conf dnsStrategy) []*dnsUpstream {
+	us := make([]*dnsUpstream, len(d.dns))
+	copy(us, d.dns)
+
+	if conf.strategy == DNSHealth {
+		scores := make(map[*dnsUpstream]time.Duration, len(us))
+		for _, u := range us {
+			scores[u] = u.score(conf.timeout)
+		}
+		sort.SliceStable(us, func(i, j int) bool {
+			return scores[us[i]] < scores[us[j]]
+		})
+	}
+	return us
+}
+
+// ask sends query to u within timeout, attempts cut short by ctx are
+// not held against the upstream
+func (d *dns) ask(ctx context.Context, u *dnsUpstream, query []byte, timeout time.Duration) ([]byte, error) {
+	actx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := u.exchange(actx, query)
+	if ctx.Err() == nil {
+		u.record(time.Since(start), err)
+	}
+	if err != nil {
+		Debug.Println("DNS Upstream", u, err)
+	}
+	return resp, err
+}
+
+// exchange asks the upstreams by the strategy until one answers
+func (d *dns) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(d.dns) == 0 {
+		return nil, ErrDNSUpstream
+	}
+
+	conf := d.getStrategy()
+	if conf.strategy == DNSRace && len(d.dns) > 1 {
+		return d.race(ctx, query, conf.timeout)
+	}
+
+	var err error
+	for _, u := range d.upstreams(conf) {
+		var resp []byte
+		resp, err = d.ask(ctx, u, query, conf.timeout)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+type dnsResult struct {
+	resp []byte
+	err  error
+}
+
+// race asks all upstreams at once, the first answer wins and cancels
+// the others
+func (d *dns) race(ctx context.Context, query []byte, timeout time.Duration) ([]byte, error) {
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dnsResult, len(d.dns))
+	for _, u := range d.dns {
+		go func(u *dnsUpstream) {
+			resp, err := d.ask(rctx, u, query, timeout)
+			results <- dnsResult{resp, err}
+		}(u)
+	}
+
+	var err error
+	for range d.dns {
+		r := <-results
+		if r.err == nil {
+			return r.resp, nil
+		}
+		if err == nil {
+			err = r.err
+		}
+	}
+	return nil, err
+}
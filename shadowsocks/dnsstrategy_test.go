@@ -0,0 +1,193 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseDNSStrategy(t *testing.T) {
+	tests := []struct {
+		s    string
+		want DNSStrategy
+		err  error
+	}{
+		{"", DNSSequential, nil},
+		{"sequential", DNSSequential, nil},
+		{" Race ", DNSRace, nil},
+		{"health", DNSHealth, nil},
+		{"fastest", DNSSequential, ErrDNSStrategy},
+	}
+	for _, tt := range tests {
+		got, err := ParseDNSStrategy(tt.s)
+		if got != tt.want || err != tt.err {
+			t.Errorf("%q = %v %v, want %v %v", tt.s, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestDNSUpstreamRecord(t *testing.T) {
+	u := &dnsUpstream{}
+
+	u.record(100*time.Millisecond, nil)
+	u.record(200*time.Millisecond, nil)
+	if s := u.stats(); s.Latency != 125*time.Millisecond || s.Queries != 2 || s.Errors != 0 {
+		t.Errorf("got %+v", s)
+	}
+
+	u.record(0, errors.New("timeout"))
+	u.record(0, errors.New("timeout"))
+	if s := u.stats(); s.Errors != 2 || s.LastErr != "timeout" || atomic.LoadInt32(&u.fails) != 2 || s.Latency != 125*time.Millisecond {
+		t.Errorf("got %+v fails %d", s, u.fails)
+	}
+
+	u.record(125*time.Millisecond, nil)
+	if atomic.LoadInt32(&u.fails) != 0 {
+		t.Errorf("fails %d after an answer", u.fails)
+	}
+
+	//concurrent answers keep the average within their range
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				u.record(125*time.Millisecond, nil)
+			}
+		}()
+	}
+	wg.Wait()
+	if s := u.stats(); s.Latency != 125*time.Millisecond || s.Queries != 8005 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestDNSUpstreamOrder(t *testing.T) {
+	d := NewDNS([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"})
+	a, b, c, e := d.dns[0], d.dns[1], d.dns[2], d.dns[3]
+
+	//a failed twice, b is slow, c fast and e never asked
+	a.record(0, errors.New("timeout"))
+	a.record(0, errors.New("timeout"))
+	b.record(300*time.Millisecond, nil)
+	c.record(10*time.Millisecond, nil)
+
+	conf := dnsStrategy{DNSHealth, time.Second}
+	want := []*dnsUpstream{e, c, b, a}
+	for i, u := range d.upstreams(conf) {
+		if u != want[i] {
+			t.Errorf("health %d: got %s, want %s", i, u, want[i])
+		}
+	}
+
+	//failures long ago no longer count
+	a.failedAt = time.Now().Add(-2 * dnsHealthRetry).UnixNano()
+	if us := d.upstreams(conf); us[0] != a && us[1] != a {
+		t.Errorf("old failures still count: %v", us)
+	}
+
+	conf.strategy = DNSSequential
+	for i, u := range d.upstreams(conf) {
+		if u != d.dns[i] {
+			t.Errorf("sequential %d: got %s", i, u)
+		}
+	}
+
+	one := NewDNS([]string{"10.0.0.1"})
+	if us := one.upstreams(conf); len(us) != 1 {
+		t.Errorf("a single upstream asked %d times", len(us))
+	}
+}
+
+// strategyDNS is a dns whose upstream 10.0.0.1 never answers and
+// 10.0.0.2 answers at once
+func strategyDNS(t *testing.T, servers ...string) *dns {
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dead.Close()
+		live.Close()
+	})
+
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			n, from, err := live.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			live.WriteTo(testAnswer(t, b[:n], ""), from)
+		}
+	}()
+
+	d := NewDNS(servers)
+	d.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "10.0.0.1:53" {
+			return net.Dial(network, dead.LocalAddr().String())
+		}
+		return net.Dial(network, live.LocalAddr().String())
+	}
+	return d
+}
+
+func TestDNSStrategyExchange(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	tests := []struct {
+		strategy DNSStrategy
+		servers  []string
+		//whether the dead upstream is waited for
+		slow bool
+		err  bool
+	}{
+		{DNSSequential, []string{"10.0.0.1", "10.0.0.2"}, true, false},
+		{DNSSequential, []string{"10.0.0.2", "10.0.0.1"}, false, false},
+		{DNSRace, []string{"10.0.0.1", "10.0.0.2"}, false, false},
+		{DNSHealth, []string{"10.0.0.1", "10.0.0.2"}, true, false},
+		{DNSSequential, []string{"10.0.0.1"}, true, true},
+	}
+
+	for _, tt := range tests {
+		d := strategyDNS(t, tt.servers...)
+		d.SetStrategy(tt.strategy, timeout)
+
+		query, _ := dnsQuery(dnsID(), "www.example.com", dnsTypeA)
+
+		start := time.Now()
+		resp, err := d.exchange(context.Background(), query)
+		took := time.Since(start)
+
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s %v: answered", tt.strategy, tt.servers)
+			}
+		} else {
+			checkAnswer(t, tt.strategy.String(), resp, err)
+		}
+		if slow := took >= timeout; slow != tt.slow || took >= 2*timeout {
+			t.Errorf("%s %v: took %s", tt.strategy, tt.servers, took)
+		}
+
+		//health asks the failed upstream last from now on
+		if tt.strategy == DNSHealth {
+			start = time.Now()
+			resp, err = d.exchange(context.Background(), query)
+			checkAnswer(t, "health again", resp, err)
+			if took := time.Since(start); took >= timeout {
+				t.Errorf("health asked the dead upstream first, took %s", took)
+			}
+		}
+		d.Close()
+	}
+}
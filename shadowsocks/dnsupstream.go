@@ -0,0 +1,340 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrDNSUpstream = errors.New("no dns upstream")
+
+const (
+	dnsPlain = iota
+	dnsTLS
+	dnsHTTPS
+)
+
+// idle DNS over TLS connections kept per upstream
+const dotMaxIdle = 4
+const dotIdleTimeout = 30 * time.Second
+
+// dnsUpstream is one server of a dns: plain udp/tcp, DNS over TLS on
+// pooled connections or DNS over HTTPS.
+type dnsUpstream struct {
+	//atomic, first for 64 bit alignment
+	queries uint64
+	errors  uint64
+	//moving average of the answer time, ns
+	latency int64
+	//unix ns of the last failure
+	failedAt int64
+	//failures in a row
+	fails   int32
+	lastErr atomic.Value
+
+	d    *dns
+	kind int
+	//host:port, empty for https
+	addr string
+	host string
+	url  string
+
+	hc *http.Client
+	//server name and roots of tls and https
+	tlsConf *tls.Config
+
+	l      sync.Mutex
+	idle   []*dotConn
+	closed bool
+}
+
+// parseDNSUpstream accepts an ip, tls://host[:port] or https://host/path
+func parseDNSUpstream(d *dns, s string) *dnsUpstream {
+	s = strings.TrimSpace(s)
+
+	if ip := net.ParseIP(s); ip != nil {
+		return &dnsUpstream{d: d, kind: dnsPlain, addr: net.JoinHostPort(ip.String(), "53")}
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "tls":
+		host, port := u.Host, "853"
+		if h, p, err := net.SplitHostPort(u.Host); err == nil {
+			host, port = h, p
+		}
+		return &dnsUpstream{d: d, kind: dnsTLS, addr: net.JoinHostPort(host, port), host: host, tlsConf: &tls.Config{ServerName: host}}
+
+	case "https":
+		t := &dnsUpstream{d: d, kind: dnsHTTPS, url: u.String(), host: u.Hostname()}
+		t.tlsConf = &tls.Config{ServerName: t.host}
+		t.hc = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: t.tlsConf,
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return d.dial(ctx, "tcp", addr)
+				},
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+		return t
+	}
+
+	return nil
+}
+
+// ValidDNSUpstream reports whether s is an upstream NewDNS accepts.
+func ValidDNSUpstream(s string) bool {
+	return parseDNSUpstream(nil, s) != nil
+}
+
+func (u *dnsUpstream) String() string {
+	if u.kind == dnsHTTPS {
+		return u.url
+	}
+	return u.addr
+}
+
+// exchange sends one query and returns the answer with the same id and
+// question, plain servers are asked over udp first and over tcp when
+// truncated
+func (u *dnsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	switch u.kind {
+	case dnsHTTPS:
+		return u.exchangeHTTPS(ctx, query)
+	case dnsTLS:
+		return u.exchangeTLS(ctx, query)
+	}
+
+	conn, err := u.d.dial(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := exchangeConn(ctx, conn, query)
+	conn.Close()
+
+	_, packet := conn.(net.PacketConn)
+	if err != nil || !packet || !dnsTruncated(resp) {
+		return resp, err
+	}
+
+	conn, err = u.d.dial(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeConn(ctx, conn, query)
+}
+
+// exchangeConn frames the query by the kind of conn, raw packets for
+// udp and length prefixed messages for streams
+func exchangeConn(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, ok := conn.(net.PacketConn); ok {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, 64*1024)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				return nil, err
+			}
+			//late answers of an earlier query are skipped
+			if dnsAnswers(query, b[:n]) {
+				return b[:n], nil
+			}
+		}
+	}
+
+	if err := writeDNSStream(conn, query); err != nil {
+		return nil, err
+	}
+	resp, err := readDNSStream(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !dnsAnswers(query, resp) {
+		return nil, ErrDNSMsg
+	}
+	return resp, nil
+}
+
+// exchangeTLS asks over a pooled connection, which the server may have
+// closed meanwhile, so a failure on one is retried on a new connection.
+// A connection that failed is never put back.
+func (u *dnsUpstream) exchangeTLS(ctx context.Context, query []byte) ([]byte, error) {
+	conn, pooled, err := u.dialTLS(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchangeConn(ctx, conn, query)
+	if err != nil {
+		conn.bad = true
+	}
+	conn.Close()
+
+	if err == nil || !pooled || ctx.Err() != nil {
+		return resp, err
+	}
+	Debug.Println("DNS Upstream Pooled", u, err)
+
+	conn, _, err = u.dialTLS(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err = exchangeConn(ctx, conn, query)
+	if err != nil {
+		conn.bad = true
+	}
+	conn.Close()
+
+	return resp, err
+}
+
+func (u *dnsUpstream) Close() {
+	u.l.Lock()
+	idle := u.idle
+	u.idle = nil
+	u.closed = true
+	u.l.Unlock()
+
+	for _, c := range idle {
+		c.Conn.Close()
+	}
+	if u.hc != nil {
+		u.hc.CloseIdleConnections()
+	}
+}
+
+// dialTLS takes an idle connection when reuse is set or dials a new one,
+// pooled tells which it was
+func (u *dnsUpstream) dialTLS(ctx context.Context, reuse bool) (c *dotConn, pooled bool, err error) {
+	u.l.Lock()
+	for reuse && len(u.idle) > 0 {
+		c := u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+
+		if time.Since(c.used) < dotIdleTimeout {
+			u.l.Unlock()
+			return c, true, nil
+		}
+		c.Conn.Close()
+	}
+	u.l.Unlock()
+
+	raw, err := u.d.dial(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	t := tls.Client(raw, u.tlsConf)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		t.SetDeadline(deadline)
+	}
+	if err := t.Handshake(); err != nil {
+		raw.Close()
+		return nil, false, err
+	}
+	t.SetDeadline(time.Time{})
+
+	return &dotConn{Conn: t, u: u}, false, nil
+}
+
+// dotConn goes back to the idle list of its upstream when it is closed
+// after a clean exchange
+type dotConn struct {
+	net.Conn
+	u    *dnsUpstream
+	bad  bool
+	used time.Time
+}
+
+func (c *dotConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.bad = true
+	}
+	return n, err
+}
+
+func (c *dotConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.bad = true
+	}
+	return n, err
+}
+
+func (c *dotConn) Close() error {
+	if c.bad {
+		return c.Conn.Close()
+	}
+
+	c.Conn.SetDeadline(time.Time{})
+	c.used = time.Now()
+
+	c.u.l.Lock()
+	if !c.u.closed && len(c.u.idle) < dotMaxIdle {
+		c.u.idle = append(c.u.idle, c)
+		c.u.l.Unlock()
+		return nil
+	}
+	c.u.l.Unlock()
+
+	return c.Conn.Close()
+}
+
+// exchangeHTTPS posts a wire format message to the url, RFC 8484
+func (u *dnsUpstream) exchangeHTTPS(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", u.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh %s: http status %d", u.url, resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if !dnsAnswers(msg, b) {
+		return nil, ErrDNSMsg
+	}
+	return b, nil
+}
@@ -0,0 +1,254 @@
+package shadowsocks
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testAnswer answers query with 1.2.3.4, or the question of name when
+// it is not empty
+func testAnswer(t *testing.T, query []byte, name string) []byte {
+	if name != "" {
+		other, _ := dnsQuery(0, name, dnsTypeA)
+		copy(other, query[:2])
+		query = other
+	}
+	q, err := parseDNSQuery(query)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	return dnsReply(query, q, 0, []net.IP{net.IPv4(1, 2, 3, 4)}, 60)
+}
+
+func testExchange(u *dnsUpstream, name string) ([]byte, error) {
+	query, _ := dnsQuery(dnsID(), name, dnsTypeA)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	return u.exchange(ctx, query)
+}
+
+func checkAnswer(t *testing.T, what string, resp []byte, err error) {
+	if err != nil {
+		t.Errorf("%s: %v", what, err)
+		return
+	}
+	a, err := parseDNSAnswer(resp, dnsTypeA)
+	if err != nil || len(a.ips) != 1 || !a.ips[0].Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Errorf("%s: got %+v %v", what, a, err)
+	}
+}
+
+func TestExchangeUDP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Skip(err)
+	}
+	defer pc.Close()
+
+	//answers of another id and another question come first, a name
+	//starting with tc is truncated and asked again over tcp
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			n, from, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			query := b[:n]
+
+			wrongID := testAnswer(t, query, "")
+			wrongID[0]++
+			pc.WriteTo(wrongID, from)
+			pc.WriteTo(testAnswer(t, query, "other.example"), from)
+
+			resp := testAnswer(t, query, "")
+			if q, _ := parseDNSQuery(query); strings.HasPrefix(q.name, "tc.") {
+				resp = resp[:q.end]
+				resp[2] |= 0x02
+				resp[6], resp[7] = 0, 0
+			}
+			pc.WriteTo(resp, from)
+		}
+	}()
+
+	var streams int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&streams, 1)
+
+			query, err := readDNSStream(conn)
+			if err == nil {
+				writeDNSStream(conn, testAnswer(t, query, ""))
+			}
+			conn.Close()
+		}
+	}()
+
+	u := &dnsUpstream{d: NewDNS(nil), kind: dnsPlain, addr: pc.LocalAddr().String()}
+
+	resp, err := testExchange(u, "www.example.com")
+	checkAnswer(t, "udp", resp, err)
+	if atomic.LoadInt32(&streams) != 0 {
+		t.Error("asked over tcp without truncation")
+	}
+
+	resp, err = testExchange(u, "tc.example.com")
+	checkAnswer(t, "truncated", resp, err)
+	if atomic.LoadInt32(&streams) != 1 {
+		t.Error("truncated answer not asked over tcp")
+	}
+}
+
+func TestExchangeHTTPS(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		q, _ := parseDNSQuery(query)
+		switch q.name {
+		case "other.example.com":
+			w.Write(testAnswer(t, query, "www.example.com"))
+		case "garbage.example.com":
+			w.Write([]byte("<html>not dns</html>"))
+		case "short.example.com":
+			w.Write(query[:2])
+		case "error.example.com":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write(testAnswer(t, query, ""))
+		}
+	}))
+	defer srv.Close()
+
+	u := &dnsUpstream{d: NewDNS(nil), kind: dnsHTTPS, url: srv.URL, hc: srv.Client()}
+
+	resp, err := testExchange(u, "www.example.com")
+	checkAnswer(t, "doh", resp, err)
+
+	for _, name := range []string{"other.example.com", "garbage.example.com", "short.example.com"} {
+		if _, err := testExchange(u, name); err != ErrDNSMsg {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+	if _, err := testExchange(u, "error.example.com"); err == nil {
+		t.Error("http error accepted")
+	}
+}
+
+// dotServer answers dns over tls, closing each connection after one
+// answer when closeAfter is set
+type dotServer struct {
+	l          net.Listener
+	accepts    int32
+	closeAfter int32
+}
+
+func newDotServer(t *testing.T) (*dotServer, *tls.Config) {
+	//the certificate of httptest is valid for example.com
+	h := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := h.TLS.Certificates[0]
+	roots := x509.NewCertPool()
+	roots.AddCert(h.Certificate())
+	h.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &dotServer{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.accepts, 1)
+			go s.serve(t, conn)
+		}
+	}()
+
+	return s, &tls.Config{ServerName: "example.com", RootCAs: roots}
+}
+
+func (s *dotServer) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	for {
+		query, err := readDNSStream(conn)
+		if err != nil {
+			return
+		}
+
+		name := ""
+		if q, _ := parseDNSQuery(query); q.name == "other.example.com" {
+			name = "www.example.com"
+		}
+		writeDNSStream(conn, testAnswer(t, query, name))
+
+		if atomic.LoadInt32(&s.closeAfter) == 1 {
+			return
+		}
+	}
+}
+
+func TestExchangeTLS(t *testing.T) {
+	s, conf := newDotServer(t)
+	defer s.l.Close()
+
+	u := &dnsUpstream{d: NewDNS(nil), kind: dnsTLS, addr: s.l.Addr().String(), host: "example.com", tlsConf: conf}
+	defer u.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := testExchange(u, "www.example.com")
+		checkAnswer(t, "dot", resp, err)
+	}
+	if n := atomic.LoadInt32(&s.accepts); n != 1 {
+		t.Errorf("%d connections, want one reused", n)
+	}
+
+	//the pooled connection is closed by the server after the next
+	//answer, the one after it is retried on a new connection
+	atomic.StoreInt32(&s.closeAfter, 1)
+	for i := 0; i < 2; i++ {
+		resp, err := testExchange(u, "www.example.com")
+		checkAnswer(t, "dot stale", resp, err)
+	}
+	if n := atomic.LoadInt32(&s.accepts); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+
+	if _, err := testExchange(u, "other.example.com"); err != ErrDNSMsg {
+		t.Errorf("wrong question: got %v", err)
+	}
+	u.l.Lock()
+	idle := len(u.idle)
+	u.l.Unlock()
+	if idle != 0 {
+		t.Errorf("%d connections pooled after a wrong answer", idle)
+	}
+}
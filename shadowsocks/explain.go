@@ -0,0 +1,171 @@
+package shadowsocks
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Explanation tells which route a destination would take and why.
+type Explanation struct {
+	To   string
+	From string
+	//rule, global or direct
+	Mode string
+
+	Proxy bool
+	//rule that matched, Matched is false when no rule did
+	Matched bool
+	RuleID  uint64
+	Matcher string
+	//address that matched when the domain was resolved first
+	Resolved string
+
+	Servers []uint64
+	Server  uint64
+
+	//dns used for the destination: hosts, route <domain>, remote, local,
+	//server, system or none
+	DNS string
+
+	Country string
+	Process string
+
+	//rules that matched but were not used
+	Skipped []Skipped
+}
+
+type Skipped struct {
+	RuleID uint64
+	Reason string
+}
+
+// Explain matches addr (host:port), as if it came from the client from
+// (ip or ip:port, may be empty), without dialing anything.
+func (c *Client) Explain(addr, from string) (*Explanation, error) {
+	raw, err := Parse2RawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	//a fake ip goes by its name, as in Serve
+	raw, ok := c.unfake(raw)
+	if !ok {
+		return nil, ErrFakeIPUnknown
+	}
+
+	m := &Meta{To: raw, explain: true}
+
+	if from != "" {
+		host, port, err := net.SplitHostPort(from)
+		if err != nil {
+			host, port = from, "0"
+		}
+
+		m.From, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	md := c.getMode()
+	e := &Explanation{To: raw.String(), From: from, Mode: md.mode.String()}
+
+	var rt route
+
+	switch md.mode {
+	case ModeGlobal:
+		rt = route{rules: &Rules{}, matcher: "global", shadows: c.candidates(md.servers)}
+	case ModeDirect:
+		e.Matcher = "direct"
+	default:
+		rt = c.explainRoute(m, raw, e)
+	}
+
+	if rt.rules != nil {
+		e.Proxy = true
+		e.Matched = true
+		e.RuleID = rt.rules.ID
+		e.Matcher = rt.matcher
+
+		for _, s := range rt.shadows {
+			e.Servers = append(e.Servers, s.ID)
+		}
+	}
+
+	if len(rt.shadows) > 0 {
+		//the server pick would return next, without moving the balancer
+		idx := int((atomic.LoadUint32(&c.idx) + 1) % uint32(len(rt.shadows)))
+		e.Server = rt.shadows[idx].ID
+	}
+
+	switch r := c.routeDNS(raw.Host()); {
+	case raw.ToIP() != nil:
+		e.DNS = "none"
+	case c.lookupHosts(raw.Host()) != nil:
+		e.DNS = "hosts"
+	case r != nil:
+		e.DNS = "route " + r.suffix
+	case e.Proxy && c.getRemoteDNS() != nil:
+		e.DNS = "remote"
+	case !e.Proxy && c.getLocalDNS() != nil:
+		e.DNS = "local"
+	case e.Proxy:
+		//the server resolves the domain
+		e.DNS = "server"
+	default:
+		e.DNS = "system"
+	}
+
+	e.Country = m.Country
+	e.Process = m.Process
+
+	return e, nil
+}
+
+// explainRoute is the route rule mode takes, in the order dial tries them
+func (c *Client) explainRoute(m *Meta, raw RawAddr, e *Explanation) route {
+	rt := c.route(m, raw)
+	e.skip(rt.skipped)
+
+	//dialLocal matches the local resolved addresses again
+	if rt.rules == nil && raw.ToIP() == nil && (c.resolver(raw.Host(), false) != nil || c.lookupHosts(raw.Host()) != nil) {
+		for _, ip := range c.resolve(m, raw) {
+			t := IP2RawAddr(ip, raw.Port())
+			m.geoDone = false
+
+			rt = c.route(m, t)
+			e.skip(rt.skipped)
+
+			if rt.rules != nil {
+				e.Resolved = t.String()
+				break
+			}
+		}
+	}
+
+	if rt.rules == nil && c.learned(raw.Host()) {
+		if s := c.autoServer(); s != nil {
+			rt = route{rules: &Rules{}, matcher: "learned", shadows: []*Shadow{s}}
+		}
+	}
+
+	return rt
+}
+
+func (e *Explanation) skip(rules []*Rules) {
+	for _, r := range rules {
+		found := false
+		for _, t := range e.Skipped {
+			if t.RuleID == r.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			e.Skipped = append(e.Skipped, Skipped{
+				RuleID: r.ID,
+				Reason: "outside schedule " + r.Schedule.String(),
+			})
+		}
+	}
+}
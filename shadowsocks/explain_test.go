@@ -0,0 +1,136 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// explainClient has servers 1 and 2 and the rules
+//
+//	10: off.example through 1, outside its schedule
+//	11: example.com and off.example through 2
+//	12: 10.0.0.0/8 through 1
+func explainClient(t *testing.T) *Client {
+	c := NewClient("", 5, 5)
+	c.shadows.Store([]*Shadow{{ID: 1}, {ID: 2}})
+
+	//a day that is not today
+	day := weekdays[(int(time.Now().UTC().Weekday())+3)%7][:3]
+	off, err := ParseSchedule(day, "", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRules(10, "off.example", "1")
+	r.Schedule = off
+
+	c.ReplaceRules([]*Rules{
+		r,
+		NewRules(11, "example.com\noff.example", "2"),
+		NewRules(12, "10.0.0.0/8", "1"),
+	})
+
+	c.SetHosts(ParseHosts("10.1.1.1 pinned.example"))
+
+	c.SetAuto(2, time.Second, time.Hour)
+	c.Learn("learned.example", time.Now().Add(time.Hour))
+
+	return c
+}
+
+func TestExplain(t *testing.T) {
+	c := explainClient(t)
+
+	tests := []struct {
+		addr     string
+		proxy    bool
+		rule     uint64
+		matcher  string
+		resolved string
+		server   uint64
+		dns      string
+		skipped  string
+	}{
+		{"www.example.com:443", true, 11, "domain", "", 2, "server", ""},
+		{"off.example:80", true, 11, "domain", "", 2, "server", "10"},
+		{"10.2.3.4:22", true, 12, "ip", "", 1, "none", ""},
+		//matched again with the address of the hosts entry
+		{"pinned.example:443", true, 12, "ip", "10.1.1.1:443", 1, "hosts", ""},
+		{"learned.example:443", true, 0, "learned", "", 2, "server", ""},
+		{"other.net:443", false, 0, "", "", 0, "system", ""},
+	}
+
+	for _, tt := range tests {
+		e, err := c.Explain(tt.addr, "")
+		if err != nil {
+			t.Errorf("%s: %v", tt.addr, err)
+			continue
+		}
+
+		var skipped []string
+		for _, s := range e.Skipped {
+			skipped = append(skipped, fmt.Sprint(s.RuleID))
+			if !strings.HasPrefix(s.Reason, "outside schedule") {
+				t.Errorf("%s: skipped for %q", tt.addr, s.Reason)
+			}
+		}
+
+		if e.Proxy != tt.proxy || e.Matched != tt.proxy || e.RuleID != tt.rule || e.Matcher != tt.matcher ||
+			e.Resolved != tt.resolved || e.Server != tt.server || e.DNS != tt.dns || strings.Join(skipped, ",") != tt.skipped {
+			t.Errorf("%s: %+v", tt.addr, e)
+		}
+		if e.Mode != "rule" || e.To != tt.addr {
+			t.Errorf("%s: mode %q to %q", tt.addr, e.Mode, e.To)
+		}
+	}
+}
+
+func TestExplainMode(t *testing.T) {
+	c := explainClient(t)
+
+	c.SetMode(ModeGlobal, "1")
+	e, err := c.Explain("other.net:443", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Proxy || e.Matcher != "global" || fmt.Sprint(e.Servers) != "[1]" || e.Server != 1 || e.Mode != "global" {
+		t.Errorf("global: %+v", e)
+	}
+
+	c.SetMode(ModeDirect, "")
+	e, err = c.Explain("www.example.com:443", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Proxy || e.Matcher != "direct" || e.DNS != "system" || e.Mode != "direct" {
+		t.Errorf("direct: %+v", e)
+	}
+}
+
+func TestExplainInput(t *testing.T) {
+	c := explainClient(t)
+
+	//the client address is optional, with or without a port
+	for _, from := range []string{"192.168.1.5", "192.168.1.5:5000", "[fd00::5]:5000"} {
+		e, err := c.Explain("www.example.com:443", from)
+		if err != nil || e.From != from {
+			t.Errorf("from %s: %+v %v", from, e, err)
+		}
+	}
+
+	if _, err := c.Explain("www.example.com:443", "not an address"); err == nil {
+		t.Errorf("bad client address explained")
+	}
+	if _, err := c.Explain("www.example.com", ""); err == nil {
+		t.Errorf("address without port explained")
+	}
+
+	if err := c.SetFakeIP("198.18.0.0/16", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Explain("198.18.0.9:443", ""); err != ErrFakeIPUnknown {
+		t.Errorf("unknown fake ip: %v", err)
+	}
+}
@@ -0,0 +1,646 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	pac "sshProxy/shadowsocks/pac"
+)
+
+// Expr is a compiled boolean rule expression such as
+//
+//	port in (22, 3306) and ip in 10.8.0.0/16 and src != 10.0.0.5
+//
+// Fields are host, sni, ip, resolved, port, src, process, uid, time and
+// day. Conditions compare a field with ==, !=, in, not in, ~ (wildcard)
+// or, for port, uid and time, < <= > >=, and are combined with and, or,
+// not and parentheses. Values are bare words or "quoted" strings.
+//
+// An expression can only compare fields of the connection with constants,
+// there are no calls or loops, so evaluating one is cheap and safe.
+type Expr struct {
+	text string
+	eval func(e *exprEnv) bool
+	//reads process or uid
+	process bool
+}
+
+// ExprError is a compile error at a byte offset of the expression.
+type ExprError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ExprError) Error() string {
+	return fmt.Sprintf("expr: %s at %d", e.Msg, e.Pos+1)
+}
+
+// exprEnv is the connection an expression is evaluated against
+type exprEnv struct {
+	c    *Client
+	m    *Meta
+	addr RawAddr
+	now  time.Time
+}
+
+func (e *exprEnv) resolved() []net.IP {
+	if ip := e.addr.ToIP(); ip != nil {
+		return []net.IP{ip}
+	}
+	if e.c == nil {
+		return nil
+	}
+	return e.c.resolve(e.m, e.addr)
+}
+
+func (x *Expr) String() string {
+	return x.text
+}
+
+// match evaluates x, time and day in loc or the local time when nil
+func (x *Expr) match(c *Client, m *Meta, addr RawAddr, loc *time.Location) bool {
+	now := time.Now()
+	if loc != nil {
+		now = now.In(loc)
+	}
+	return x.eval(&exprEnv{c: c, m: m, addr: addr, now: now})
+}
+
+// CompileExpr parses an expression, empty text compiles to nil.
+func CompileExpr(text string) (x *Expr, err error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+
+	toks, err := exprLex(text)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{toks: toks}
+
+	fn, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tkEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+
+	return &Expr{text: text, eval: fn, process: p.process}, nil
+}
+
+const (
+	tkEOF = iota
+	tkWord
+	tkString
+	tkOp
+	tkLParen
+	tkRParen
+	tkComma
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+var exprOps = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "~", "!"}
+
+func exprLex(s string) ([]exprToken, error) {
+	var toks []exprToken
+
+	for i := 0; i < len(s); {
+		c := s[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+		case c == '(':
+			toks = append(toks, exprToken{tkLParen, "(", i})
+			i++
+			continue
+		case c == ')':
+			toks = append(toks, exprToken{tkRParen, ")", i})
+			i++
+			continue
+		case c == ',':
+			toks = append(toks, exprToken{tkComma, ",", i})
+			i++
+			continue
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, &ExprError{i, "unterminated string"}
+			}
+			t, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, &ExprError{i, "bad string"}
+			}
+			toks = append(toks, exprToken{tkString, t, i})
+			i = j + 1
+			continue
+		}
+
+		op := ""
+		for _, o := range exprOps {
+			if strings.HasPrefix(s[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op != "" {
+			toks = append(toks, exprToken{tkOp, op, i})
+			i += len(op)
+			continue
+		}
+		if strings.IndexByte("=&|", c) >= 0 {
+			return nil, &ExprError{i, fmt.Sprintf("unexpected %q", c)}
+		}
+
+		j := i
+		for j < len(s) && strings.IndexByte(" \t\r\n(),\"=!<>~&|", s[j]) < 0 {
+			j++
+		}
+		toks = append(toks, exprToken{tkWord, s[i:j], i})
+		i = j
+	}
+
+	return append(toks, exprToken{tkEOF, "end", len(s)}), nil
+}
+
+type exprParser struct {
+	toks []exprToken
+	i    int
+	//a process or uid field was seen
+	process bool
+}
+
+type exprFunc func(e *exprEnv) bool
+
+func (p *exprParser) peek() exprToken {
+	return p.toks[p.i]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.toks[p.i]
+	if t.kind != tkEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *exprParser) errorf(t exprToken, format string, args ...interface{}) error {
+	return &ExprError{t.pos, fmt.Sprintf(format, args...)}
+}
+
+func (p *exprParser) is(t exprToken, word, op string) bool {
+	return (t.kind == tkWord && strings.EqualFold(t.text, word)) || (t.kind == tkOp && t.text == op)
+}
+
+func (p *exprParser) or() (exprFunc, error) {
+	a, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.is(p.peek(), "or", "||") {
+		p.next()
+
+		b, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+
+		l, r := a, b
+		a = func(e *exprEnv) bool { return l(e) || r(e) }
+	}
+	return a, nil
+}
+
+func (p *exprParser) and() (exprFunc, error) {
+	a, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.is(p.peek(), "and", "&&") {
+		p.next()
+
+		b, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+
+		l, r := a, b
+		a = func(e *exprEnv) bool { return l(e) && r(e) }
+	}
+	return a, nil
+}
+
+func (p *exprParser) not() (exprFunc, error) {
+	if p.is(p.peek(), "not", "!") {
+		p.next()
+
+		a, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(e *exprEnv) bool { return !a(e) }, nil
+	}
+
+	if p.peek().kind == tkLParen {
+		p.next()
+
+		a, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tkRParen {
+			return nil, p.errorf(t, "missing )")
+		}
+		return a, nil
+	}
+
+	return p.cond()
+}
+
+// cond parses field op value
+func (p *exprParser) cond() (exprFunc, error) {
+	f := p.next()
+	if f.kind != tkWord {
+		return nil, p.errorf(f, "expected a field, got %q", f.text)
+	}
+
+	field := strings.ToLower(f.text)
+	if _, ok := exprFields[field]; !ok {
+		return nil, p.errorf(f, "unknown field %q", f.text)
+	}
+	if field == "process" || field == "uid" {
+		p.process = true
+	}
+
+	o := p.next()
+	op := o.text
+	switch {
+	case o.kind == tkOp && op != "!" && op != "&&" && op != "||":
+	case o.kind == tkWord && strings.EqualFold(op, "in"):
+		op = "in"
+	case o.kind == tkWord && strings.EqualFold(op, "not") && p.is(p.peek(), "in", ""):
+		p.next()
+		op = "not in"
+	default:
+		return nil, p.errorf(o, "expected an operator after %s, got %q", field, o.text)
+	}
+
+	var vals []exprToken
+	if op == "in" || op == "not in" {
+		if p.peek().kind == tkLParen {
+			p.next()
+			for {
+				v := p.next()
+				if v.kind != tkWord && v.kind != tkString {
+					return nil, p.errorf(v, "expected a value, got %q", v.text)
+				}
+				vals = append(vals, v)
+
+				t := p.next()
+				if t.kind == tkRParen {
+					break
+				}
+				if t.kind != tkComma {
+					return nil, p.errorf(t, "expected , or ), got %q", t.text)
+				}
+			}
+		}
+	}
+	if len(vals) == 0 {
+		v := p.next()
+		if v.kind != tkWord && v.kind != tkString {
+			return nil, p.errorf(v, "expected a value, got %q", v.text)
+		}
+		vals = append(vals, v)
+	}
+
+	neg := false
+	switch op {
+	case "!=":
+		op, neg = "==", true
+	case "not in":
+		op, neg = "in", true
+	}
+
+	fn, err := exprFields[field](p, f, op, vals)
+	if err != nil {
+		return nil, err
+	}
+
+	if neg {
+		return func(e *exprEnv) bool { return !fn(e) }, nil
+	}
+	return fn, nil
+}
+
+type exprCompiler func(p *exprParser, f exprToken, op string, vals []exprToken) (exprFunc, error)
+
+var exprFields map[string]exprCompiler
+
+func init() {
+	exprFields = map[string]exprCompiler{
+		"host": exprHost(func(e *exprEnv) string { return e.addr.Host() }),
+		"sni":  exprHost(func(e *exprEnv) string { return e.m.Sniffed }),
+		"process": exprString(func(e *exprEnv) (string, bool) {
+			return e.m.Process, e.m.Process != ""
+		}),
+		"ip": exprIP(func(e *exprEnv) []net.IP {
+			if ip := e.addr.ToIP(); ip != nil {
+				return []net.IP{ip}
+			}
+			return nil
+		}),
+		"resolved": exprIP(func(e *exprEnv) []net.IP {
+			return e.resolved()
+		}),
+		"src": exprIP(func(e *exprEnv) []net.IP {
+			if ip := AddrIP(e.m.From); ip != nil {
+				return []net.IP{ip}
+			}
+			return nil
+		}),
+		"port": exprNum(65535, func(e *exprEnv) (int, bool) {
+			return int(e.addr.Port()), true
+		}),
+		"uid": exprNum(1<<31-1, func(e *exprEnv) (int, bool) {
+			return e.m.UID, e.m.UIDKnown
+		}),
+		"time": exprTime,
+		"day":  exprDay,
+	}
+}
+
+func exprOnly(p *exprParser, f exprToken, op string, ops ...string) error {
+	for _, o := range ops {
+		if o == op {
+			return nil
+		}
+	}
+	return p.errorf(f, "%s does not support %s", strings.ToLower(f.text), op)
+}
+
+// exprHost compares domains, in also matches subdomains
+func exprHost(get func(e *exprEnv) string) exprCompiler {
+	return func(p *exprParser, f exprToken, op string, vals []exprToken) (exprFunc, error) {
+		if err := exprOnly(p, f, op, "==", "in", "~"); err != nil {
+			return nil, err
+		}
+
+		host := func(e *exprEnv) string {
+			return strings.TrimSuffix(strings.ToLower(get(e)), ".")
+		}
+
+		switch op {
+		case "~":
+			reg, err := exprGlob(vals[0].text)
+			if err != nil {
+				return nil, p.errorf(vals[0], "bad pattern %q", vals[0].text)
+			}
+			return func(e *exprEnv) bool { return reg.MatchString(host(e)) }, nil
+
+		case "in":
+			d := make(pac.Domain)
+			for _, v := range vals {
+				d.Add(strings.TrimSuffix(strings.ToLower(v.text), "."))
+			}
+			return func(e *exprEnv) bool {
+				h := host(e)
+				return h != "" && d.Match(h)
+			}, nil
+		}
+
+		want := strings.TrimSuffix(strings.ToLower(vals[0].text), ".")
+		return func(e *exprEnv) bool { return host(e) == want }, nil
+	}
+}
+
+func exprString(get func(e *exprEnv) (string, bool)) exprCompiler {
+	return func(p *exprParser, f exprToken, op string, vals []exprToken) (exprFunc, error) {
+		if err := exprOnly(p, f, op, "==", "in", "~"); err != nil {
+			return nil, err
+		}
+
+		if op == "~" {
+			reg, err := exprGlob(vals[0].text)
+			if err != nil {
+				return nil, p.errorf(vals[0], "bad pattern %q", vals[0].text)
+			}
+			return func(e *exprEnv) bool {
+				s, ok := get(e)
+				return ok && reg.MatchString(strings.ToLower(s))
+			}, nil
+		}
+
+		return func(e *exprEnv) bool {
+			s, ok := get(e)
+			if !ok {
+				return false
+			}
+			for _, v := range vals {
+				if v.text == s {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+}
+
+// exprIP matches addresses against ips, cidrs and a-b ranges, a field
+// with several addresses matches when any of them does
+func exprIP(get func(e *exprEnv) []net.IP) exprCompiler {
+	return func(p *exprParser, f exprToken, op string, vals []exprToken) (exprFunc, error) {
+		if err := exprOnly(p, f, op, "==", "in"); err != nil {
+			return nil, err
+		}
+
+		nets := pac.NewIPNets()
+		for _, v := range vals {
+			if start, end, ok := parseIPRange(v.text); ok {
+				if err := nets.AddRange(start, end, nil); err != nil {
+					return nil, p.errorf(v, "bad ip range %q", v.text)
+				}
+				continue
+			}
+
+			n, ok := parseIPNet(v.text)
+			if !ok {
+				return nil, p.errorf(v, "bad ip %q", v.text)
+			}
+			nets.Add(n)
+		}
+
+		return func(e *exprEnv) bool {
+			for _, ip := range get(e) {
+				if nets.Match(ip) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+}
+
+func exprCompare(op string, a, b int) bool {
+	switch op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return a == b
+}
+
+func exprNum(max int, get func(e *exprEnv) (int, bool)) exprCompiler {
+	return func(p *exprParser, f exprToken, op string, vals []exprToken) (exprFunc, error) {
+		if err := exprOnly(p, f, op, "==", "in", "<", "<=", ">", ">="); err != nil {
+			return nil, err
+		}
+
+		var spans [][2]int
+		for _, v := range vals {
+			a, b := v.text, v.text
+			if i := strings.IndexByte(v.text, '-'); i > 0 && op == "in" {
+				a, b = v.text[:i], v.text[i+1:]
+			}
+
+			min, err1 := strconv.Atoi(a)
+			max2, err2 := strconv.Atoi(b)
+			if err1 != nil || err2 != nil || min < 0 || max2 > max || max2 < min {
+				return nil, p.errorf(v, "bad number %q", v.text)
+			}
+			spans = append(spans, [2]int{min, max2})
+		}
+
+		if op != "in" {
+			want := spans[0][0]
+			return func(e *exprEnv) bool {
+				n, ok := get(e)
+				return ok && exprCompare(op, n, want)
+			}, nil
+		}
+
+		return func(e *exprEnv) bool {
+			n, ok := get(e)
+			if !ok {
+				return false
+			}
+			for _, s := range spans {
+				if n >= s[0] && n <= s[1] {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+}
+
+// exprTime compares the time of day in the zone of the rule, hh:mm-hh:mm
+// ranges may run past midnight
+func exprTime(p *exprParser, f exprToken, op string, vals []exprToken) (exprFunc, error) {
+	if err := exprOnly(p, f, op, "==", "in", "<", "<=", ">", ">="); err != nil {
+		return nil, err
+	}
+
+	now := func(e *exprEnv) int {
+		return e.now.Hour()*60 + e.now.Minute()
+	}
+
+	var spans [][2]int
+	for _, v := range vals {
+		a, b := v.text, v.text
+		if i := strings.IndexByte(v.text, '-'); i > 0 && op == "in" {
+			a, b = v.text[:i], v.text[i+1:]
+		}
+
+		start, ok1 := clock(a)
+		end, ok2 := clock(b)
+		if !ok1 || !ok2 {
+			return nil, p.errorf(v, "bad time %q, use hh:mm", v.text)
+		}
+		spans = append(spans, [2]int{start, end})
+	}
+
+	if op != "in" {
+		want := spans[0][0]
+		return func(e *exprEnv) bool { return exprCompare(op, now(e), want) }, nil
+	}
+
+	return func(e *exprEnv) bool {
+		t := now(e)
+		for _, s := range spans {
+			if s[0] == s[1] && t == s[0] {
+				return true
+			}
+			if s[0] < s[1] && t >= s[0] && t < s[1] {
+				return true
+			}
+			if s[0] > s[1] && (t >= s[0] || t < s[1]) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// exprDay compares the day of the week in the zone of the rule, mon-fri
+// ranges included
+func exprDay(p *exprParser, f exprToken, op string, vals []exprToken) (exprFunc, error) {
+	if err := exprOnly(p, f, op, "==", "in"); err != nil {
+		return nil, err
+	}
+
+	var days [7]bool
+	for _, v := range vals {
+		s := strings.ToLower(v.text)
+
+		a, b := s, s
+		if i := strings.IndexByte(s, '-'); i > 0 && op == "in" {
+			a, b = s[:i], s[i+1:]
+		}
+
+		from, to := weekday(a), weekday(b)
+		if from < 0 || to < 0 {
+			return nil, p.errorf(v, "bad day %q", v.text)
+		}
+		for i := from; ; i = (i + 1) % 7 {
+			days[i] = true
+			if i == to {
+				break
+			}
+		}
+	}
+
+	return func(e *exprEnv) bool { return days[e.now.Weekday()] }, nil
+}
+
+// exprGlob compiles a wildcard pattern, * is any text and ? one char
+func exprGlob(s string) (*regexp.Regexp, error) {
+	t := regexp.QuoteMeta(strings.ToLower(s))
+	t = strings.Replace(t, `\*`, ".*", -1)
+	t = strings.Replace(t, `\?`, ".", -1)
+	return regexp.Compile("^" + t + "$")
+}
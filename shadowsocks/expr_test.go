@@ -0,0 +1,164 @@
+package shadowsocks
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func exprEnvFor(t *testing.T, addr, from string, now time.Time) *exprEnv {
+	a, err := Parse2RawAddr(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := net.ResolveTCPAddr("tcp", from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Meta{From: src, To: a, UID: 1000, UIDKnown: true, Process: "curl"}
+	return &exprEnv{m: m, addr: a, now: now}
+}
+
+func TestExprEval(t *testing.T) {
+	//a monday
+	now := time.Date(2024, 1, 1, 23, 30, 0, 0, time.UTC)
+	e := exprEnvFor(t, "10.8.1.2:22", "192.168.1.5:5000", now)
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		//and binds tighter than or
+		{"port == 80 or port == 22 and src == 192.168.1.5", true},
+		{"port == 22 or port == 80 and src == 1.1.1.1", true},
+		{"(port == 22 or port == 80) and src == 1.1.1.1", false},
+		{"port == 80 || port == 22 && uid == 1000", true},
+
+		{"not port == 22", false},
+		{"! port == 80", true},
+		{"not not port == 22", true},
+		{"not (port == 80 or ip in 10.8.0.0/16)", false},
+		{"not port == 80 and port == 22", true},
+
+		{"port != 22", false},
+		{"port < 23", true},
+		{"port <= 22", true},
+		{"port > 22", false},
+		{"port >= 22", true},
+		{"port in (21, 22)", true},
+		{"port in 20-30", true},
+		{"port not in (80, 443)", true},
+		{"uid > 999", true},
+		{"uid in (0, 33)", false},
+
+		{"ip == 10.8.1.2", true},
+		{"ip in (10.8.0.0/16, 172.16.0.0/12)", true},
+		{"ip in 10.8.1.0-10.8.1.9", true},
+		{"src in 192.168.1.0/24", true},
+		{"process == curl", true},
+		{`process ~ "cu*"`, true},
+		{"host in (example.com)", false},
+
+		{"time >= 23:00", true},
+		{"time in 22:00-06:00", true},
+		{"time in 08:00-18:00", false},
+		{"day == 1", true},
+		{"day in 2-6", false},
+	}
+
+	for _, tt := range tests {
+		x, err := CompileExpr(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got := x.eval(e); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestExprUnknown(t *testing.T) {
+	e := exprEnvFor(t, "10.8.1.2:22", "127.0.0.1:5000", time.Now())
+	e.m.UIDKnown = false
+	e.m.Process = ""
+
+	//unknown values match no value, so != and not in do
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"uid == 1000", false},
+		{"uid != 1000", true},
+		{"uid < 5000", false},
+		{"process == curl", false},
+		{"process not in (curl, wget)", true},
+	}
+
+	for _, tt := range tests {
+		x, err := CompileExpr(tt.expr)
+		if err != nil {
+			t.Fatal(tt.expr, err)
+		}
+		if got := x.eval(e); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestExprZone(t *testing.T) {
+	east := time.FixedZone("east", 14*3600)
+	west := time.FixedZone("west", -12*3600)
+
+	//the zones are 26 hours apart, never on the same day
+	day := int(time.Now().In(east).Weekday())
+	x, err := CompileExpr("day == " + strconv.Itoa(day))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := Parse2RawAddr("10.0.0.1:80")
+	m := &Meta{To: a}
+
+	if !x.match(nil, m, a, east) {
+		t.Errorf("day %d not matched in %s", day, east)
+	}
+	if x.match(nil, m, a, west) {
+		t.Errorf("day %d matched in %s", day, west)
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+	}{
+		{"color == red", 0},
+		{"port 22", 5},
+		{"port ==", 7},
+		{"port == 22 and", 14},
+		{"port == 22)", 10},
+		{"(port == 22", 11},
+		{"port in (22, 80", 15},
+		{"port == 70000", 8},
+		{"port ~ 22", 0},
+		{"ip == 10.0.0.300", 6},
+		{"time == 25:00", 8},
+		{"day == someday", 7},
+		{`host == "example`, 8},
+		{"port = 22", 5},
+	}
+
+	for _, tt := range tests {
+		_, err := CompileExpr(tt.expr)
+		e, ok := err.(*ExprError)
+		if !ok {
+			t.Errorf("%s: got %v, want an ExprError", tt.expr, err)
+			continue
+		}
+		if e.Pos != tt.pos {
+			t.Errorf("%s: error %q at %d, want %d", tt.expr, e.Msg, e.Pos, tt.pos)
+		}
+	}
+}
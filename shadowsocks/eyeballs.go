@@ -0,0 +1,178 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+var ErrIPPref = errors.New("unknown ip preference, use ipv6, ipv4 or ipv4only")
+var ErrNoIPv4 = errors.New("no ipv4 address to dial with ipv4only")
+
+// IPPref decides the order resolved addresses are tried in.
+type IPPref int
+
+const (
+	//ipv6 first, the RFC 8305 default
+	PreferIPv6 IPPref = iota
+	PreferIPv4
+	//ipv6 addresses are dropped
+	IPv4Only
+)
+
+var ipPrefNames = []string{"ipv6", "ipv4", "ipv4only"}
+
+func (p IPPref) String() string {
+	if p < 0 || int(p) >= len(ipPrefNames) {
+		return ""
+	}
+	return ipPrefNames[p]
+}
+
+func ParseIPPref(s string) (IPPref, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return PreferIPv6, nil
+	}
+
+	for i, n := range ipPrefNames {
+		if n == s {
+			return IPPref(i), nil
+		}
+	}
+	return PreferIPv6, ErrIPPref
+}
+
+// RFC 8305 connection attempt delay
+const eyeballsDelay = 250 * time.Millisecond
+
+// SetIPPref sets the order resolved addresses are dialed in.
+func (c *Client) SetIPPref(p IPPref) {
+	c.ipPref.Store(p)
+}
+
+func (c *Client) getIPPref() IPPref {
+	return c.ipPref.Load().(IPPref)
+}
+
+// sortAddrs interleaves the families, the preferred one first
+func sortAddrs(ipaddr []net.IPAddr, pref IPPref) []net.IP {
+	var v4, v6 []net.IP
+	for _, t := range ipaddr {
+		if t.IP.To4() != nil {
+			v4 = append(v4, t.IP)
+		} else {
+			v6 = append(v6, t.IP)
+		}
+	}
+
+	first, second := v6, v4
+	switch pref {
+	case PreferIPv4:
+		first, second = v4, v6
+	case IPv4Only:
+		first, second = v4, nil
+	}
+
+	ips := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ips = append(ips, first[i])
+		}
+		if i < len(second) {
+			ips = append(ips, second[i])
+		}
+	}
+	return ips
+}
+
+type raceResult struct {
+	i    int
+	conn net.Conn
+	err  error
+}
+
+// race dials n addresses RFC 8305 style: the next attempt starts after
+// eyeballsDelay or as soon as one fails. The first connection wins, the
+// context of the others is cancelled and connections still coming are
+// closed.
+func race(ctx context.Context, n int, dial func(ctx context.Context, i int) (net.Conn, error)) (net.Conn, int, error) {
+	if n == 0 {
+		return nil, -1, ErrDial
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan raceResult, n)
+	started, pending := 0, 0
+
+	start := func() {
+		i := started
+		started++
+		pending++
+
+		go func() {
+			conn, err := dial(ctx, i)
+			results <- raceResult{i, conn, err}
+		}()
+	}
+
+	var firstErr error
+
+	timer := time.NewTimer(eyeballsDelay)
+	defer timer.Stop()
+
+	start()
+	for pending > 0 {
+		var next <-chan time.Time
+		if started < n {
+			next = timer.C
+		}
+
+		select {
+		case r := <-results:
+			pending--
+
+			if r.err == nil {
+				go func(left int) {
+					for ; left > 0; left-- {
+						if t := <-results; t.conn != nil {
+							t.conn.Close()
+						}
+					}
+				}(pending)
+
+				return r.conn, r.i, nil
+			}
+
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			Debug.Println("Dial Attempt", r.i, r.err)
+
+			if started < n {
+				start()
+				resetTimer(timer)
+			}
+
+		case <-next:
+			start()
+			timer.Reset(eyeballsDelay)
+		}
+	}
+
+	return nil, -1, firstErr
+}
+
+func resetTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(eyeballsDelay)
+}
@@ -0,0 +1,185 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseIPPref(t *testing.T) {
+	tests := []struct {
+		s    string
+		want IPPref
+		err  error
+	}{
+		{"", PreferIPv6, nil},
+		{"IPv4", PreferIPv4, nil},
+		{" ipv4only ", IPv4Only, nil},
+		{"ipv6", PreferIPv6, nil},
+		{"v4", PreferIPv6, ErrIPPref},
+	}
+	for _, tt := range tests {
+		got, err := ParseIPPref(tt.s)
+		if got != tt.want || err != tt.err {
+			t.Errorf("%q = %v %v", tt.s, got, err)
+		}
+	}
+}
+
+func TestSortAddrs(t *testing.T) {
+	var ipaddr []net.IPAddr
+	for _, s := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "2001:db8::1", "2001:db8::2"} {
+		ipaddr = append(ipaddr, net.IPAddr{IP: net.ParseIP(s)})
+	}
+
+	tests := []struct {
+		pref IPPref
+		want []string
+	}{
+		{PreferIPv6, []string{"2001:db8::1", "10.0.0.1", "2001:db8::2", "10.0.0.2", "10.0.0.3"}},
+		{PreferIPv4, []string{"10.0.0.1", "2001:db8::1", "10.0.0.2", "2001:db8::2", "10.0.0.3"}},
+		{IPv4Only, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+	}
+	for _, tt := range tests {
+		got := sortAddrs(ipaddr, tt.pref)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v", tt.pref, got)
+			continue
+		}
+		for i := range got {
+			if got[i].String() != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.pref, got, tt.want)
+				break
+			}
+		}
+	}
+
+	if got := sortAddrs(ipaddr[3:], IPv4Only); len(got) != 0 {
+		t.Errorf("ipv6 only with ipv4only: got %v", got)
+	}
+}
+
+// raceConn returns one end of a pipe, the other end tells when it is
+// closed
+func raceConn(closed chan<- int, i int) net.Conn {
+	a, b := net.Pipe()
+	go func() {
+		io.Copy(io.Discard, b)
+		closed <- i
+	}()
+	return a
+}
+
+func TestRaceCancel(t *testing.T) {
+	cancelled := make(chan int, 2)
+	closed := make(chan int, 2)
+
+	start := time.Now()
+	conn, i, err := race(context.Background(), 2, func(ctx context.Context, i int) (net.Conn, error) {
+		if i == 0 {
+			//never answers, unless cancelled
+			<-ctx.Done()
+			cancelled <- i
+			return nil, ctx.Err()
+		}
+		return raceConn(closed, i), nil
+	})
+	if err != nil || i != 1 {
+		t.Fatalf("got %d %v", i, err)
+	}
+	defer conn.Close()
+
+	if took := time.Since(start); took < eyeballsDelay || took > eyeballsDelay+time.Second {
+		t.Errorf("second attempt after %s", took)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("losing attempt not cancelled")
+	}
+}
+
+func TestRaceLate(t *testing.T) {
+	closed := make(chan int, 2)
+
+	//the first one ignores its context and connects after the winner
+	conn, i, err := race(context.Background(), 2, func(ctx context.Context, i int) (net.Conn, error) {
+		if i == 0 {
+			time.Sleep(eyeballsDelay + 100*time.Millisecond)
+		}
+		return raceConn(closed, i), nil
+	})
+	if err != nil || i != 1 {
+		t.Fatalf("got %d %v", i, err)
+	}
+	defer conn.Close()
+
+	select {
+	case n := <-closed:
+		if n != 0 {
+			t.Errorf("winner %d closed", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("late connection not closed")
+	}
+}
+
+func TestRaceFailures(t *testing.T) {
+	errFirst := errors.New("first")
+	closed := make(chan int, 3)
+
+	//a failure starts the next attempt at once
+	start := time.Now()
+	conn, i, err := race(context.Background(), 3, func(ctx context.Context, i int) (net.Conn, error) {
+		if i < 2 {
+			return nil, errFirst
+		}
+		return raceConn(closed, i), nil
+	})
+	if err != nil || i != 2 {
+		t.Fatalf("got %d %v", i, err)
+	}
+	conn.Close()
+	if took := time.Since(start); took >= eyeballsDelay {
+		t.Errorf("took %s after failures", took)
+	}
+
+	_, i, err = race(context.Background(), 3, func(ctx context.Context, i int) (net.Conn, error) {
+		if i == 0 {
+			return nil, errFirst
+		}
+		return nil, errors.New("later")
+	})
+	if err != errFirst || i != -1 {
+		t.Errorf("all failed: got %d %v", i, err)
+	}
+
+	if _, _, err := race(context.Background(), 0, nil); err != ErrDial {
+		t.Errorf("no address: got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = race(ctx, 2, func(ctx context.Context, i int) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Errorf("cancelled: got %v", err)
+	}
+}
+
+func TestDialLocalIPv4Only(t *testing.T) {
+	c := NewClient("", 1, 5)
+	c.SetHosts(ParseHosts("2001:db8::1 v6only.example"))
+	c.SetIPPref(IPv4Only)
+
+	raw, _ := Parse2RawAddr("v6only.example:80")
+	if _, _, err := c.dialLocal(context.Background(), &Meta{To: raw}, raw); err != ErrNoIPv4 {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+var ErrFakeIP = errors.New("invalid fake ip range")
+var ErrFakeIPUnknown = errors.New("unknown fake ip")
+
+// ttl of fake answers
+const fakeIPTTL = 60
+
+// fakeIP hands out addresses of an ipv4 pool to names, so connections
+// to them can be routed by name again. When the pool is used up the
+// oldest address is given to the new name.
+type fakeIP struct {
+	l    sync.Mutex
+	base uint32
+	size uint32
+	//offset of the next address
+	next uint32
+
+	names map[string]uint32
+	ips   map[uint32]string
+
+	//names answered with real addresses
+	exclude []string
+}
+
+func newFakeIP(cidr, exclude string) (*fakeIP, error) {
+	_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, err
+	}
+
+	ip := ipnet.IP.To4()
+	ones, bits := ipnet.Mask.Size()
+	if ip == nil || bits != 32 || ones > 30 {
+		return nil, ErrFakeIP
+	}
+
+	f := &fakeIP{
+		base:  binary.BigEndian.Uint32(ip),
+		size:  1 << uint(32-ones),
+		next:  1,
+		names: make(map[string]uint32),
+		ips:   make(map[uint32]string),
+	}
+
+	for _, t := range StrSplit(exclude) {
+		if t = dnsRouteDomain(t); t != "" {
+			f.exclude = append(f.exclude, t)
+		}
+	}
+
+	return f, nil
+}
+
+func (f *fakeIP) ip(off uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, f.base+off)
+	return ip
+}
+
+// offset of ip in the pool, without the network and broadcast address
+func (f *fakeIP) offset(ip net.IP) (uint32, bool) {
+	ip = ip.To4()
+	if ip == nil {
+		return 0, false
+	}
+
+	off := binary.BigEndian.Uint32(ip) - f.base
+	return off, off > 0 && off < f.size-1
+}
+
+func (f *fakeIP) excluded(name string) bool {
+	for _, t := range f.exclude {
+		if name == t || strings.HasSuffix(name, "."+t) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the address of name, new is true when it was assigned now
+func (f *fakeIP) get(name string) (ip net.IP, new bool) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if off, ok := f.names[name]; ok {
+		return f.ip(off), false
+	}
+
+	off := f.next
+	f.next++
+	if f.next >= f.size-1 {
+		f.next = 1
+	}
+
+	if old, ok := f.ips[off]; ok {
+		delete(f.names, old)
+	}
+	f.names[name] = off
+	f.ips[off] = name
+
+	return f.ip(off), true
+}
+
+// restore puts back a saved address, in the order they were assigned
+func (f *fakeIP) restore(ip net.IP, name string) {
+	off, ok := f.offset(ip)
+	if !ok || name == "" {
+		return
+	}
+
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if old, ok := f.ips[off]; ok {
+		delete(f.names, old)
+	}
+	if old, ok := f.names[name]; ok {
+		delete(f.ips, old)
+	}
+	f.names[name] = off
+	f.ips[off] = name
+
+	f.next = off + 1
+	if f.next >= f.size-1 {
+		f.next = 1
+	}
+}
+
+func (f *fakeIP) name(ip net.IP) (string, bool) {
+	off, ok := f.offset(ip)
+	if !ok {
+		return "", false
+	}
+
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	name, ok := f.ips[off]
+	return name, ok
+}
+
+// SetFakeIP makes the dns inbound answer A queries with addresses of
+// cidr, like 198.18.0.0/15, that Serve turns back into the names.
+// Names under the exclude domains get real answers, an empty cidr
+// disables it.
+func (c *Client) SetFakeIP(cidr, exclude string) error {
+	if cidr == "" {
+		c.fakeIP.Store((*fakeIP)(nil))
+		return nil
+	}
+
+	f, err := newFakeIP(cidr, exclude)
+	if err != nil {
+		return err
+	}
+
+	c.fakeIP.Store(f)
+	return nil
+}
+
+// RestoreFakeIP puts back an address saved from Watcher.OnFakeIP,
+// addresses outside the range are ignored.
+func (c *Client) RestoreFakeIP(ip net.IP, name string) {
+	if f := c.getFakeIP(); f != nil {
+		f.restore(ip, name)
+	}
+}
+
+func (c *Client) getFakeIP() *fakeIP {
+	f, _ := c.fakeIP.Load().(*fakeIP)
+	return f
+}
+
+// fakeIPAnswer answers A queries with a pool address and AAAA queries
+// with no records, ok is false for names that are not faked
+func (c *Client) fakeIPAnswer(name string, qtype uint16) (ips []net.IP, ok bool) {
+	f := c.getFakeIP()
+	if f == nil || (qtype != dnsTypeA && qtype != dnsTypeAAAA) {
+		return nil, false
+	}
+	if f.excluded(name) || c.lookupHosts(name) != nil {
+		return nil, false
+	}
+	if _, err := Parse2RawAddr(net.JoinHostPort(name, "0")); err != nil {
+		return nil, false
+	}
+
+	if qtype == dnsTypeAAAA {
+		return nil, true
+	}
+
+	ip, new := f.get(name)
+	if new {
+		c.Watcher.OnFakeIP(ip, name)
+	}
+	return []net.IP{ip}, true
+}
+
+// unfake turns a pool address back into its name
+func (c *Client) unfake(addr RawAddr) (RawAddr, bool) {
+	f := c.getFakeIP()
+	ip := addr.ToIP()
+	if f == nil || ip == nil {
+		return addr, true
+	}
+
+	if _, ok := f.offset(ip); !ok {
+		return addr, true
+	}
+
+	name, ok := f.name(ip)
+	if !ok {
+		return addr, false
+	}
+
+	raw, err := Parse2RawAddr(net.JoinHostPort(name, addr.PortString()))
+	if err != nil {
+		return addr, false
+	}
+	return raw, true
+}
@@ -0,0 +1,141 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewFakeIP(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/31", "10.0.0.0/32", "2001:db8::/64", "10.0.0.0", ""} {
+		if _, err := newFakeIP(cidr, ""); err == nil {
+			t.Errorf("%q accepted", cidr)
+		}
+	}
+
+	f, err := newFakeIP(" 198.18.0.0/15 ", "lan, .corp.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.size != 1<<17 || len(f.exclude) != 2 {
+		t.Errorf("got size %d exclude %v", f.size, f.exclude)
+	}
+	for name, want := range map[string]bool{"lan": true, "x.lan": true, "a.b.corp": true, "plan": false, "corp.com": false} {
+		if f.excluded(name) != want {
+			t.Errorf("%s excluded %v", name, !want)
+		}
+	}
+}
+
+func TestFakeIPPool(t *testing.T) {
+	//10.0.0.1 to 10.0.0.6, without the network and broadcast address
+	f, err := newFakeIP("10.0.0.0/29", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"a", "b", "c", "d", "e", "f"}
+	for i, name := range names {
+		ip, new := f.get(name)
+		if !new || !ip.Equal(net.IPv4(10, 0, 0, byte(i+1))) {
+			t.Errorf("%s got %s %v", name, ip, new)
+		}
+	}
+
+	if ip, new := f.get("c"); new || !ip.Equal(net.IPv4(10, 0, 0, 3)) {
+		t.Errorf("c again got %s %v", ip, new)
+	}
+
+	//the pool is used up, the oldest address goes to the new name
+	if ip, new := f.get("g"); !new || !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("g got %s %v", ip, new)
+	}
+	if name, _ := f.name(net.IPv4(10, 0, 0, 1)); name != "g" {
+		t.Errorf("10.0.0.1 is %q", name)
+	}
+	if ip, new := f.get("a"); !new || !ip.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("a again got %s %v", ip, new)
+	}
+	if _, ok := f.names["b"]; ok {
+		t.Error("b kept the address given to a")
+	}
+
+	for _, ip := range []string{"10.0.0.0", "10.0.0.7", "10.0.1.1", "9.255.255.255", "2001:db8::1"} {
+		if _, ok := f.offset(net.ParseIP(ip)); ok {
+			t.Errorf("%s in the pool", ip)
+		}
+	}
+}
+
+func TestFakeIPRestore(t *testing.T) {
+	f, _ := newFakeIP("10.0.0.0/29", "")
+
+	//in the order they were assigned, the later one wins
+	f.restore(net.IPv4(10, 0, 0, 5), "a")
+	f.restore(net.IPv4(10, 0, 0, 6), "b")
+	f.restore(net.IPv4(10, 0, 0, 5), "c")
+	f.restore(net.IPv4(10, 0, 0, 2), "b")
+	f.restore(net.IPv4(10, 0, 0, 9), "x")
+	f.restore(net.IPv4(10, 0, 0, 3), "")
+
+	tests := map[string]string{"10.0.0.5": "c", "10.0.0.2": "b", "10.0.0.6": "", "10.0.0.3": ""}
+	for ip, want := range tests {
+		if name, _ := f.name(net.ParseIP(ip)); name != want {
+			t.Errorf("%s is %q, want %q", ip, name, want)
+		}
+	}
+
+	//new names go after the last restored address
+	if ip, _ := f.get("d"); !ip.Equal(net.IPv4(10, 0, 0, 3)) {
+		t.Errorf("d got %s", ip)
+	}
+}
+
+func TestFakeIPClient(t *testing.T) {
+	c := NewClient("", 5, 5)
+	if err := c.SetFakeIP("10.0.0.0/29", "lan"); err != nil {
+		t.Fatal(err)
+	}
+
+	ips, ok := c.fakeIPAnswer("example.com", dnsTypeA)
+	if !ok || len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("got %v %v", ips, ok)
+	}
+	if ips, ok := c.fakeIPAnswer("example.com", dnsTypeAAAA); !ok || len(ips) != 0 {
+		t.Errorf("aaaa got %v %v", ips, ok)
+	}
+	if _, ok := c.fakeIPAnswer("nas.lan", dnsTypeA); ok {
+		t.Error("excluded name faked")
+	}
+
+	c.RestoreFakeIP(net.IPv4(10, 0, 0, 4), "restored.example")
+
+	tests := []struct {
+		addr, want string
+		ok         bool
+	}{
+		{"10.0.0.1:443", "example.com:443", true},
+		{"10.0.0.4:80", "restored.example:80", true},
+		{"10.0.0.5:80", "", false},
+		{"192.168.1.1:80", "192.168.1.1:80", true},
+		{"example.org:80", "example.org:80", true},
+	}
+	for _, tt := range tests {
+		raw, _ := Parse2RawAddr(tt.addr)
+		got, ok := c.unfake(raw)
+		if ok != tt.ok || (ok && got.String() != tt.want) {
+			t.Errorf("%s: got %s %v", tt.addr, got, ok)
+		}
+	}
+
+	if _, err := c.Explain("10.0.0.5:80", ""); err != ErrFakeIPUnknown {
+		t.Errorf("explain unknown fake ip: %v", err)
+	}
+	if e, err := c.Explain("10.0.0.1:443", ""); err != nil || e.To != "example.com:443" {
+		t.Errorf("explain fake ip: %+v %v", e, err)
+	}
+
+	c.SetFakeIP("", "")
+	if _, ok := c.fakeIPAnswer("example.com", dnsTypeA); ok {
+		t.Error("faked after disabling")
+	}
+}
@@ -0,0 +1,112 @@
+package shadowsocks
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+type geoIP struct {
+	file  string
+	mtime time.Time
+	db    atomic.Value
+	stop  chan struct{}
+}
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// NewGeoIP loads a MaxMind .mmdb file and reloads it whenever the
+// file is modified.
+func NewGeoIP(file string) (*geoIP, error) {
+	g := &geoIP{
+		file: file,
+		stop: make(chan struct{}),
+	}
+
+	if err := g.load(); err != nil {
+		return nil, err
+	}
+
+	go g.run()
+
+	return g, nil
+}
+
+func (g *geoIP) load() error {
+	fi, err := os.Stat(g.file)
+	if err != nil {
+		return err
+	}
+
+	//read into memory so a reload never unmaps a db still in use
+	b, err := ioutil.ReadFile(g.file)
+	if err != nil {
+		return err
+	}
+
+	db, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return err
+	}
+
+	g.mtime = fi.ModTime()
+	g.db.Store(db)
+
+	return nil
+}
+
+func (g *geoIP) run() {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-t.C:
+		}
+
+		fi, err := os.Stat(g.file)
+		if err != nil || fi.ModTime().Equal(g.mtime) {
+			continue
+		}
+
+		if err := g.load(); err != nil {
+			Debug.Println("GeoIP Reload", g.file, err)
+		} else {
+			Debug.Println("GeoIP Reload", g.file)
+		}
+	}
+}
+
+// Close stops the reloads and drops the database, lookups still running
+// keep the reader they loaded.
+func (g *geoIP) Close() {
+	close(g.stop)
+	g.db.Store((*maxminddb.Reader)(nil))
+}
+
+// Country returns the ISO country code of ip, or "" when unknown.
+func (g *geoIP) Country(ip net.IP) string {
+	db, _ := g.db.Load().(*maxminddb.Reader)
+	if db == nil {
+		return ""
+	}
+
+	var rec geoRecord
+	if err := db.Lookup(ip, &rec); err != nil {
+		Debug.Println("GeoIP Lookup", ip, err)
+		return ""
+	}
+
+	return strings.ToUpper(rec.Country.ISOCode)
+}
@@ -0,0 +1,121 @@
+package shadowsocks
+
+import (
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Hosts pins names to addresses before any dns is asked. Entries are in
+// hosts file format, "ip name...", a *.domain name covers the
+// subdomains of domain.
+type Hosts struct {
+	names map[string][]net.IPAddr
+	//longest suffix first
+	wild []hostsWild
+}
+
+type hostsWild struct {
+	suffix string
+	ipaddr []net.IPAddr
+}
+
+// ParseHosts reads hosts file texts, a name in an earlier text hides the
+// same name in the later ones. Lines that do not parse are skipped.
+func ParseHosts(texts ...string) *Hosts {
+	h := &Hosts{names: make(map[string][]net.IPAddr)}
+	wild := make(map[string][]net.IPAddr)
+
+	for _, text := range texts {
+		names := make(map[string][]net.IPAddr)
+
+		for _, line := range strings.Split(text, "\n") {
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+
+			ip := net.ParseIP(fields[0])
+			if ip == nil {
+				Debug.Println("Hosts Invalid", line)
+				continue
+			}
+
+			for _, name := range fields[1:] {
+				name = strings.ToLower(strings.TrimSuffix(name, "."))
+				names[name] = append(names[name], net.IPAddr{IP: ip})
+			}
+		}
+
+		for name, ipaddr := range names {
+			if strings.HasPrefix(name, "*.") {
+				name = name[2:]
+				if _, ok := wild[name]; !ok {
+					wild[name] = ipaddr
+				}
+			} else if _, ok := h.names[name]; !ok {
+				h.names[name] = ipaddr
+			}
+		}
+	}
+
+	for suffix, ipaddr := range wild {
+		h.wild = append(h.wild, hostsWild{suffix: suffix, ipaddr: ipaddr})
+	}
+	sort.Slice(h.wild, func(i, j int) bool {
+		return len(h.wild[i].suffix) > len(h.wild[j].suffix)
+	})
+
+	return h
+}
+
+// LoadHostsFile reads a hosts file, like /etc/hosts, for ParseHosts.
+func LoadHostsFile(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Lookup returns the addresses pinned for host, nil when there are none.
+func (h *Hosts) Lookup(host string) []net.IPAddr {
+	if h == nil {
+		return nil
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if ipaddr, ok := h.names[host]; ok {
+		return ipaddr
+	}
+	for _, w := range h.wild {
+		if strings.HasSuffix(host, "."+w.suffix) {
+			return w.ipaddr
+		}
+	}
+	return nil
+}
+
+// Len is the number of names and wildcards.
+func (h *Hosts) Len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.names) + len(h.wild)
+}
+
+// SetHosts replaces the hosts table, nil removes it.
+func (c *Client) SetHosts(h *Hosts) {
+	c.hosts.Store(h)
+}
+
+func (c *Client) lookupHosts(host string) []net.IPAddr {
+	h, _ := c.hosts.Load().(*Hosts)
+	return h.Lookup(host)
+}
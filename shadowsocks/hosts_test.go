@@ -0,0 +1,71 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseHosts(t *testing.T) {
+	h := ParseHosts(`# a comment
+127.0.0.1	localhost
+10.0.0.1 a.example b.example   # names after a comment are not read c.example
+10.0.0.2 a.example
+::1 localhost ip6-localhost
+fd00::5 v6.example
+10.0.0.3 *.wild.example
+10.0.0.4 *.deep.wild.example
+10.0.0.5 Mixed.Example.
+
+not-an-ip bad.example
+10.0.0.6
+fe80::1%eth0 zone.example
+   #10.0.0.7 commented.example
+`, `10.9.9.9 a.example
+10.9.9.9 *.wild.example
+10.0.0.8 other.example`)
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"localhost", "[127.0.0.1 ::1]"},
+		{"ip6-localhost", "[::1]"},
+		//every address of a name, in the order of the lines
+		{"a.example", "[10.0.0.1 10.0.0.2]"},
+		{"b.example", "[10.0.0.1]"},
+		{"c.example", "[]"},
+		{"v6.example", "[fd00::5]"},
+		{"x.wild.example", "[10.0.0.3]"},
+		{"wild.example", "[]"},
+		//the longest wildcard wins
+		{"x.deep.wild.example", "[10.0.0.4]"},
+		{"mixed.example", "[10.0.0.5]"},
+		{"MIXED.EXAMPLE.", "[10.0.0.5]"},
+		{"bad.example", "[]"},
+		{"zone.example", "[]"},
+		{"commented.example", "[]"},
+		//a later text only adds names
+		{"other.example", "[10.0.0.8]"},
+		{"none.example", "[]"},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, a := range h.Lookup(tt.host) {
+			got = append(got, a.IP.String())
+		}
+		if s := fmt.Sprint(got); s != tt.want {
+			t.Errorf("Lookup(%q) = %s, want %s", tt.host, s, tt.want)
+		}
+	}
+
+	//names and wildcards
+	if h.Len() != 9 {
+		t.Errorf("Len() = %d", h.Len())
+	}
+
+	var none *Hosts
+	if none.Lookup("localhost") != nil || none.Len() != 0 {
+		t.Errorf("nil hosts not empty")
+	}
+}
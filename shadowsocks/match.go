@@ -0,0 +1,251 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+type matchKey struct {
+	r    *Rules
+	addr string
+}
+
+type matchVal struct {
+	ok     bool
+	expire time.Time
+}
+
+// route is the result of matching a destination against the rules
+type route struct {
+	rules   *Rules
+	matcher string
+	shadows []*Shadow
+
+	//rules that matched outside of their schedule, only when explaining
+	skipped []*Rules
+}
+
+func (c *Client) match(m *Meta, addr RawAddr) *Shadow {
+	rt := c.route(m, addr)
+	if rt.rules != nil {
+		m.Matched = true
+		m.RuleID = rt.rules.ID
+	}
+
+	return c.pick(rt.shadows)
+}
+
+// route finds the first matching rule that has an available server
+func (c *Client) route(m *Meta, addr RawAddr) route {
+	var skipped []*Rules
+	now := time.Now()
+
+	for _, r := range c.getRules() {
+		//before matching, which may look up the dns or the country
+		if !r.Schedule.Active(now) {
+			if m.explain && c.matchRules(m, r, addr) != "" {
+				skipped = append(skipped, r)
+			}
+			continue
+		}
+
+		t := c.matchRules(m, r, addr)
+		if t == "" {
+			continue
+		}
+
+		if shadows := c.candidates(r.ServerID); len(shadows) > 0 {
+			return route{rules: r, matcher: t, shadows: shadows, skipped: skipped}
+		}
+	}
+
+	return route{skipped: skipped}
+}
+
+// matchRules returns the kind of item that matched, "" if none
+func (c *Client) matchRules(m *Meta, r *Rules, addr RawAddr) string {
+	uid := -1
+	if m.UIDKnown {
+		uid = m.UID
+	}
+	if !r.MatchClient(AddrIP(m.From), uid, m.Process) {
+		return ""
+	}
+	if r.OnlyClient() {
+		return "client"
+	}
+	if t := r.MatchType(addr.String()); t != "" {
+		return t
+	}
+	if t := c.matchGeoIP(m, r, addr); t != "" {
+		return t
+	}
+	if r.Expr != nil && r.Expr.match(c, m, addr, r.Location) {
+		return "expr"
+	}
+	if r.Resolve && addr.ToIP() == nil && c.matchResolved(m, r, addr) {
+		return "resolved"
+	}
+	return ""
+}
+
+// matchGeoIP matches the country of the destination against the GEOIP
+// items, the port qualified ones too, the country is looked up once
+func (c *Client) matchGeoIP(m *Meta, r *Rules, addr RawAddr) string {
+	if len(r.GeoIP) > 0 && r.MatchCountry(c.country(m, addr)) {
+		return "geoip"
+	}
+
+	port := addr.Port()
+	for _, p := range r.Ports {
+		if len(p.GeoIP) > 0 && port >= p.min && port <= p.max && p.MatchCountry(c.country(m, addr)) {
+			return "geoip:port"
+		}
+	}
+	return ""
+}
+
+// matchResolved matches the rules against the local resolved addresses
+// of a domain, the decision is cached like a dns answer.
+func (c *Client) matchResolved(m *Meta, r *Rules, addr RawAddr) bool {
+	key := matchKey{r: r, addr: addr.String()}
+
+	if t, ok := c.matchCache.Get(key); ok {
+		v := t.(matchVal)
+		if time.Now().Before(v.expire) {
+			return v.ok
+		}
+	}
+
+	ok := false
+	for _, ip := range c.resolve(m, addr) {
+		if r.Match(IP2RawAddr(ip, addr.Port()).String()) {
+			ok = true
+			break
+		}
+	}
+
+	//as long as the answer, failed lookups are tried again
+	if m.ttl > 0 {
+		c.matchCache.Add(key, matchVal{
+			ok:     ok,
+			expire: time.Now().Add(time.Duration(m.ttl) * time.Second),
+		})
+	}
+
+	Debug.Println("Match Resolved", ok, addr.String(), m.ips)
+
+	return ok
+}
+
+// servers of a rule, empty ids means all servers
+func (c *Client) candidates(ids []uint64) (shadows []*Shadow) {
+	all := c.getShadows()
+
+	if len(ids) < 1 {
+		shadows = all
+	} else {
+		for _, s := range all {
+			for _, id := range ids {
+				if s.ID == id {
+					shadows = append(shadows, s)
+					break
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// round robin between the candidate servers
+func (c *Client) pick(shadows []*Shadow) *Shadow {
+	if len(shadows) < 1 {
+		return nil
+	}
+
+	idx := int(atomic.AddUint32(&c.idx, 1) % uint32(len(shadows)))
+
+	return shadows[idx]
+}
+
+// country of the destination, domains are resolved with the local dns
+func (c *Client) country(m *Meta, addr RawAddr) string {
+	g := c.getGeoIP()
+	if m.geoDone || g == nil {
+		return m.Country
+	}
+	m.geoDone = true
+
+	if ip := addr.ToIP(); ip != nil {
+		m.Country = g.Country(ip)
+		return m.Country
+	}
+
+	for _, ip := range c.resolve(m, addr) {
+		if m.Country = g.Country(ip); m.Country != "" {
+			break
+		}
+	}
+
+	return m.Country
+}
+
+// resolve looks up a domain destination once per connection
+func (c *Client) resolve(m *Meta, addr RawAddr) []net.IP {
+	if m.resolved {
+		return m.ips
+	}
+	m.resolved = true
+
+	ipaddr, ttl, err := c.lookupLocal(addr.Host())
+	m.ttl = ttl
+	if err != nil {
+		Debug.Println("Match Lookup", addr.Host(), err)
+		return nil
+	}
+
+	for _, p := range ipaddr {
+		m.ips = append(m.ips, p.IP)
+	}
+
+	return m.ips
+}
+
+// seconds hosts entries and answers of the system resolver are valid
+const dnsDefaultTTL = 60
+
+// lookupLocal resolves host for direct connections, it also returns the
+// seconds the answer stays valid
+func (c *Client) lookupLocal(host string) ([]net.IPAddr, uint32, error) {
+	if ipaddr := c.lookupHosts(host); ipaddr != nil {
+		return ipaddr, dnsDefaultTTL, nil
+	}
+	if d := c.resolver(host, false); d != nil {
+		return d.lookupTTL(host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, dnsDefaultTTL, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	ipaddr, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+
+	c.Watcher.OnDNSLog(&DNSLog{
+		Name:     host,
+		Resolver: "system",
+		IPs:      ipaddr,
+		Latency:  time.Since(start),
+		Err:      err,
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+	return ipaddr, dnsDefaultTTL, nil
+}
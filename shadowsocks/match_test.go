@@ -0,0 +1,112 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMatchResolvedTTL(t *testing.T) {
+	c := NewClient("", 5, 5)
+	c.SetLocalDNS("127.0.0.1")
+	d := c.getLocalDNS()
+	d.Dial = func(ctx context.Context, n, addr string) (net.Conn, error) {
+		return nil, errors.New("offline")
+	}
+
+	now := time.Now()
+	d.lru.Add("short.example", &dnsVal{ipaddr: []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, expire: now.Add(5 * time.Second)})
+	d.lru.Add("long.example", &dnsVal{ipaddr: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, expire: now.Add(time.Hour)})
+	d.lru.Add("gone.example", &dnsVal{negative: true, expire: now.Add(20 * time.Second)})
+
+	r := NewRules(1, "10.0.0.0/8", "")
+	r.Resolve = true
+
+	tests := []struct {
+		host string
+		ok   bool
+		ttl  time.Duration
+	}{
+		{"short.example", true, 5 * time.Second},
+		{"long.example", false, time.Hour},
+		//not found is kept as long as the negative answer
+		{"gone.example", false, 20 * time.Second},
+	}
+
+	for _, tt := range tests {
+		addr, _ := Parse2RawAddr(tt.host + ":443")
+
+		if ok := c.matchResolved(&Meta{}, r, addr); ok != tt.ok {
+			t.Errorf("%s matched %v", tt.host, ok)
+		}
+
+		v, found := c.matchCache.Get(matchKey{r: r, addr: addr.String()})
+		if !found {
+			t.Errorf("%s not cached", tt.host)
+			continue
+		}
+		if left := time.Until(v.(matchVal).expire); left > tt.ttl || left < tt.ttl-2*time.Second {
+			t.Errorf("%s cached for %v, want the ttl %v", tt.host, left, tt.ttl)
+		}
+	}
+
+	//the decision goes with the answer
+	addr, _ := Parse2RawAddr("short.example:443")
+	key := matchKey{r: r, addr: addr.String()}
+	c.matchCache.Add(key, matchVal{ok: false, expire: time.Now().Add(-time.Second)})
+	if !c.matchResolved(&Meta{}, r, addr) {
+		t.Errorf("expired decision used")
+	}
+
+	//a failed lookup is not cached
+	d.lru.Remove("short.example")
+	c.matchCache.Purge()
+	if c.matchResolved(&Meta{}, r, addr) {
+		t.Errorf("failed lookup matched")
+	}
+	if _, found := c.matchCache.Get(key); found {
+		t.Errorf("failed lookup cached")
+	}
+}
+
+func TestRouteSchedule(t *testing.T) {
+	c := NewClient("", 5, 5)
+	c.shadows.Store([]*Shadow{{ID: 1}})
+
+	c.SetLocalDNS("127.0.0.1")
+	d := c.getLocalDNS()
+	d.lru.Add("a.example", &dnsVal{ipaddr: []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, expire: time.Now().Add(time.Hour)})
+
+	off, err := ParseSchedule(weekdays[(int(time.Now().UTC().Weekday())+3)%7], "", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRules(10, "10.0.0.0/8", "1")
+	r.Resolve = true
+	r.Schedule = off
+	c.ReplaceRules([]*Rules{r})
+
+	addr, _ := Parse2RawAddr("a.example:443")
+
+	//outside its schedule the rule looks nothing up
+	m := &Meta{}
+	if rt := c.route(m, addr); rt.rules != nil || len(rt.skipped) > 0 {
+		t.Errorf("route %+v", rt)
+	}
+	if m.resolved || c.matchCache.Len() > 0 {
+		t.Errorf("inactive rule resolved the destination")
+	}
+
+	//explain still tells it was skipped
+	m = &Meta{explain: true}
+	if rt := c.route(m, addr); rt.rules != nil || len(rt.skipped) != 1 || rt.skipped[0] != r {
+		t.Errorf("explain route %+v", rt)
+	}
+
+	r.Schedule = nil
+	if rt := c.route(&Meta{}, addr); rt.rules != r || rt.matcher != "resolved" {
+		t.Errorf("active route %+v", rt)
+	}
+}
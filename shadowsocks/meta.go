@@ -0,0 +1,42 @@
+package shadowsocks
+
+import (
+	"net"
+)
+
+// Meta describes a client connection while it is routed, it is
+// handed to the Watcher so the connection log can show why it was
+// proxied or not.
+type Meta struct {
+	From net.Addr
+	To   RawAddr
+
+	//a rule, the auto mode list or a global or direct mode decided the route
+	Matched bool
+	RuleID  uint64
+
+	//local program that opened the connection, linux only
+	Process string
+	PID     int
+	UID     int
+	//UID is valid, it may be known when the process is not
+	UIDKnown bool
+
+	//server name read from the TLS or HTTP request of an ip destination
+	Sniffed string
+
+	//country of the destination ip, set when a GEOIP rule was evaluated
+	Country string
+
+	geoDone bool
+
+	//local resolved addresses of a domain destination
+	ips      []net.IP
+	resolved bool
+	//seconds they stay valid, 0 when unknown
+	ttl uint32
+
+	//set by Explain, rules outside their schedule are matched as well
+	//to tell they were skipped
+	explain bool
+}
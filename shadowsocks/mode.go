@@ -0,0 +1,75 @@
+package shadowsocks
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrMode = errors.New("unknown mode, use rule, global or direct")
+
+// Mode decides how new connections are routed.
+type Mode int
+
+const (
+	//rules decide, the default
+	ModeRule Mode = iota
+	//everything goes through the mode servers
+	ModeGlobal
+	//everything goes direct
+	ModeDirect
+)
+
+var modeNames = []string{"rule", "global", "direct"}
+
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(modeNames) {
+		return ""
+	}
+	return modeNames[m]
+}
+
+func ParseMode(s string) (Mode, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return ModeRule, nil
+	}
+
+	for i, n := range modeNames {
+		if n == s {
+			return Mode(i), nil
+		}
+	}
+	return ModeRule, ErrMode
+}
+
+type modeState struct {
+	mode Mode
+	//servers of global mode, empty means all
+	servers []uint64
+}
+
+// SetMode switches the routing of new connections, connections already
+// established keep the route they got. serverIds are the comma separated
+// servers global mode balances between, empty means all servers.
+func (c *Client) SetMode(mode Mode, serverIds string) {
+	c.mode.Store(&modeState{
+		mode:    mode,
+		servers: parseIds(serverIds),
+	})
+
+	Debug.Println("Mode", mode, serverIds)
+}
+
+// Mode returns the current mode and the servers of global mode.
+func (c *Client) Mode() (Mode, []uint64) {
+	t := c.getMode()
+	return t.mode, t.servers
+}
+
+func (c *Client) getMode() *modeState {
+	t, _ := c.mode.Load().(*modeState)
+	if t == nil {
+		return &modeState{}
+	}
+	return t
+}
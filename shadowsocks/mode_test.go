@@ -0,0 +1,141 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Mode
+		err  error
+	}{
+		{"", ModeRule, nil},
+		{"rule", ModeRule, nil},
+		{" Global ", ModeGlobal, nil},
+		{"DIRECT", ModeDirect, nil},
+		{"proxy", ModeRule, ErrMode},
+	}
+
+	for _, tt := range tests {
+		m, err := ParseMode(tt.s)
+		if m != tt.want || err != tt.err {
+			t.Errorf("ParseMode(%q) = %v %v", tt.s, m, err)
+		}
+		if err == nil && tt.s != "" {
+			if m2, _ := ParseMode(m.String()); m2 != m {
+				t.Errorf("%v does not parse back", m)
+			}
+		}
+	}
+
+	if Mode(9).String() != "" {
+		t.Errorf("unknown mode named")
+	}
+}
+
+// modeClient has servers 1 and 2, the ids of the servers dialed are
+// returned by dialed
+func modeClient() (c *Client, dialed func() []uint64) {
+	c = NewClient("", 5, 5)
+
+	var l sync.Mutex
+	var ids []uint64
+	server := func(id uint64) *Shadow {
+		return &Shadow{ID: id, Dial: func(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+			l.Lock()
+			defer l.Unlock()
+			ids = append(ids, id)
+
+			a, _ := net.Pipe()
+			return a, nil
+		}}
+	}
+	c.shadows.Store([]*Shadow{server(1), server(2)})
+
+	c.ReplaceRules([]*Rules{NewRules(1, "example.com", "1")})
+
+	return c, func() []uint64 {
+		l.Lock()
+		defer l.Unlock()
+		t := ids
+		ids = nil
+		return t
+	}
+}
+
+func TestDialMode(t *testing.T) {
+	c, dialed := modeClient()
+
+	//the direct destination
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	dial := func(to string) (*Meta, error) {
+		addr, err := Parse2RawAddr(to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &Meta{To: addr}
+		conn, _, err := c.dial(context.Background(), m, addr)
+		if conn != nil {
+			conn.Close()
+		}
+		return m, err
+	}
+
+	tests := []struct {
+		mode    Mode
+		servers string
+		to      string
+		want    []uint64
+		matched bool
+	}{
+		{ModeRule, "", "www.example.com:443", []uint64{1}, true},
+		{ModeRule, "", "127.0.0.1:" + port, nil, false},
+		{ModeGlobal, "2", "127.0.0.1:" + port, []uint64{2}, true},
+		{ModeGlobal, "2", "www.example.com:443", []uint64{2}, true},
+		{ModeDirect, "", "127.0.0.1:" + port, nil, true},
+	}
+
+	for _, tt := range tests {
+		c.SetMode(tt.mode, tt.servers)
+
+		m, err := dial(tt.to)
+		if err != nil {
+			t.Errorf("%v %s: %v", tt.mode, tt.to, err)
+			continue
+		}
+		if got := dialed(); len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+			t.Errorf("%v %s dialed %v, want %v", tt.mode, tt.to, got, tt.want)
+		}
+		if m.Matched != tt.matched {
+			t.Errorf("%v %s matched %v", tt.mode, tt.to, m.Matched)
+		}
+	}
+
+	//global mode over all servers
+	c.SetMode(ModeGlobal, "")
+	if _, err := dial("127.0.0.1:" + port); err != nil || len(dialed()) != 1 {
+		t.Errorf("global over all servers: %v", err)
+	}
+
+	//global mode with no usable server fails, not direct
+	c.SetMode(ModeGlobal, "9")
+	if _, err := dial("127.0.0.1:" + port); err != ErrAllServerUnavailable {
+		t.Errorf("global without servers: %v", err)
+	}
+
+	mode, ids := c.Mode()
+	if mode != ModeGlobal || len(ids) != 1 || ids[0] != 9 {
+		t.Errorf("Mode() = %v %v", mode, ids)
+	}
+}
@@ -5,25 +5,133 @@ import (
 	"regexp"
 	"regexp/syntax"
 	pac "sshProxy/shadowsocks/pac"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// Rules is one rule entry. Each item of the rule text is one of:
+//
+//	example.com          example.com and its subdomains
+//	full:example.com     example.com only
+//	keyword:example      hosts containing example
+//	*.example.com        wildcard, * matches any characters
+//	%regexp%             regular expression
+//	10.0.0.0/8           ip network
+//	10.0.0.5-10.0.0.99   ip range
+//	GEOIP,CN             country of the destination ip
+//
+// followed by an optional :port or :port-port qualifier, e.g.
+// 10.8.0.0/16:22, [fd00::]/8:3000-3100 or GEOIP,CN:443.
+//
+// src:10.0.0.0/8 limits the rule to clients from that range, and on
+// linux process:kubectl and uid:1000 limit it to local programs. A rule
+// with only such items matches every destination of those clients.
 type Rules struct {
-	Host     pac.Domain
-	IP       pac.IPNets
-	Regs     []regexp.Regexp
-	ServerID []uint64
+	ID        uint64
+	Host      pac.Domain
+	Full      map[string]struct{}
+	Keywords  []string
+	Globs     []regexp.Regexp
+	IP        pac.IPNets
+	Regs      []regexp.Regexp
+	GeoIP     []string
+	Sources   pac.IPNets
+	Processes []string
+	UIDs      []int
+	Ports     []*portRules
+	ServerID  []uint64
+
+	//match ip rules against the local resolved addresses of domains
+	Resolve bool
+
+	//the rules are skipped outside of it, nil is always
+	Schedule *Schedule
+
+	//matches too when true, see CompileExpr
+	Expr *Expr
+	//zone of the expr time and day, nil is the local time
+	Location *time.Location
+}
+
+// rules that only apply to a destination port range
+type portRules struct {
+	min, max uint16
+	Rules
+}
+
+func NewRules(id uint64, items, serverIds string) *Rules {
+	r := &Rules{
+		ID:       id,
+		ServerID: parseIds(serverIds),
+	}
+	r.Init()
+
+	ts := StrSplit(items)
+	for i := 0; i < len(ts); i++ {
+		//GEOIP,CN is split by StrSplit
+		if strings.EqualFold(ts[i], "GEOIP") && i+1 < len(ts) {
+			r.Add("geoip:" + ts[i+1])
+			i++
+			continue
+		}
+		r.Add(ts[i])
+	}
+
+	return r
 }
 
 func (r *Rules) Init() {
 	r.Host = make(pac.Domain)
+	r.Full = make(map[string]struct{})
 	r.IP = pac.NewIPNets()
 }
 
 func (r *Rules) Add(rule string) {
-	_, ipnet, err := net.ParseCIDR(rule)
-	if err == nil {
-		r.IP.Add(*ipnet)
+	if len(rule) > 4 && strings.EqualFold(rule[:4], "src:") {
+		if r.Sources == nil {
+			r.Sources = pac.NewIPNets()
+		}
+		if ipnet, ok := parseIPNet(rule[4:]); ok {
+			r.Sources.Add(ipnet)
+		} else {
+			Debug.Println("Rule Source", rule)
+		}
+		return
+	}
+
+	if len(rule) > 8 && strings.EqualFold(rule[:8], "process:") {
+		r.Processes = append(r.Processes, rule[8:])
+		return
+	}
+
+	if len(rule) > 4 && strings.EqualFold(rule[:4], "uid:") {
+		if uid, err := strconv.Atoi(rule[4:]); err == nil {
+			r.UIDs = append(r.UIDs, uid)
+		} else {
+			Debug.Println("Rule UID", rule)
+		}
+		return
+	}
+
+	if t, min, max, ok := splitRulePort(rule); ok {
+		r.portRules(min, max).Add(t)
+		return
+	}
+
+	if ipnet, ok := parseIPNet(rule); ok {
+		r.IP.Add(ipnet)
+	} else if start, end, ok := parseIPRange(rule); ok {
+		r.IP.AddRange(start, end, nil)
+	} else if len(rule) > 5 && strings.EqualFold(rule[:5], "full:") {
+		r.Full[strings.ToLower(strings.Trim(rule[5:], "."))] = struct{}{}
+	} else if len(rule) > 8 && strings.EqualFold(rule[:8], "keyword:") {
+		r.Keywords = append(r.Keywords, strings.ToLower(rule[8:]))
+	} else if rule[0] != '%' && strings.Contains(rule, "*") {
+		reg := "^" + strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(rule)), `\*`, ".*") + "$"
+		r.Globs = append(r.Globs, *regexp.MustCompile(reg))
+	} else if len(rule) > 6 && strings.EqualFold(rule[:6], "geoip:") {
+		r.GeoIP = append(r.GeoIP, strings.ToUpper(rule[6:]))
 	} else if len(rule) > 2 && rule[0] == '%' {
 		reg, err := syntax.Parse(rule[1:len(rule)-1], syntax.Perl)
 		if err != nil {
@@ -32,27 +140,247 @@ func (r *Rules) Add(rule string) {
 			r.Regs = append(r.Regs, *regexp.MustCompile(reg.String()))
 		}
 	} else {
-		r.Host.Add(rule)
+		r.Host.Add(strings.ToLower(rule))
+	}
+}
+
+// MatchClient reports whether the rule applies to a client, process is
+// empty and uid negative when they are unknown.
+func (r *Rules) MatchClient(ip net.IP, uid int, process string) bool {
+	if r.Sources != nil && (ip == nil || !r.Sources.Match(ip)) {
+		return false
+	}
+
+	if len(r.Processes) > 0 {
+		ok := false
+		for _, p := range r.Processes {
+			if process != "" && p == process {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(r.UIDs) > 0 {
+		ok := false
+		for _, u := range r.UIDs {
+			if uid >= 0 && u == uid {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
 	}
+
+	return true
 }
 
+// needProcess reports whether matching needs the local process of the
+// client
+func (r *Rules) needProcess() bool {
+	return len(r.Processes) > 0 || len(r.UIDs) > 0 || (r.Expr != nil && r.Expr.process)
+}
+
+// OnlyClient reports whether the rule has client items but no
+// destination items.
+func (r *Rules) OnlyClient() bool {
+	if r.Sources == nil && len(r.Processes) < 1 && len(r.UIDs) < 1 {
+		return false
+	}
+	if len(r.Host) > 0 || len(r.Full) > 0 || len(r.Ports) > 0 {
+		return false
+	}
+	if len(r.Keywords) > 0 || len(r.Globs) > 0 || len(r.Regs) > 0 || len(r.GeoIP) > 0 || r.Expr != nil {
+		return false
+	}
+
+	empty := true
+	r.IP.Each(func(net.IPNet) {
+		empty = false
+	})
+	return empty
+}
+
+func (r *Rules) portRules(min, max uint16) *Rules {
+	for _, p := range r.Ports {
+		if p.min == min && p.max == max {
+			return &p.Rules
+		}
+	}
+
+	p := &portRules{min: min, max: max}
+	p.Init()
+	r.Ports = append(r.Ports, p)
+
+	return &p.Rules
+}
+
+// Match reports whether host, with an optional port, matches the rules.
 func (r *Rules) Match(host string) bool {
-	tmp := strings.Split(host, ":")
-	host = tmp[0]
+	return r.MatchType(host) != ""
+}
+
+// MatchType is like Match but returns the kind of item that matched:
+// ip, full, domain, keyword, wildcard or regexp, with a :port suffix
+// for port qualified items. It returns "" when nothing matched.
+func (r *Rules) MatchType(host string) string {
+	var port uint16
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host = h
+		t, _ := strconv.ParseUint(p, 10, 16)
+		port = uint16(t)
+	}
+
+	if t := r.matchHost(host); t != "" {
+		return t
+	}
+
+	for _, p := range r.Ports {
+		if port >= p.min && port <= p.max {
+			if t := p.matchHost(host); t != "" {
+				return t + ":port"
+			}
+		}
+	}
+
+	return ""
+}
+
+func (r *Rules) matchHost(raw string) string {
+	raw = strings.Trim(raw, "[]")
+	host := strings.ToLower(raw)
 
 	ip := net.ParseIP(host)
 
 	if ip != nil {
-		return r.IP.Match(ip)
+		if r.IP.Match(ip) {
+			return "ip"
+		}
+		return ""
+	}
+	if _, ok := r.Full[strings.TrimSuffix(host, ".")]; ok {
+		return "full"
 	}
 	if r.Host.Match(host) {
-		return true
+		return "domain"
 	}
-	for _, reg := range r.Regs {
+	for _, k := range r.Keywords {
+		if strings.Contains(host, k) {
+			return "keyword"
+		}
+	}
+	for _, reg := range r.Globs {
 		if reg.MatchString(host) {
-			return true
+			return "wildcard"
+		}
+	}
+	for _, reg := range r.Regs {
+		if reg.MatchString(raw) {
+			return "regexp"
+		}
+	}
+
+	return ""
+}
+
+// splitRulePort splits the :port or :port-port qualifier off a rule.
+func splitRulePort(rule string) (string, uint16, uint16, bool) {
+	i := strings.LastIndexByte(rule, ':')
+	if i < 1 {
+		return "", 0, 0, false
+	}
+
+	host, port := rule[:i], rule[i+1:]
+
+	min, max, ok := parsePortRange(port)
+	if !ok {
+		return "", 0, 0, false
+	}
+
+	//full:, keyword: and geoip: items are not ipv6
+	value := host
+	for _, prefix := range []string{"full:", "keyword:", "geoip:"} {
+		if len(host) > len(prefix) && strings.EqualFold(host[:len(prefix)], prefix) {
+			value = host[len(prefix):]
+			break
 		}
 	}
 
+	switch {
+	case host[0] == '[':
+		//[fd00::1]:22 or [fd00::]/8:22
+		host = strings.Replace(host[1:], "]", "", 1)
+	case host[0] == '%':
+		//%regexp%:22
+		if len(host) < 3 || host[len(host)-1] != '%' {
+			return "", 0, 0, false
+		}
+	case strings.Contains(value, ":"):
+		//ipv6 cidr, fd00::/8:22
+		if _, _, err := net.ParseCIDR(value); err != nil {
+			return "", 0, 0, false
+		}
+	}
+
+	return host, min, max, true
+}
+
+// parseIPNet parses a cidr or a single ip
+func parseIPNet(s string) (net.IPNet, bool) {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return *ipnet, true
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		if t := ip.To4(); t != nil {
+			ip = t
+		}
+		return net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, true
+	}
+	return net.IPNet{}, false
+}
+
+func parseIPRange(s string) (net.IP, net.IP, bool) {
+	i := strings.IndexByte(s, '-')
+	if i < 1 {
+		return nil, nil, false
+	}
+
+	start := net.ParseIP(s[:i])
+	end := net.ParseIP(s[i+1:])
+	if start == nil || end == nil {
+		return nil, nil, false
+	}
+	return start, end, true
+}
+
+func parsePortRange(s string) (uint16, uint16, bool) {
+	a, b := s, s
+	if i := strings.IndexByte(s, '-'); i > 0 {
+		a, b = s[:i], s[i+1:]
+	}
+
+	min, err := strconv.ParseUint(a, 10, 16)
+	if err != nil {
+		return 0, 0, false
+	}
+	max, err := strconv.ParseUint(b, 10, 16)
+	if err != nil || max < min {
+		return 0, 0, false
+	}
+
+	return uint16(min), uint16(max), true
+}
+
+func (r *Rules) MatchCountry(country string) bool {
+	for _, c := range r.GeoIP {
+		if c == country {
+			return true
+		}
+	}
 	return false
 }
@@ -1,144 +1,326 @@
 package pac
 
 import (
+	"errors"
+	"math/big"
 	"net"
-	"sort"
 )
 
+var ErrRange = errors.New("invalid ip range")
+
+// IPNets is a set of ip ranges with longest prefix match lookups, each
+// entry may carry a payload such as the rule it belongs to.
 type IPNets interface {
 	Match(net.IP) bool
 	Add(net.IPNet)
 	Each(func(net.IPNet))
+
+	// Insert adds n with a payload, replacing the payload of an existing entry.
+	Insert(n net.IPNet, val interface{})
+	// Lookup returns the longest prefix containing ip and its payload.
+	Lookup(ip net.IP) (net.IPNet, interface{}, bool)
+	// Remove deletes exactly n, reporting whether it was present.
+	Remove(n net.IPNet) bool
+	// AddRange adds start-end inclusive as the smallest set of prefixes.
+	AddRange(start, end net.IP, val interface{}) error
 }
 
 func NewIPNets() IPNets {
-	return new(ipNets)
+	return &ipNets{
+		v4: &node{},
+		v6: &node{},
+	}
 }
 
-type ipv4 [net.IPv4len]byte
-type ipv6 [net.IPv6len]byte
-type ipv6s map[ipv6]struct{}
-type ipv4s map[ipv4]struct{}
-
-type ipv4Nets struct {
-	ips  ipv4s
-	mask net.IPMask
+// node of a path compressed binary trie, key holds the first bits bits
+// of the prefix and is zero after them.
+type node struct {
+	key   [net.IPv6len]byte
+	bits  int
+	child [2]*node
+	set   bool
+	val   interface{}
 }
 
-type ipv6Nets struct {
-	ips  ipv6s
-	mask net.IPMask
+type ipNets struct {
+	v4 *node
+	v6 *node
 }
 
-type ipNets struct {
-	v4 []ipv4Nets
-	v6 []ipv6Nets
+// key of an ip and the root of its family
+func (s *ipNets) key(ip net.IP) (k [net.IPv6len]byte, size int, root *node) {
+	if t := ip.To4(); t != nil {
+		copy(k[:], t)
+		return k, 8 * net.IPv4len, s.v4
+	}
+	if t := ip.To16(); t != nil {
+		copy(k[:], t)
+		return k, 8 * net.IPv6len, s.v6
+	}
+	return k, 0, nil
 }
 
-func (s ipv6s) add(ip net.IP) {
-	var t ipv6
-	copy(t[:], ip)
-	s[t] = struct{}{}
+func (s *ipNets) prefix(n net.IPNet) (k [net.IPv6len]byte, bits int, root *node) {
+	ones, total := n.Mask.Size()
+
+	k, size, root := s.key(n.IP)
+	if root == nil || (total != 8*net.IPv4len && total != 8*net.IPv6len) {
+		return k, 0, nil
+	}
+
+	//ipv4 network written with an ipv6 mask, ::ffff:1.2.3.0/120
+	if size == 8*net.IPv4len && total == 8*net.IPv6len {
+		if ones < 96 {
+			return k, 0, nil
+		}
+		ones -= 96
+	}
+	//ipv6 network with an ipv4 mask makes no sense
+	if size == 8*net.IPv6len && total == 8*net.IPv4len {
+		return k, 0, nil
+	}
+
+	return maskKey(k, ones), ones, root
 }
 
-func (s ipv6s) match(ip net.IP) bool {
-	var t ipv6
-	copy(t[:], ip)
-	_, ok := s[t]
-	return ok
+func bit(k *[net.IPv6len]byte, i int) int {
+	return int(k[i/8]>>(7-uint(i%8))) & 1
 }
 
-func (s ipv4s) add(ip net.IP) {
-	var t ipv4
-	copy(t[:], ip)
-	s[t] = struct{}{}
+func maskKey(k [net.IPv6len]byte, bits int) [net.IPv6len]byte {
+	for i := 0; i < net.IPv6len; i++ {
+		switch {
+		case bits >= 8*(i+1):
+		case bits <= 8*i:
+			k[i] = 0
+		default:
+			k[i] &= ^byte(0xff >> uint(bits-8*i))
+		}
+	}
+	return k
 }
 
-func (s ipv4s) match(ip net.IP) bool {
-	var t ipv4
-	copy(t[:], ip)
-	_, ok := s[t]
-	return ok
+// commonBits is the length of the common prefix of a and b, at most max
+func commonBits(a, b *[net.IPv6len]byte, max int) int {
+	n := 0
+	for i := 0; i < net.IPv6len && n < max; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			x <<= 1
+			n++
+		}
+		break
+	}
+	if n > max {
+		n = max
+	}
+	return n
 }
 
 func (s *ipNets) Add(n net.IPNet) {
-	o1, _ := n.Mask.Size()
-
-	if ip := n.IP.To4(); ip != nil && len(n.Mask) == net.IPv4len {
-		for _, m := range s.v4 {
-			o2, _ := m.mask.Size()
-			if o1 == o2 {
-				m.ips.add(ip)
-				return
-			}
+	s.Insert(n, nil)
+}
+
+func (s *ipNets) Insert(n net.IPNet, val interface{}) {
+	k, bits, root := s.prefix(n)
+	if root == nil {
+		return
+	}
+
+	cur := root
+	for {
+		if cur.bits == bits {
+			cur.set = true
+			cur.val = val
+			return
 		}
 
-		t := ipv4Nets{
-			ips:  make(ipv4s),
-			mask: n.Mask,
+		b := bit(&k, cur.bits)
+		child := cur.child[b]
+		if child == nil {
+			cur.child[b] = &node{key: k, bits: bits, set: true, val: val}
+			return
 		}
-		t.ips.add(ip)
 
-		s.v4 = append(s.v4, t)
-		sort.Sort(ipv4NetsSort(s.v4))
-	}
+		max := child.bits
+		if bits < max {
+			max = bits
+		}
+		cp := commonBits(&child.key, &k, max)
 
-	if ip := n.IP.To16(); ip != nil && len(n.Mask) == net.IPv6len {
-		for _, m := range s.v6 {
-			o2, _ := m.mask.Size()
-			if o1 == o2 {
-				m.ips.add(ip)
-				return
-			}
+		if cp == child.bits {
+			cur = child
+			continue
 		}
 
-		t := ipv6Nets{
-			ips:  make(ipv6s),
-			mask: n.Mask,
+		if cp == bits {
+			//the new prefix contains child
+			t := &node{key: k, bits: bits, set: true, val: val}
+			t.child[bit(&child.key, bits)] = child
+			cur.child[b] = t
+			return
 		}
-		t.ips.add(ip)
 
-		s.v6 = append(s.v6, t)
-		sort.Sort(ipv6NetsSort(s.v6))
+		mid := &node{key: maskKey(k, cp), bits: cp}
+		mid.child[bit(&child.key, cp)] = child
+		mid.child[bit(&k, cp)] = &node{key: k, bits: bits, set: true, val: val}
+		cur.child[b] = mid
+		return
 	}
 }
 
 func (s *ipNets) Match(ip net.IP) bool {
-	if t := ip.To4(); t != nil {
-		for _, n := range s.v4 {
-			t = t.Mask(n.mask)
-			if ok := n.ips.match(t); ok {
-				return true
-			}
+	return s.lookup(ip) != nil
+}
+
+func (s *ipNets) Lookup(ip net.IP) (net.IPNet, interface{}, bool) {
+	n := s.lookup(ip)
+	if n == nil {
+		return net.IPNet{}, nil, false
+	}
+	return s.ipNet(n, len(ip.To4()) == net.IPv4len), n.val, true
+}
+
+func (s *ipNets) lookup(ip net.IP) *node {
+	k, size, cur := s.key(ip)
+
+	var best *node
+	for cur != nil {
+		if cur.bits > size || commonBits(&cur.key, &k, cur.bits) < cur.bits {
+			break
 		}
-	} else if t := ip.To16(); t != nil {
-		for _, n := range s.v6 {
-			t = t.Mask(n.mask)
-			if ok := n.ips.match(t); ok {
-				return true
-			}
+		if cur.set {
+			best = cur
+		}
+		if cur.bits == size {
+			break
 		}
+		cur = cur.child[bit(&k, cur.bits)]
 	}
-	return false
+
+	return best
 }
 
-func (s *ipNets) Each(fn func(net.IPNet)) {
-	for _, n := range s.v4 {
-		for ip, _ := range n.ips {
-			t := net.IPNet{
-				IP:   net.IP(ip[:]),
-				Mask: n.mask,
-			}
-			fn(t)
+func (s *ipNets) Remove(n net.IPNet) bool {
+	k, bits, root := s.prefix(n)
+	if root == nil {
+		return false
+	}
+
+	path := []*node{}
+	cur := root
+	for cur != nil && cur.bits < bits {
+		if commonBits(&cur.key, &k, cur.bits) < cur.bits {
+			return false
+		}
+		path = append(path, cur)
+		cur = cur.child[bit(&k, cur.bits)]
+	}
+	if cur == nil || cur.bits != bits || cur.key != k || !cur.set {
+		return false
+	}
+
+	cur.set = false
+	cur.val = nil
+
+	//drop or splice out nodes left without an entry, never the root
+	for i := len(path) - 1; i >= 0; i-- {
+		parent := path[i]
+		if !compact(parent, cur) || i == 0 {
+			break
 		}
+		cur = parent
+	}
+
+	return true
+}
+
+// compact drops n when it holds no entry and has less than two
+// children, reporting whether it did
+func compact(parent, n *node) bool {
+	if n.set || (n.child[0] != nil && n.child[1] != nil) {
+		return false
+	}
+
+	b := bit(&n.key, parent.bits)
+
+	if n.child[0] != nil {
+		parent.child[b] = n.child[0]
+	} else {
+		parent.child[b] = n.child[1]
+	}
+	return true
+}
+
+func (s *ipNets) AddRange(start, end net.IP, val interface{}) error {
+	a, sa, _ := s.key(start)
+	b, sb, _ := s.key(end)
+	if sa == 0 || sa != sb {
+		return ErrRange
 	}
-	for _, n := range s.v6 {
-		for ip, _ := range n.ips {
-			t := net.IPNet{
-				IP:   net.IP(ip[:]),
-				Mask: n.mask,
+
+	lo := new(big.Int).SetBytes(a[:sa/8])
+	hi := new(big.Int).SetBytes(b[:sb/8])
+	if lo.Cmp(hi) > 0 {
+		return ErrRange
+	}
+
+	one := big.NewInt(1)
+	for lo.Cmp(hi) <= 0 {
+		//largest block aligned at lo that does not pass hi
+		size := int(lo.TrailingZeroBits())
+		if lo.Sign() == 0 {
+			size = sa
+		}
+		for size > 0 {
+			last := new(big.Int).Lsh(one, uint(size))
+			last.Add(last, lo).Sub(last, one)
+			if last.Cmp(hi) <= 0 {
+				break
 			}
-			fn(t)
+			size--
+		}
+
+		ip := make(net.IP, sa/8)
+		lo.FillBytes(ip)
+
+		s.Insert(net.IPNet{IP: ip, Mask: net.CIDRMask(sa-size, sa)}, val)
+
+		lo.Add(lo, new(big.Int).Lsh(one, uint(size)))
+	}
+
+	return nil
+}
+
+func (s *ipNets) ipNet(n *node, v4 bool) net.IPNet {
+	if v4 {
+		return net.IPNet{
+			IP:   net.IP(append([]byte(nil), n.key[:net.IPv4len]...)),
+			Mask: net.CIDRMask(n.bits, 8*net.IPv4len),
 		}
 	}
+	return net.IPNet{
+		IP:   net.IP(append([]byte(nil), n.key[:]...)),
+		Mask: net.CIDRMask(n.bits, 8*net.IPv6len),
+	}
+}
+
+func (s *ipNets) Each(fn func(net.IPNet)) {
+	s.each(s.v4, true, fn)
+	s.each(s.v6, false, fn)
+}
+
+func (s *ipNets) each(n *node, v4 bool, fn func(net.IPNet)) {
+	if n == nil {
+		return
+	}
+	if n.set {
+		fn(s.ipNet(n, v4))
+	}
+	s.each(n.child[0], v4, fn)
+	s.each(n.child[1], v4, fn)
 }
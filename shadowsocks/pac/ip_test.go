@@ -0,0 +1,297 @@
+package pac
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func randNets(n, size int) []net.IPNet {
+	r := rand.New(rand.NewSource(1))
+
+	nets := make([]net.IPNet, n)
+	for i := range nets {
+		ip := make(net.IP, size)
+		r.Read(ip)
+
+		ones := 8 + r.Intn(8*size-8)
+		mask := net.CIDRMask(ones, 8*size)
+		nets[i] = net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	return nets
+}
+
+func randIPs(n, size int) []net.IP {
+	r := rand.New(rand.NewSource(2))
+
+	ips := make([]net.IP, n)
+	for i := range ips {
+		ips[i] = make(net.IP, size)
+		r.Read(ips[i])
+	}
+	return ips
+}
+
+func benchmarkAdd(b *testing.B, size int) {
+	nets := randNets(10000, size)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := NewIPNets()
+		for _, n := range nets {
+			s.Add(n)
+		}
+	}
+}
+
+func benchmarkMatch(b *testing.B, size int) {
+	s := NewIPNets()
+	for _, n := range randNets(10000, size) {
+		s.Add(n)
+	}
+	ips := randIPs(1024, size)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Match(ips[i%len(ips)])
+	}
+}
+
+func BenchmarkAdd10kIPv4(b *testing.B)   { benchmarkAdd(b, net.IPv4len) }
+func BenchmarkAdd10kIPv6(b *testing.B)   { benchmarkAdd(b, net.IPv6len) }
+func BenchmarkMatch10kIPv4(b *testing.B) { benchmarkMatch(b, net.IPv4len) }
+func BenchmarkMatch10kIPv6(b *testing.B) { benchmarkMatch(b, net.IPv6len) }
+
+func cidr(t *testing.T, s string) net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+func TestIPNetsLookup(t *testing.T) {
+	s := NewIPNets()
+	for _, c := range []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32", "10.128.0.0/9", "2001:db8::/32", "2001:db8:1::/48"} {
+		s.Insert(cidr(t, c), c)
+	}
+
+	tests := []struct {
+		ip, want string
+	}{
+		{"10.1.2.3", "10.1.2.3/32"},
+		{"10.1.2.4", "10.1.2.0/24"},
+		{"10.1.3.1", "10.1.0.0/16"},
+		{"10.2.0.1", "10.0.0.0/8"},
+		{"10.200.0.1", "10.128.0.0/9"},
+		{"11.0.0.1", "0.0.0.0/0"},
+		{"2001:db8:1::5", "2001:db8:1::/48"},
+		{"2001:db8:2::5", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+	}
+
+	for _, tt := range tests {
+		n, val, ok := s.Lookup(net.ParseIP(tt.ip))
+		if tt.want == "" {
+			if ok || s.Match(net.ParseIP(tt.ip)) {
+				t.Errorf("%s matched %s", tt.ip, n.String())
+			}
+			continue
+		}
+		if !ok || n.String() != tt.want || val != tt.want {
+			t.Errorf("%s: got %s %v, want %s", tt.ip, n.String(), val, tt.want)
+		}
+	}
+
+	//replacing keeps one entry with the new payload
+	s.Insert(cidr(t, "10.1.0.0/16"), "new")
+	if _, val, _ := s.Lookup(net.ParseIP("10.1.3.1")); val != "new" {
+		t.Errorf("payload not replaced, got %v", val)
+	}
+}
+
+// checkCompact fails when a node other than the root holds no entry and
+// has less than two children
+func checkCompact(t *testing.T, n *node, root bool) {
+	if n == nil {
+		return
+	}
+	if !root && !n.set && (n.child[0] == nil || n.child[1] == nil) {
+		t.Errorf("node /%d left without an entry", n.bits)
+	}
+	checkCompact(t, n.child[0], false)
+	checkCompact(t, n.child[1], false)
+}
+
+func TestIPNetsRemove(t *testing.T) {
+	s := NewIPNets()
+	all := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24", "192.168.0.0/16", "192.168.1.0/24"}
+	for _, c := range all {
+		s.Add(cidr(t, c))
+	}
+
+	if s.Remove(cidr(t, "10.1.4.0/24")) || s.Remove(cidr(t, "10.0.0.0/9")) || s.Remove(cidr(t, "172.16.0.0/12")) {
+		t.Error("removed a missing entry")
+	}
+
+	if !s.Remove(cidr(t, "10.1.0.0/16")) {
+		t.Fatal("10.1.0.0/16 not removed")
+	}
+	if s.Remove(cidr(t, "10.1.0.0/16")) {
+		t.Error("10.1.0.0/16 removed twice")
+	}
+	if n, _, _ := s.Lookup(net.ParseIP("10.1.9.9")); n.String() != "10.0.0.0/8" {
+		t.Errorf("10.1.9.9 matched %s after remove", n.String())
+	}
+	if n, _, _ := s.Lookup(net.ParseIP("10.1.2.9")); n.String() != "10.1.2.0/24" {
+		t.Errorf("10.1.2.9 matched %s after remove", n.String())
+	}
+
+	for _, c := range []string{"10.1.2.0/24", "192.168.1.0/24", "10.0.0.0/8"} {
+		if !s.Remove(cidr(t, c)) {
+			t.Errorf("%s not removed", c)
+		}
+		checkCompact(t, s.(*ipNets).v4, true)
+	}
+
+	var left []string
+	s.Each(func(n net.IPNet) { left = append(left, n.String()) })
+	if len(left) != 2 || left[0] != "10.1.3.0/24" || left[1] != "192.168.0.0/16" {
+		t.Errorf("left %v", left)
+	}
+
+	s.Remove(cidr(t, "10.1.3.0/24"))
+	s.Remove(cidr(t, "192.168.0.0/16"))
+	if v4 := s.(*ipNets).v4; v4.child[0] != nil || v4.child[1] != nil {
+		t.Error("nodes left after removing every entry")
+	}
+}
+
+func TestIPNetsRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	nets := randNets(500, net.IPv4len)
+
+	s := NewIPNets()
+	for _, n := range nets {
+		s.Add(n)
+	}
+	//remove every other one, then add the rest again in case of duplicates
+	var kept []net.IPNet
+	for i, n := range nets {
+		if i%2 == 0 {
+			s.Remove(n)
+		}
+	}
+	for i, n := range nets {
+		if i%2 == 1 {
+			s.Add(n)
+			kept = append(kept, n)
+		}
+	}
+	checkCompact(t, s.(*ipNets).v4, true)
+
+	for i := 0; i < 20000; i++ {
+		ip := make(net.IP, net.IPv4len)
+		r.Read(ip)
+
+		best := -1
+		for _, n := range kept {
+			if ones, _ := n.Mask.Size(); n.Contains(ip) && ones > best {
+				best = ones
+			}
+		}
+
+		n, _, ok := s.Lookup(ip)
+		ones, _ := n.Mask.Size()
+		if ok != (best >= 0) || (ok && ones != best) {
+			t.Fatalf("%s: got %s %v, want /%d", ip, n.String(), ok, best)
+		}
+	}
+}
+
+func TestIPNetsAddRange(t *testing.T) {
+	tests := []struct {
+		start, end string
+		want       []string
+	}{
+		{"10.0.0.0", "10.0.0.255", []string{"10.0.0.0/24"}},
+		{"10.0.0.1", "10.0.0.1", []string{"10.0.0.1/32"}},
+		{"10.0.0.1", "10.0.0.6", []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.6/32"}},
+		{"10.0.0.255", "10.0.1.0", []string{"10.0.0.255/32", "10.0.1.0/32"}},
+		{"0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"192.168.0.0", "192.168.3.255", []string{"192.168.0.0/22"}},
+		{"2001:db8::", "2001:db8::ff", []string{"2001:db8::/120"}},
+		{"2001:db8::1", "2001:db8::2", []string{"2001:db8::1/128", "2001:db8::2/128"}},
+	}
+
+	for _, tt := range tests {
+		s := NewIPNets()
+		if err := s.AddRange(net.ParseIP(tt.start), net.ParseIP(tt.end), nil); err != nil {
+			t.Errorf("%s-%s: %v", tt.start, tt.end, err)
+			continue
+		}
+
+		var got []string
+		s.Each(func(n net.IPNet) { got = append(got, n.String()) })
+
+		if len(got) != len(tt.want) {
+			t.Errorf("%s-%s: got %v, want %v", tt.start, tt.end, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s-%s: got %v, want %v", tt.start, tt.end, got, tt.want)
+				break
+			}
+		}
+	}
+
+	s := NewIPNets()
+	for _, r := range [][2]string{{"10.0.0.2", "10.0.0.1"}, {"10.0.0.1", "2001:db8::1"}, {"", "10.0.0.1"}} {
+		if s.AddRange(net.ParseIP(r[0]), net.ParseIP(r[1]), nil) != ErrRange {
+			t.Errorf("%s-%s accepted", r[0], r[1])
+		}
+	}
+}
+
+func TestIPNetsFamilies(t *testing.T) {
+	s := NewIPNets()
+	s.Add(cidr(t, "10.0.0.0/8"))
+	s.Add(cidr(t, "::/96"))
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"::ffff:11.1.2.3", false},
+		{"::10.1.2.3", true},
+		{"11.1.2.3", false},
+	}
+	for _, tt := range tests {
+		if got := s.Match(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	//a mapped lookup reports the ipv4 network
+	if n, _, _ := s.Lookup(net.ParseIP("::ffff:10.1.2.3")); n.String() != "10.0.0.0/8" {
+		t.Errorf("mapped lookup got %s", n.String())
+	}
+
+	//ipv4 written with an ipv6 mask is the same entry
+	s.Add(cidr(t, "::ffff:172.16.0.0/108"))
+	if n, _, ok := s.Lookup(net.ParseIP("172.20.0.1")); !ok || n.String() != "172.16.0.0/12" {
+		t.Errorf("172.20.0.1 got %s %v", n.String(), ok)
+	}
+	if !s.Remove(cidr(t, "172.16.0.0/12")) {
+		t.Error("172.16.0.0/12 not removed")
+	}
+
+	//an ipv6 default route does not cover ipv4
+	s.Add(cidr(t, "::/0"))
+	if s.Match(net.ParseIP("11.1.2.3")) {
+		t.Error("::/0 matched ipv4")
+	}
+}
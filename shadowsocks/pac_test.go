@@ -0,0 +1,154 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSplitRulePort(t *testing.T) {
+	tests := []struct {
+		rule     string
+		host     string
+		min, max uint16
+		ok       bool
+	}{
+		{"example.com", "", 0, 0, false},
+		{"example.com:443", "example.com", 443, 443, true},
+		{"example.com:8000-8080", "example.com", 8000, 8080, true},
+		{"example.com:8080-8000", "", 0, 0, false},
+		{"example.com:70000", "", 0, 0, false},
+		{"example.com:", "", 0, 0, false},
+		{":443", "", 0, 0, false},
+		{"10.8.0.0/16:22", "10.8.0.0/16", 22, 22, true},
+		{"10.0.0.5-10.0.0.99:80", "10.0.0.5-10.0.0.99", 80, 80, true},
+		//a bare ipv6 address or cidr has no port
+		{"fd00::1", "", 0, 0, false},
+		{"2001:db8::22", "", 0, 0, false},
+		{"fd00::/8", "", 0, 0, false},
+		{"fd00::/8:22", "fd00::/8", 22, 22, true},
+		{"[fd00::1]:22", "fd00::1", 22, 22, true},
+		{"[fd00::]/8:3000-3100", "fd00::/8", 3000, 3100, true},
+		{"%^a\\.example$%:443", "%^a\\.example$%", 443, 443, true},
+		{"%^a:1$%", "", 0, 0, false},
+		{"%a:22", "", 0, 0, false},
+		{"full:example.com:443", "full:example.com", 443, 443, true},
+		{"keyword:example:443", "keyword:example", 443, 443, true},
+		{"*.example.com:443", "*.example.com", 443, 443, true},
+		{"geoip:CN:443", "geoip:CN", 443, 443, true},
+	}
+
+	for _, tt := range tests {
+		host, min, max, ok := splitRulePort(tt.rule)
+		if host != tt.host || min != tt.min || max != tt.max || ok != tt.ok {
+			t.Errorf("splitRulePort(%q) = %q %d %d %v, want %q %d %d %v", tt.rule, host, min, max, ok, tt.host, tt.min, tt.max, tt.ok)
+		}
+	}
+}
+
+func TestRulesMatchType(t *testing.T) {
+	r := NewRules(1, `example.com
+full:only.example
+keyword:tracker
+*.cdn.example
+%^api[0-9]+\.example$%
+10.0.0.0/8
+192.168.1.5-192.168.1.9
+fd00::/8
+db.example:3306
+172.16.0.0/12:22
+[fe80::]/10:8000-8080
+%^git\.%:22`, "")
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"example.com", "domain"},
+		{"www.example.com:443", "domain"},
+		{"EXAMPLE.COM", "domain"},
+		{"only.example", "full"},
+		{"only.example.", "full"},
+		{"sub.only.example", ""},
+		{"ads.tracker.net", "keyword"},
+		{"a.b.cdn.example", "wildcard"},
+		{"cdn.example", ""},
+		{"api12.example", "regexp"},
+		{"api.example", ""},
+		{"10.1.2.3", "ip"},
+		{"10.1.2.3:80", "ip"},
+		{"192.168.1.7", "ip"},
+		{"192.168.1.10", ""},
+		{"fd00::1", "ip"},
+		{"[fd00::1]:443", "ip"},
+		{"db.example:3306", "domain:port"},
+		{"db.example:3307", ""},
+		{"db.example", ""},
+		{"172.16.5.5:22", "ip:port"},
+		{"172.16.5.5:23", ""},
+		{"[fe80::1]:8080", "ip:port"},
+		{"[fe80::1]:8081", ""},
+		{"git.example:22", "regexp:port"},
+		{"git.example:443", ""},
+		{"other.net", ""},
+	}
+
+	for _, tt := range tests {
+		if got := r.MatchType(tt.host); got != tt.want {
+			t.Errorf("MatchType(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRulesAdd(t *testing.T) {
+	r := NewRules(1, "GEOIP,CN\nGEOIP,us:443\nfull:A.Example.\nkeyword:Ads\nsrc:10.0.0.0/8\nprocess:curl\nuid:1000\nuid:x", "2,3")
+
+	if len(r.GeoIP) != 1 || r.GeoIP[0] != "CN" {
+		t.Errorf("GeoIP %v", r.GeoIP)
+	}
+	if len(r.Ports) != 1 || r.Ports[0].min != 443 || len(r.Ports[0].GeoIP) != 1 || r.Ports[0].GeoIP[0] != "US" {
+		t.Errorf("port qualified GEOIP not kept apart: %+v", r.Ports)
+	}
+	if _, ok := r.Full["a.example"]; !ok || len(r.Keywords) != 1 || r.Keywords[0] != "ads" {
+		t.Errorf("Full %v Keywords %v", r.Full, r.Keywords)
+	}
+	if !r.Sources.Match(net.ParseIP("10.1.1.1")) || len(r.Processes) != 1 || len(r.UIDs) != 1 {
+		t.Errorf("client items %v %v %v", r.Sources, r.Processes, r.UIDs)
+	}
+	if len(r.ServerID) != 2 || r.OnlyClient() {
+		t.Errorf("ServerID %v OnlyClient %v", r.ServerID, r.OnlyClient())
+	}
+
+	if c := NewRules(1, "src:10.0.0.0/8", ""); !c.OnlyClient() {
+		t.Errorf("src only rule is not OnlyClient")
+	}
+}
+
+func TestMatchGeoIP(t *testing.T) {
+	c := NewClient("", 5, 5)
+	r := NewRules(1, "GEOIP,CN\nGEOIP,US:443", "")
+
+	tests := []struct {
+		country string
+		addr    string
+		want    string
+	}{
+		{"CN", "1.2.3.4:80", "geoip"},
+		{"US", "1.2.3.4:443", "geoip:port"},
+		{"US", "1.2.3.4:80", ""},
+		{"JP", "1.2.3.4:443", ""},
+		{"", "1.2.3.4:443", ""},
+	}
+
+	for _, tt := range tests {
+		addr, err := Parse2RawAddr(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//the country as looked up before
+		m := &Meta{Country: tt.country, geoDone: true}
+
+		if got := c.matchGeoIP(m, r, addr); got != tt.want {
+			t.Errorf("%s %s: %q, want %q", tt.country, tt.addr, got, tt.want)
+		}
+	}
+}
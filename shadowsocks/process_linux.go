@@ -0,0 +1,140 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errProcessNotFound = errors.New("process not found")
+
+// lookupProcess finds the local process owning the client side of a
+// connection, local is the client address and remote the listener's.
+// uid is -1 when the socket is not found, it is still returned when the
+// process is not, as the fds of other users can not be read without root.
+func lookupProcess(local, remote net.Addr) (pid, uid int, name string, err error) {
+	l, ok1 := local.(*net.TCPAddr)
+	r, ok2 := remote.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return 0, -1, "", errProcessNotFound
+	}
+
+	inode := ""
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		inode, uid, err = findSocket(file, l, r)
+		if err == nil {
+			break
+		}
+	}
+	if inode == "" {
+		return 0, -1, "", errProcessNotFound
+	}
+
+	pid, err = findSocketOwner(inode)
+	if err != nil {
+		return 0, uid, "", err
+	}
+
+	b, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/comm")
+	if err != nil {
+		return 0, uid, "", err
+	}
+
+	return pid, uid, strings.TrimSpace(string(b)), nil
+}
+
+// findSocket returns the inode and uid of the socket from local to remote
+func findSocket(file string, local, remote *net.TCPAddr) (string, int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	//header
+	s.Scan()
+
+	for s.Scan() {
+		//sl local_address rem_address st tx:rx tr:when retrnsmt uid timeout inode
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		if !equalProcAddr(fields[1], local) || !equalProcAddr(fields[2], remote) {
+			continue
+		}
+
+		uid, _ := strconv.Atoi(fields[7])
+		return fields[9], uid, nil
+	}
+
+	if err := s.Err(); err != nil {
+		return "", 0, err
+	}
+	return "", 0, errProcessNotFound
+}
+
+// equalProcAddr compares a /proc/net/tcp address such as 0100007F:0438
+// with addr. The ip is printed as native endian 32 bit words, which is
+// little endian on every platform we run on.
+func equalProcAddr(s string, addr *net.TCPAddr) bool {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return false
+	}
+
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil || int(port) != addr.Port {
+		return false
+	}
+
+	b, err := hex.DecodeString(s[:i])
+	if err != nil || len(b)%4 != 0 {
+		return false
+	}
+	for j := 0; j < len(b); j += 4 {
+		b[j], b[j+1], b[j+2], b[j+3] = b[j+3], b[j+2], b[j+1], b[j]
+	}
+
+	return net.IP(b).Equal(addr.IP)
+}
+
+// findSocketOwner scans /proc/*/fd for the process holding the socket
+func findSocketOwner(inode string) (int, error) {
+	target := "socket:[" + inode + "]"
+
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+
+		dir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, fd.Name()))
+			if err == nil && link == target {
+				return pid, nil
+			}
+		}
+	}
+
+	return 0, errProcessNotFound
+}
@@ -0,0 +1,102 @@
+package shadowsocks
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEqualProcAddr(t *testing.T) {
+	tests := []struct {
+		s    string
+		addr string
+		want bool
+	}{
+		{"0100007F:0438", "127.0.0.1:1080", true},
+		{"0100007F:0438", "127.0.0.1:1081", false},
+		{"7F000001:0438", "127.0.0.1:1080", false},
+		{"0501A8C0:C350", "192.168.1.5:50000", true},
+		//each 32 bit word is little endian, the words are in order
+		{"00000000000000000000000001000000:0050", "[::1]:80", true},
+		{"B80D0120000000000000000005000000:01BB", "[2001:db8::5]:443", true},
+		{"20010DB8000000000000000000000005:01BB", "[2001:db8::5]:443", false},
+		//an ipv4 client of an ipv6 listener
+		{"0000000000000000FFFF00000100007F:0438", "127.0.0.1:1080", true},
+		{"0100007F", "127.0.0.1:1080", false},
+		{"0100007F:xyz", "127.0.0.1:1080", false},
+		{"01007F:0438", "127.0.0.1:1080", false},
+		{"ZZ00007F:0438", "127.0.0.1:1080", false},
+	}
+
+	for _, tt := range tests {
+		addr, err := net.ResolveTCPAddr("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := equalProcAddr(tt.s, addr); got != tt.want {
+			t.Errorf("equalProcAddr(%q, %s) = %v, want %v", tt.s, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestFindSocket(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tcp")
+	err := ioutil.WriteFile(file, []byte(`  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:0438 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 11111 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:C350 0100007F:0438 01 00000000:00000000 00:00000000 00000000  1001        0 22222 1 0000000000000000 20 4 30 10 -1
+   2: short line
+   3: 0100007F:0438 0100007F:C350 01 00000000:00000000 00:00000000 00000000  1000        0 33333 1 0000000000000000 20 4 30 10 -1
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	listener := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+
+	inode, uid, err := findSocket(file, client, listener)
+	if err != nil || inode != "22222" || uid != 1001 {
+		t.Errorf("findSocket = %q %d %v", inode, uid, err)
+	}
+
+	other := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50001}
+	if _, _, err := findSocket(file, other, listener); err != errProcessNotFound {
+		t.Errorf("unknown socket: %v", err)
+	}
+
+	if _, _, err := findSocket(filepath.Join(t.TempDir(), "none"), client, listener); err == nil {
+		t.Errorf("missing file read")
+	}
+}
+
+func TestLookupProcess(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skip("no /proc/net/tcp")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	//the client is this test
+	pid, uid, _, err := lookupProcess(in.RemoteAddr(), in.LocalAddr())
+	if err != nil || pid != os.Getpid() || uid != os.Getuid() {
+		t.Errorf("lookupProcess = %d %d %v, want %d %d", pid, uid, err, os.Getpid(), os.Getuid())
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+)
+
+var errProcessNotFound = errors.New("process lookup is only supported on linux")
+
+func lookupProcess(local, remote net.Addr) (pid, uid int, name string, err error) {
+	return 0, -1, "", errProcessNotFound
+}
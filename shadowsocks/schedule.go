@@ -0,0 +1,163 @@
+package shadowsocks
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrSchedule = errors.New("invalid schedule")
+
+var weekdays = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// Schedule limits rules to some days of the week and times of the day.
+type Schedule struct {
+	days [7]bool
+	//minutes since midnight, a span ending before it starts runs past
+	//midnight and belongs to the day it starts on
+	spans [][2]int
+	loc   *time.Location
+
+	text string
+}
+
+// ParseZone loads an IANA time zone, nil for an empty one which is the
+// local time.
+func ParseZone(zone string) (*time.Location, error) {
+	zone = strings.TrimSpace(zone)
+	if zone == "" {
+		return nil, nil
+	}
+	return time.LoadLocation(zone)
+}
+
+// ParseSchedule parses days like "mon-fri,sun" and times like
+// "22:00-06:00,12:00-13:30" in the zone loc, empty days means every
+// day, empty times all day and a nil loc the local time. Nil is
+// returned when both days and times are empty.
+func ParseSchedule(days, times string, loc *time.Location) (*Schedule, error) {
+	days = strings.ToLower(strings.TrimSpace(days))
+	times = strings.TrimSpace(times)
+
+	if days == "" && times == "" {
+		return nil, nil
+	}
+
+	zone := ""
+	if loc != nil {
+		zone = loc.String()
+	} else {
+		loc = time.Local
+	}
+
+	s := &Schedule{loc: loc}
+
+	if days == "" {
+		for i := range s.days {
+			s.days[i] = true
+		}
+	}
+	for _, t := range StrSplit(days) {
+		a, b := t, t
+		if i := strings.IndexByte(t, '-'); i > 0 {
+			a, b = t[:i], t[i+1:]
+		}
+
+		from, to := weekday(a), weekday(b)
+		if from < 0 || to < 0 {
+			return nil, ErrSchedule
+		}
+		for i := from; ; i = (i + 1) % 7 {
+			s.days[i] = true
+			if i == to {
+				break
+			}
+		}
+	}
+
+	if times == "" {
+		s.spans = append(s.spans, [2]int{0, 24 * 60})
+	}
+	for _, t := range StrSplit(times) {
+		i := strings.IndexByte(t, '-')
+		if i < 0 {
+			return nil, ErrSchedule
+		}
+
+		start, ok1 := clock(t[:i])
+		end, ok2 := clock(t[i+1:])
+		if !ok1 || !ok2 || start == end {
+			return nil, ErrSchedule
+		}
+		s.spans = append(s.spans, [2]int{start, end})
+	}
+
+	s.text = strings.TrimSpace(days + " " + times + " " + zone)
+
+	return s, nil
+}
+
+// weekday parses a lower case day name, its first three letters or a
+// number where 0 and 7 are sunday
+func weekday(s string) int {
+	s = strings.TrimSpace(s)
+	for i, d := range weekdays {
+		if s == d || s == d[:3] {
+			return i
+		}
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n <= 7 {
+		return n % 7
+	}
+	return -1
+}
+
+// clock parses hh:mm into minutes, 24:00 is the end of the day
+func clock(s string) (int, bool) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return 0, false
+	}
+
+	h, err1 := strconv.Atoi(strings.TrimSpace(s[:i]))
+	m, err2 := strconv.Atoi(strings.TrimSpace(s[i+1:]))
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, false
+	}
+	return h*60 + m, true
+}
+
+// Active reports whether t falls into the schedule.
+func (s *Schedule) Active(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+
+	t = t.In(s.loc)
+	now := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+
+	for _, sp := range s.spans {
+		if sp[0] < sp[1] {
+			if now >= sp[0] && now < sp[1] && s.days[day] {
+				return true
+			}
+			continue
+		}
+
+		//past midnight, the part after it belongs to the day before
+		if now >= sp[0] && s.days[day] {
+			return true
+		}
+		if now < sp[1] && s.days[(day+6)%7] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Schedule) String() string {
+	return s.text
+}
@@ -0,0 +1,110 @@
+package shadowsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWeekday(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"sun", 0},
+		{"sunday", 0},
+		{"mon", 1},
+		{"wednesday", 3},
+		{"sat", 6},
+		{" fri ", 5},
+		{"0", 0},
+		{"7", 0},
+		{"3", 3},
+		{"sunflower", -1},
+		{"monk", -1},
+		{"thurs", -1},
+		{"su", -1},
+		{"8", -1},
+		{"-1", -1},
+		{"", -1},
+	}
+
+	for _, tt := range tests {
+		if got := weekday(tt.s); got != tt.want {
+			t.Errorf("%q = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	for _, days := range []string{"sunflower", "mon-fryday", "mon-", "xyz"} {
+		if _, err := ParseSchedule(days, "", nil); err != ErrSchedule {
+			t.Errorf("%q: got %v", days, err)
+		}
+	}
+	for _, times := range []string{"10:00", "10:00-10:00", "25:00-26:00", "10:60-11:00", "a-b"} {
+		if _, err := ParseSchedule("", times, nil); err != ErrSchedule {
+			t.Errorf("%q: got %v", times, err)
+		}
+	}
+	if _, err := ParseZone("Nowhere/Town"); err == nil {
+		t.Error("unknown zone accepted")
+	}
+	if loc, err := ParseZone(" "); loc != nil || err != nil {
+		t.Errorf("empty zone got %v %v", loc, err)
+	}
+	if s, err := ParseSchedule("", "", nil); s != nil || err != nil {
+		t.Errorf("empty got %v %v", s, err)
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	//2024-01-01 is a monday
+	at := func(day, h, m int) time.Time {
+		return time.Date(2024, 1, day, h, m, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		days, times string
+		t           time.Time
+		want        bool
+	}{
+		{"mon-fri", "", at(1, 12, 0), true},
+		{"monday-friday", "", at(6, 12, 0), false},
+		{"Sat,Sun", "", at(7, 0, 0), true},
+		{"fri-mon", "", at(3, 12, 0), false},
+		{"fri-mon", "", at(8, 12, 0), true},
+		{"", "09:00-18:00", at(2, 9, 0), true},
+		{"", "09:00-18:00", at(2, 18, 0), false},
+		{"", "09:00-12:00,13:00-18:00", at(2, 12, 30), false},
+		{"", "00:00-24:00", at(2, 23, 59), true},
+		//past midnight belongs to the day it starts on
+		{"fri", "22:00-06:00", at(5, 23, 0), true},
+		{"fri", "22:00-06:00", at(6, 5, 59), true},
+		{"fri", "22:00-06:00", at(5, 5, 0), false},
+		{"fri", "22:00-06:00", at(6, 6, 0), false},
+	}
+
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.days, tt.times, time.UTC)
+		if err != nil {
+			t.Errorf("%q %q: %v", tt.days, tt.times, err)
+			continue
+		}
+		if got := s.Active(tt.t); got != tt.want {
+			t.Errorf("%q %q at %s = %v, want %v", tt.days, tt.times, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+
+	//9:00 in Tokyo is 0:00 in UTC
+	loc, err := ParseZone("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ParseSchedule("mon", "09:00-10:00", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Active(at(1, 0, 30)) || s.Active(at(1, 9, 30)) {
+		t.Error("zone not applied")
+	}
+}
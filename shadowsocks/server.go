@@ -60,7 +60,7 @@ func (s *Server) Serve(c net.Conn) {
 		return
 	}
 
-	s.Watcher.OnProxyStart(false, c.RemoteAddr(), addr)
+	s.Watcher.OnProxyStart(false, c.RemoteAddr(), addr, nil)
 	defer func() {
 		s.Watcher.OnProxyStop(false, c.RemoteAddr(), addr, err)
 	}()
@@ -1,9 +1,11 @@
 package shadowsocks
 
 import (
+	"context"
 	"errors"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -20,13 +22,14 @@ type Shadow struct {
 	ID        uint64
 	Network   string
 	Address   string
-	Rule      Rules
 	Shadow    Creater
 	Traffic   Traffic
 	sshConfig *ssh.ClientConfig
 	ssh       *ssh.Client
+	sshLock   sync.Mutex
 	ss        shadow.Cipher
-	Dial      func(string, time.Duration) (net.Conn, error)
+	//connects to an address through the server, giving up when ctx is done
+	Dial func(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error)
 }
 
 func AllCiphers() []string {
@@ -82,8 +85,6 @@ func NewShadow(network, addr, cipher, user, password string) (*Shadow, error) {
 		s.Dial = s.DialSS
 	}
 
-	s.Rule.Init()
-
 	return s, nil
 }
 
@@ -91,20 +92,50 @@ func (s *Shadow) Listen() (l net.Listener, err error) {
 	return net.Listen(s.Network, s.Address)
 }
 
-func (s *Shadow) DialSocks(addr string, timeout time.Duration) (net.Conn, error) {
+// dialContext returns when dial does or ctx is done, for dials that can
+// not be interrupted. A connection made after ctx is done is closed.
+func dialContext(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Shadow) DialSocks(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
 	num := strconv.Itoa(int(timeout / time.Second))
 
-	dialSocksProxy := socks.Dial(s.Network + "//" + s.Address + "?timeout=" + num + "s")
-	return dialSocksProxy("", addr)
+	dialSocksProxy := socks.Dial(s.Network + "://" + s.Address + "?timeout=" + num + "s")
+	return dialContext(ctx, func() (net.Conn, error) {
+		return dialSocksProxy("", addr)
+	})
 }
 
-func (s *Shadow) DialSS(addr string, timeout time.Duration) (net.Conn, error) {
+func (s *Shadow) DialSS(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
 	raw, err := Parse2RawAddr(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	c, err := net.DialTimeout(s.Network, s.Address, timeout)
+	d := net.Dialer{Timeout: timeout}
+	c, err := d.DialContext(ctx, s.Network, s.Address)
 	if err != nil {
 		return nil, err
 	}
@@ -123,19 +154,40 @@ func (s *Shadow) DialSS(addr string, timeout time.Duration) (net.Conn, error) {
 	return t2, nil
 }
 
-func (s *Shadow) DialSSH(addr string, timeout time.Duration) (net.Conn, error) {
+func (s *Shadow) DialSSH(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	return dialContext(ctx, func() (net.Conn, error) {
+		return s.dialSSH(addr)
+	})
+}
+
+func (s *Shadow) dialSSH(addr string) (net.Conn, error) {
+	s.sshLock.Lock()
 	if s.ssh == nil {
 		var err error
 		s.ssh, err = ssh.Dial("tcp", s.Address, s.sshConfig)
 		if err != nil {
+			s.sshLock.Unlock()
 			Debug.Println("SSH Dial", err)
 			return nil, err
 		}
 	}
+	client := s.ssh
+	s.sshLock.Unlock()
 
-	n, err := s.ssh.Dial(s.Network, addr)
+	n, err := client.Dial(s.Network, addr)
 	if err != nil {
 		Debug.Println("Dial From SSH", err)
 	}
 	return n, err
 }
+
+// Close closes the ssh session of the server, if any.
+func (s *Shadow) Close() {
+	s.sshLock.Lock()
+	defer s.sshLock.Unlock()
+
+	if s.ssh != nil {
+		s.ssh.Close()
+		s.ssh = nil
+	}
+}
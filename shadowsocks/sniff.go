@@ -0,0 +1,234 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"time"
+)
+
+const sniffMaxSize = 16*1024 + 5
+
+// SetSniff enables reading the TLS SNI or HTTP Host of connections to
+// ip destinations so domain rules can match them. Protocols where the
+// server speaks first send nothing, they are held up for timeout at most.
+// A zero timeout disables sniffing.
+func (c *Client) SetSniff(timeout time.Duration) {
+	c.sniffTimeout = timeout
+}
+
+// peekConn returns the bytes read while sniffing before reading on
+type peekConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// sniff reads the first client bytes until a server name is found, the
+// data can not contain one, or the timeout passed.
+func (c *Client) sniff(from net.Conn) (net.Conn, string) {
+	buf := make([]byte, 0, 1024)
+
+	from.SetReadDeadline(time.Now().Add(c.sniffTimeout))
+	defer from.SetReadDeadline(time.Time{})
+
+	name := ""
+	for len(buf) < sniffMaxSize {
+		if len(buf) == cap(buf) {
+			t := make([]byte, len(buf), 2*cap(buf))
+			copy(t, buf)
+			buf = t
+		}
+
+		n, err := from.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		t, more := sniffName(buf)
+		if t != "" || !more {
+			name = t
+			break
+		}
+		if err != nil {
+			if !isTimeout(err) {
+				Debug.Println("Sniff", from.RemoteAddr(), err)
+			}
+			break
+		}
+	}
+
+	if len(buf) == 0 {
+		return from, name
+	}
+	return &peekConn{Conn: from, buf: buf}, name
+}
+
+// sniffName returns the server name in the first bytes of a TLS or
+// HTTP connection, more reports that b is too short to tell.
+func sniffName(b []byte) (name string, more bool) {
+	if len(b) == 0 {
+		return "", true
+	}
+
+	if b[0] == 0x16 {
+		name, more = sniffTLS(b)
+	} else {
+		name, more = sniffHTTP(b)
+	}
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if net.ParseIP(name) != nil {
+		name = ""
+	}
+	return name, more
+}
+
+// tlsVec reads the length prefixed fields of a ClientHello
+type tlsVec []byte
+
+func (v *tlsVec) next(size int) (tlsVec, bool) {
+	b := *v
+	if len(b) < size {
+		return nil, false
+	}
+
+	n := 0
+	for i := 0; i < size; i++ {
+		n = n<<8 | int(b[i])
+	}
+	if len(b) < size+n {
+		return nil, false
+	}
+
+	*v = b[size+n:]
+	return b[size : size+n], true
+}
+
+func sniffTLS(b []byte) (string, bool) {
+	if len(b) < 5 {
+		return "", true
+	}
+	if b[1] != 3 {
+		return "", false
+	}
+
+	n := int(b[3])<<8 | int(b[4])
+	if len(b) < 5+n {
+		return "", true
+	}
+
+	rec := tlsVec(b[5 : 5+n])
+
+	//client hello
+	if len(rec) < 1 || rec[0] != 1 {
+		return "", false
+	}
+	rec = rec[1:]
+	hello, ok := rec.next(3)
+	if !ok {
+		//split over several records, only the first is read
+		return "", false
+	}
+
+	//version and random
+	if len(hello) < 34 {
+		return "", false
+	}
+	hello = hello[34:]
+
+	//session id, cipher suites, compression methods
+	for _, size := range []int{1, 2, 1} {
+		if _, ok := hello.next(size); !ok {
+			return "", false
+		}
+	}
+
+	exts, ok := hello.next(2)
+	if !ok {
+		return "", false
+	}
+
+	for len(exts) >= 2 {
+		typ := int(exts[0])<<8 | int(exts[1])
+		exts = exts[2:]
+
+		ext, ok := exts.next(2)
+		if !ok {
+			return "", false
+		}
+		if typ != 0 {
+			continue
+		}
+
+		list, ok := ext.next(2)
+		if !ok {
+			return "", false
+		}
+		for len(list) >= 1 {
+			kind := list[0]
+			list = list[1:]
+
+			name, ok := list.next(2)
+			if !ok {
+				return "", false
+			}
+			if kind == 0 {
+				return string(name), false
+			}
+		}
+	}
+
+	return "", false
+}
+
+func sniffHTTP(b []byte) (string, bool) {
+	//request line starts with an upper case method
+	i := 0
+	for ; i < len(b) && i < 16; i++ {
+		if b[i] == ' ' {
+			break
+		}
+		if b[i] < 'A' || b[i] > 'Z' {
+			return "", false
+		}
+	}
+	if i == len(b) {
+		return "", true
+	}
+	if i == 0 || b[i] != ' ' {
+		return "", false
+	}
+
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = len(b)
+	}
+
+	lines := bytes.Split(b[:end], []byte("\r\n"))
+	for j, line := range lines[1:] {
+		//the last line may still be incomplete
+		if end == len(b) && j == len(lines)-2 {
+			break
+		}
+
+		k := bytes.IndexByte(line, ':')
+		if k < 0 || !strings.EqualFold(string(line[:k]), "host") {
+			continue
+		}
+
+		host := strings.TrimSpace(string(line[k+1:]))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.Trim(host, "[]"), false
+	}
+
+	return "", end == len(b)
+}
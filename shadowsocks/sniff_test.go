@@ -0,0 +1,172 @@
+package shadowsocks
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first record a TLS client sends for name,
+// without the server name extension when name is empty
+func clientHello(t *testing.T, name string) []byte {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	go func() {
+		c := tls.Client(c1, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		c.Handshake()
+		c.Close()
+	}()
+
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(c2, head); err != nil {
+		t.Fatal(err)
+	}
+	rec := make([]byte, int(head[3])<<8|int(head[4]))
+	if _, err := io.ReadFull(c2, rec); err != nil {
+		t.Fatal(err)
+	}
+	return append(head, rec...)
+}
+
+func TestSniffTLS(t *testing.T) {
+	hello := clientHello(t, "Example.COM")
+
+	if name, more := sniffName(hello); name != "example.com" || more {
+		t.Errorf("got %q %v", name, more)
+	}
+
+	//every truncated record asks for more
+	for i := 1; i < len(hello); i++ {
+		if name, more := sniffName(hello[:i]); name != "" || !more {
+			t.Fatalf("%d of %d bytes: got %q %v", i, len(hello), name, more)
+		}
+	}
+
+	if name, more := sniffName(clientHello(t, "")); name != "" || more {
+		t.Errorf("without sni: got %q %v", name, more)
+	}
+
+	//a record length cut inside the hello is not a hello
+	bad := append([]byte(nil), hello[:9]...)
+	bad[3], bad[4] = 0, 4
+	if name, more := sniffName(bad); name != "" || more {
+		t.Errorf("short record: got %q %v", name, more)
+	}
+
+	bad = append([]byte(nil), hello...)
+	bad[1] = 2
+	if name, more := sniffName(bad); name != "" || more {
+		t.Errorf("bad version: got %q %v", name, more)
+	}
+}
+
+func TestSniffHTTP(t *testing.T) {
+	tests := []struct {
+		req  string
+		name string
+		more bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", false},
+		{"POST /a HTTP/1.1\r\nUser-Agent: x\r\nhost: Example.com:8080\r\n\r\n", "example.com", false},
+		{"GET / HTTP/1.1\r\nHost: [::1]:80\r\n\r\n", "", false},
+		{"GET / HTTP/1.1\r\nHost: 10.0.0.1\r\n\r\n", "", false},
+		{"GET / HTTP/1.0\r\n\r\n", "", false},
+		{"GE", "", true},
+		{"GET / HTTP/1.1\r\nHost: exa", "", true},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n", "example.com", false},
+		{"SSH-2.0-OpenSSH\r\n", "", false},
+		{"get / HTTP/1.1\r\n", "", false},
+	}
+
+	for _, tt := range tests {
+		name, more := sniffName([]byte(tt.req))
+		if name != tt.name || more != tt.more {
+			t.Errorf("%q: got %q %v, want %q %v", tt.req, name, more, tt.name, tt.more)
+		}
+	}
+}
+
+// sniffChunks writes data to a sniffed connection in chunks of size and
+// returns the sniffed name and everything read from the connection
+func sniffChunks(t *testing.T, data []byte, size int) (string, []byte) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	go func() {
+		for i := 0; i < len(data); i += size {
+			end := i + size
+			if end > len(data) {
+				end = len(data)
+			}
+			c2.Write(data[i:end])
+			time.Sleep(time.Millisecond)
+		}
+		c2.Close()
+	}()
+
+	c := &Client{sniffTimeout: 5 * time.Second}
+	conn, name := c.sniff(c1)
+
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name, got
+}
+
+func TestSniffReads(t *testing.T) {
+	req := []byte("GET /index.html HTTP/1.1\r\nUser-Agent: test\r\nHost: example.com\r\nAccept: */*\r\n\r\nbody")
+	hello := clientHello(t, "example.org")
+
+	tests := []struct {
+		data []byte
+		size int
+		name string
+	}{
+		{req, len(req), "example.com"},
+		{req, 1, "example.com"},
+		{req, 7, "example.com"},
+		{hello, 1, "example.org"},
+		{hello, 100, "example.org"},
+		{[]byte("SSH-2.0-OpenSSH\r\n"), 3, ""},
+	}
+
+	for _, tt := range tests {
+		name, got := sniffChunks(t, tt.data, tt.size)
+		if name != tt.name {
+			t.Errorf("chunks of %d: got %q, want %q", tt.size, name, tt.name)
+		}
+		if string(got) != string(tt.data) {
+			t.Errorf("chunks of %d: read %q, want %q", tt.size, got, tt.data)
+		}
+	}
+}
+
+func TestSniffTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	//the server speaks first, nothing to read
+	c := &Client{sniffTimeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	conn, name := c.sniff(c1)
+	if name != "" || conn != c1 {
+		t.Errorf("got %q %T", name, conn)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("held up %s", d)
+	}
+
+	//the deadline is cleared for the relay
+	go c2.Write([]byte("x"))
+	b := make([]byte, 1)
+	if _, err := conn.Read(b); err != nil {
+		t.Error(err)
+	}
+}
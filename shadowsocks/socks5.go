@@ -225,6 +225,7 @@ func Parse2RawAddr(addr string) (RawAddr, error) {
 	raw := make([]byte, 1+1+len(h)+2)
 	raw[0] = SOCKS_ATYP_DOMAINNAME
 	raw[1] = uint8(len(h))
+	copy(raw[2:], h)
 	raw[len(raw)-2] = uint8((port & 0xff00) >> 8)
 	raw[len(raw)-1] = uint8(port & 0xff)
 
@@ -49,3 +49,19 @@ func StrSplit(str string) (out []string) {
 	}
 	return
 }
+
+// AddrIP returns the ip of a tcp address, nil if it has none.
+func AddrIP(a net.Addr) net.IP {
+	if a == nil {
+		return nil
+	}
+	if t, ok := a.(*net.TCPAddr); ok {
+		return t.IP
+	}
+
+	host, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
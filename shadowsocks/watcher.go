@@ -3,6 +3,7 @@ package shadowsocks
 import (
 	"net"
 	"sync/atomic"
+	"time"
 )
 
 type Watcher interface {
@@ -10,9 +11,16 @@ type Watcher interface {
 	OnSocksInvalid(from net.Addr, err error)
 	//Server HandShake Error
 	OnShadowInvalid(from net.Addr, err error)
-	OnProxyStart(ac bool, from, to net.Addr)
+	//meta is nil on the server side
+	OnProxyStart(ac bool, from, to net.Addr, meta *Meta)
 	OnProxyStop(ac bool, from, to net.Addr, err error)
 	Hijacker(host string, c net.Conn) bool
+	//auto mode retried host through the server
+	OnAutoLearn(host string, expire time.Time)
+	//the dns inbound gave a fake ip to name
+	OnFakeIP(ip net.IP, name string)
+	//a domain was looked up
+	OnDNSLog(l *DNSLog)
 }
 
 var DefaultWatcher = &defaultWatcher{}
@@ -29,13 +37,17 @@ func (w *defaultWatcher) OnShadowInvalid(from net.Addr, err error) {
 	Debug.Println("ShadowInvalid", from, err)
 }
 
-func (w *defaultWatcher) OnProxyStart(ac bool, from, to net.Addr) {
+func (w *defaultWatcher) OnProxyStart(ac bool, from, to net.Addr, meta *Meta) {
 	mode := "Direct"
 	if ac {
 		mode = "Proxy"
 	}
 
-	Debug.Println("ProxyStart", mode, from, "<=>", to)
+	if meta != nil {
+		Debug.Println("ProxyStart", mode, from, "<=>", to, meta.Process, meta.Country)
+	} else {
+		Debug.Println("ProxyStart", mode, from, "<=>", to)
+	}
 
 	atomic.AddInt32(&w.Counter, 1)
 }
@@ -54,3 +66,13 @@ func (w *defaultWatcher) OnProxyStop(ac bool, from, to net.Addr, err error) {
 func (this *defaultWatcher) Hijacker(host string, c net.Conn) bool {
 	return false
 }
+
+func (w *defaultWatcher) OnAutoLearn(host string, expire time.Time) {
+}
+
+func (w *defaultWatcher) OnFakeIP(ip net.IP, name string) {
+}
+
+func (w *defaultWatcher) OnDNSLog(l *DNSLog) {
+	Debug.Println("DNS", l.Resolver, l.Name, l.IPs, l.Latency, l.Cache, l.Err)
+}
@@ -0,0 +1,98 @@
+package ui
+
+import (
+	"net"
+	ss "sshProxy/shadowsocks"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// how often the dns cache is saved besides restart and shutdown
+const dnsCacheSaveEvery = 5 * time.Minute
+
+// initDNSCache loads the saved answers, they are served stale while the
+// most used names are refreshed
+func (this *ui) initDNSCache() {
+	this.l.Lock()
+	persist := this.dnsPersist
+	this.l.Unlock()
+
+	if !persist {
+		return
+	}
+
+	var rs []DNSCache
+	err := this.store.Find(&rs, nil)
+	if err != nil {
+		ss.Debug.Println("initDNSCache", err)
+		return
+	}
+
+	es := make([]ss.DNSCacheEntry, 0, len(rs))
+	for _, r := range rs {
+		e := ss.DNSCacheEntry{
+			Resolver: r.Resolver,
+			Name:     r.Name,
+			Expire:   r.Expire,
+			Hits:     r.Hits,
+		}
+		for _, t := range r.IPs {
+			if ip := net.ParseIP(t); ip != nil {
+				e.IPs = append(e.IPs, ip)
+			}
+		}
+		es = append(es, e)
+	}
+
+	this.client().RestoreDNSCache(es)
+}
+
+// saveDNSCache replaces the saved answers with the current cache
+func (this *ui) saveDNSCache() {
+	this.l.Lock()
+	c := this.ssServer
+	persist := this.dnsPersist
+	this.l.Unlock()
+
+	if c == nil || !persist {
+		return
+	}
+
+	es := c.DNSCacheSnapshot()
+
+	err := this.store.Bolt().Update(func(tx *bolt.Tx) error {
+		err := this.store.TxDeleteMatching(tx, DNSCache{}, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range es {
+			r := DNSCache{
+				Key:      e.Resolver + " " + e.Name,
+				Resolver: e.Resolver,
+				Name:     e.Name,
+				Expire:   e.Expire,
+				Hits:     e.Hits,
+			}
+			for _, ip := range e.IPs {
+				r.IPs = append(r.IPs, ip.String())
+			}
+
+			if err := this.store.TxInsert(tx, r.Key, &r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ss.Debug.Println("saveDNSCache", err)
+	}
+}
+
+func (this *ui) runDNSCache() {
+	c := time.Tick(dnsCacheSaveEvery)
+	for _ = range c {
+		this.saveDNSCache()
+	}
+}
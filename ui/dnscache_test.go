@@ -0,0 +1,85 @@
+package ui
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	ss "sshProxy/shadowsocks"
+	"testing"
+	"time"
+)
+
+// dnsCacheClient is a client with a local dns and nothing cached
+func dnsCacheClient() *ss.Client {
+	c := ss.NewClient("", 5, 5)
+	c.SetLocalDNS("10.0.0.9")
+	return c
+}
+
+func snapshotNames(c *ss.Client) string {
+	var names []string
+	for _, e := range c.DNSCacheSnapshot() {
+		names = append(names, fmt.Sprint(e.Resolver, " ", e.Name, " ", e.IPs))
+	}
+	sort.Strings(names)
+	return fmt.Sprint(names)
+}
+
+func TestDNSCacheSaveRestore(t *testing.T) {
+	u := newTestUI(t)
+	u.dnsPersist = true
+
+	u.ssServer = dnsCacheClient()
+	u.ssServer.RestoreDNSCache([]ss.DNSCacheEntry{
+		{Resolver: "local", Name: "a.example", IPs: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}, Expire: time.Now()},
+		{Resolver: "local", Name: "b.example", IPs: []net.IP{net.ParseIP("10.0.0.2")}, Expire: time.Now()},
+	})
+	want := snapshotNames(u.ssServer)
+	if want == "[]" {
+		t.Fatalf("nothing cached")
+	}
+
+	u.saveDNSCache()
+
+	var rs []DNSCache
+	if err := u.store.Find(&rs, nil); err != nil || len(rs) != 2 {
+		t.Fatalf("saved %d %v", len(rs), err)
+	}
+
+	//after a restart
+	u.ssServer = dnsCacheClient()
+	u.initDNSCache()
+	if got := snapshotNames(u.ssServer); got != want {
+		t.Errorf("restored %s, want %s", got, want)
+	}
+
+	//a save replaces the rows
+	u.ssServer = dnsCacheClient()
+	u.saveDNSCache()
+	rs = nil
+	if err := u.store.Find(&rs, nil); err != nil || len(rs) != 0 {
+		t.Errorf("%d rows kept after saving an empty cache", len(rs))
+	}
+}
+
+func TestDNSCacheNotPersisted(t *testing.T) {
+	u := newTestUI(t)
+
+	u.ssServer = dnsCacheClient()
+	u.ssServer.RestoreDNSCache([]ss.DNSCacheEntry{
+		{Resolver: "local", Name: "a.example", IPs: []net.IP{net.ParseIP("10.0.0.1")}, Expire: time.Now()},
+	})
+	u.saveDNSCache()
+
+	var rs []DNSCache
+	if err := u.store.Find(&rs, nil); err != nil || len(rs) != 0 {
+		t.Errorf("saved %d without persistence", len(rs))
+	}
+
+	u.store.Insert("local a.example", &DNSCache{Key: "local a.example", Resolver: "local", Name: "a.example", IPs: []string{"10.0.0.1"}, Expire: time.Now()})
+	u.ssServer = dnsCacheClient()
+	u.initDNSCache()
+	if got := snapshotNames(u.ssServer); got != "[]" {
+		t.Errorf("restored %s without persistence", got)
+	}
+}
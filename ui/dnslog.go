@@ -0,0 +1,176 @@
+package ui
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	ss "sshProxy/shadowsocks"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/bybzmt/bolthold"
+)
+
+// saved lookups kept by gcStore, and the most waiting to be saved
+const dnsLogKeep = 5000
+
+// names counted at most, the ones seen once make room for new ones
+const dnsTopMax = 10000
+
+type dnsLogTop struct {
+	Name   string
+	Count  int
+	Misses int
+	Errors int
+	//average ms
+	Latency float64
+}
+
+type dnsLogList struct {
+	Logs []DNSLog
+	Top  []dnsLogTop
+}
+
+// countDNS adds t to the counts of its name, the latency is summed until
+// topDNS averages it. dnsL is held.
+func (this *uiWatcher) countDNS(t *DNSLog) {
+	n, ok := this.dnsTop[t.Name]
+	if !ok {
+		if len(this.dnsTop) >= dnsTopMax {
+			for name, n := range this.dnsTop {
+				if n.Count == 1 {
+					delete(this.dnsTop, name)
+				}
+			}
+		}
+		if len(this.dnsTop) >= dnsTopMax {
+			this.dnsTop = make(map[string]*dnsLogTop)
+		}
+
+		n = &dnsLogTop{Name: t.Name}
+		this.dnsTop[t.Name] = n
+	}
+
+	n.Count++
+	n.Latency += t.Latency
+	if t.Cache == "" || t.Cache == "miss" {
+		n.Misses++
+	}
+	if t.Err != "" {
+		n.Errors++
+	}
+}
+
+// topDNS returns the max most looked up names containing name, only
+// the ones with errors when onlyErr is set
+func (this *uiWatcher) topDNS(name string, onlyErr bool, max int) []dnsLogTop {
+	rs := make([]dnsLogTop, 0)
+
+	this.dnsL.Lock()
+	for _, n := range this.dnsTop {
+		if name != "" && !strings.Contains(n.Name, name) {
+			continue
+		}
+		if onlyErr && n.Errors == 0 {
+			continue
+		}
+
+		t := *n
+		t.Latency /= float64(t.Count)
+		rs = append(rs, t)
+	}
+	this.dnsL.Unlock()
+
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Count != rs[j].Count {
+			return rs[i].Count > rs[j].Count
+		}
+		return rs[i].Name < rs[j].Name
+	})
+	if len(rs) > max {
+		rs = rs[:max]
+	}
+	return rs
+}
+
+// dnsLogQuery selects the saved lookups after id, newest first
+func dnsLogQuery(id uint64, name, resolver, cache string, onlyErr bool, length int) *bolthold.Query {
+	q := bolthold.Where("ID").Gt(id)
+	if name != "" {
+		q = q.And("Name").RegExp(regexp.MustCompile(regexp.QuoteMeta(name)))
+	}
+	if resolver != "" {
+		q = q.And("Resolver").RegExp(regexp.MustCompile("^" + regexp.QuoteMeta(resolver)))
+	}
+	if cache != "" {
+		q = q.And("Cache").Eq(cache)
+	}
+	if onlyErr {
+		q = q.And("Err").Ne("")
+	}
+	return q.SortBy("ID").Reverse().Limit(length)
+}
+
+func (this *ui) runDNSLog() {
+	for range this.watcher.dnsNew {
+		this.saveDNSLog()
+	}
+}
+
+// saveDNSLog saves the pending lookups in one transaction
+func (this *ui) saveDNSLog() {
+	w := &this.watcher
+
+	w.dnsL.Lock()
+	ls := w.dnsLogs
+	w.dnsLogs = nil
+	w.dnsL.Unlock()
+
+	if len(ls) == 0 {
+		return
+	}
+
+	err := this.store.Bolt().Update(func(tx *bolt.Tx) error {
+		for _, t := range ls {
+			if err := this.store.TxInsert(tx, bolthold.NextSequence(), t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ss.Debug.Println("dnsLog save", err)
+	}
+}
+
+// 读取未命中缓存的DNS查询日志, 和启动以来查询次数最多的域名
+func (this *ui) apiDNSLog(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(r.FormValue("name"))
+	resolver := r.FormValue("resolver")
+	cache := r.FormValue("cache")
+	onlyErr := r.FormValue("err") == "1"
+
+	id, _ := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	length, _ := strconv.Atoi(r.FormValue("length"))
+	if length < 1 {
+		length = 100
+	}
+	top, _ := strconv.Atoi(r.FormValue("top"))
+	if top < 1 {
+		top = 10
+	}
+
+	rs := dnsLogList{Logs: make([]DNSLog, 0)}
+
+	err := this.store.Find(&rs.Logs, dnsLogQuery(id, name, resolver, cache, onlyErr, length))
+	if err != nil {
+		ss.Debug.Println("apiDNSLog", err)
+	}
+
+	rs.Top = this.watcher.topDNS(name, onlyErr, top)
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&rs)
+}
@@ -0,0 +1,151 @@
+package ui
+
+import (
+	"errors"
+	"fmt"
+	ss "sshProxy/shadowsocks"
+	"testing"
+	"time"
+
+	"github.com/bybzmt/bolthold"
+)
+
+func TestDNSLogSave(t *testing.T) {
+	u := newTestUI(t)
+	w := &u.watcher
+
+	lookups := []ss.DNSLog{
+		{Name: "a.example", Resolver: "local", Latency: 30 * time.Millisecond, Cache: "miss"},
+		{Name: "a.example", Resolver: "local", Latency: 0, Cache: "hit"},
+		{Name: "a.example", Resolver: "local", Latency: 0, Cache: "stale"},
+		{Name: "b.example", Resolver: "remote", Latency: 10 * time.Millisecond, Cache: "miss", Err: errors.New("timeout")},
+		{Name: "b.example", Resolver: "remote", Latency: 0, Cache: "negative", Err: errors.New("no such host")},
+		{Name: "c.example", Resolver: "system", Latency: 20 * time.Millisecond},
+	}
+	for i := range lookups {
+		w.OnDNSLog(&lookups[i])
+	}
+
+	u.saveDNSLog()
+
+	var ls []DNSLog
+	if err := u.store.Find(&ls, nil); err != nil {
+		t.Fatal(err)
+	}
+	//cached answers are only counted
+	if len(ls) != 3 {
+		t.Errorf("%d saved, want the 2 misses and the system lookup: %+v", len(ls), ls)
+	}
+	if len(w.dnsLogs) != 0 {
+		t.Errorf("%d left pending", len(w.dnsLogs))
+	}
+
+	top := w.topDNS("", false, 10)
+	want := []dnsLogTop{
+		{Name: "a.example", Count: 3, Misses: 1, Latency: 10},
+		{Name: "b.example", Count: 2, Misses: 1, Errors: 2, Latency: 5},
+		{Name: "c.example", Count: 1, Misses: 1, Latency: 20},
+	}
+	if fmt.Sprint(top) != fmt.Sprint(want) {
+		t.Errorf("top %+v\nwant %+v", top, want)
+	}
+
+	tests := []struct {
+		name    string
+		onlyErr bool
+		max     int
+		want    string
+	}{
+		{"", false, 1, "a.example"},
+		{"b.", false, 10, "b.example"},
+		{"", true, 10, "b.example"},
+		{"nothing", false, 10, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		for _, n := range w.topDNS(tt.name, tt.onlyErr, tt.max) {
+			got += n.Name
+		}
+		if got != tt.want {
+			t.Errorf("topDNS(%q, %v, %d) = %q, want %q", tt.name, tt.onlyErr, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestDNSLogPending(t *testing.T) {
+	u := newTestUI(t)
+	w := &u.watcher
+
+	//a stalled store keeps the newest ones
+	for i := 0; i < dnsLogKeep+10; i++ {
+		w.OnDNSLog(&ss.DNSLog{Name: fmt.Sprintf("n%d.example", i), Cache: "miss"})
+	}
+	if len(w.dnsLogs) != dnsLogKeep || w.dnsLogs[0].Name != "n10.example" {
+		t.Errorf("%d pending from %s", len(w.dnsLogs), w.dnsLogs[0].Name)
+	}
+
+	//names seen once make room for new ones
+	w.dnsTop = make(map[string]*dnsLogTop)
+	for i := 0; i < dnsTopMax; i++ {
+		w.OnDNSLog(&ss.DNSLog{Name: fmt.Sprintf("n%d.example", i), Cache: "hit"})
+	}
+	w.OnDNSLog(&ss.DNSLog{Name: "n0.example", Cache: "hit"})
+	w.OnDNSLog(&ss.DNSLog{Name: "new.example", Cache: "hit"})
+
+	if len(w.dnsTop) != 2 || w.dnsTop["n0.example"] == nil || w.dnsTop["new.example"] == nil {
+		t.Errorf("%d names counted after the limit", len(w.dnsTop))
+	}
+}
+
+func TestDNSLogQuery(t *testing.T) {
+	u := newTestUI(t)
+
+	logs := []DNSLog{
+		{Name: "a.example", Resolver: "local", Cache: "miss"},
+		{Name: "aaexample.com", Resolver: "local", Cache: "miss"},
+		{Name: "b.example", Resolver: "route example", Cache: "miss", Err: "timeout"},
+		{Name: "c.example", Resolver: "system"},
+		{Name: "a.example", Resolver: "remote", Cache: "miss"},
+	}
+	for i := range logs {
+		if err := u.store.Insert(bolthold.NextSequence(), &logs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		id       uint64
+		name     string
+		resolver string
+		cache    string
+		onlyErr  bool
+		length   int
+		want     []uint64
+	}{
+		{0, "", "", "", false, 100, []uint64{5, 4, 3, 2, 1}},
+		{0, "", "", "", false, 2, []uint64{5, 4}},
+		{3, "", "", "", false, 100, []uint64{5, 4}},
+		//a dot is no wildcard
+		{0, "a.", "", "", false, 100, []uint64{5, 1}},
+		{0, "", "route", "", false, 100, []uint64{3}},
+		{0, "", "ote", "", false, 100, nil},
+		{0, "", "", "miss", false, 100, []uint64{5, 3, 2, 1}},
+		{0, "", "", "", true, 100, []uint64{3}},
+		{0, "a.example", "local", "miss", false, 100, []uint64{1}},
+	}
+	for _, tt := range tests {
+		var ls []DNSLog
+		err := u.store.Find(&ls, dnsLogQuery(tt.id, tt.name, tt.resolver, tt.cache, tt.onlyErr, tt.length))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []uint64
+		for _, l := range ls {
+			got = append(got, l.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%+v: got %v", tt, got)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package ui
+
+import (
+	"encoding/json"
+	"net/http"
+	ss "sshProxy/shadowsocks"
+	"strconv"
+
+	"github.com/bybzmt/bolthold"
+)
+
+func (this *ui) initDNSRoutes(c *ss.Client) {
+	var rs []DNSRoute
+
+	err := this.store.Find(&rs, bolthold.Where("Enable").Eq(true))
+	if err != nil {
+		ss.Debug.Println("initDNSRoutes", err)
+	}
+
+	routes := make([]ss.DNSRoute, 0, len(rs))
+	for _, r := range rs {
+		routes = append(routes, ss.DNSRoute{Domain: r.Domain, DNS: r.DNS, Via: r.Via})
+	}
+
+	c.SetDNSRoutes(routes)
+}
+
+func dnsRouteForm(r *http.Request) (*DNSRoute, error) {
+	var rs DNSRoute
+
+	rs.ID, _ = strconv.ParseUint(r.FormValue("ID"), 10, 64)
+	rs.Domain = r.FormValue("Domain")
+	rs.DNS = r.FormValue("DNS")
+	rs.Via, _ = strconv.ParseUint(r.FormValue("Via"), 10, 64)
+	rs.Note = r.FormValue("Note")
+	rs.Enable = r.FormValue("Enable") == "1"
+
+	err := ss.CheckDNSRoute(ss.DNSRoute{Domain: rs.Domain, DNS: rs.DNS, Via: rs.Via})
+	return &rs, err
+}
+
+// 读取域名DNS列表
+func (this *ui) apiDNSRoutes(w http.ResponseWriter, r *http.Request) {
+	rs := make([]DNSRoute, 0)
+
+	err := this.store.Find(&rs, nil)
+	if err != nil {
+		ss.Debug.Println("apiDNSRoutes", err)
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&rs)
+}
+
+// 添加域名DNS
+func (this *ui) apiDNSRouteAdd(w http.ResponseWriter, r *http.Request) {
+	rs, err := dnsRouteForm(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	err = this.store.Insert(bolthold.NextSequence(), rs)
+	if err != nil {
+		ss.Debug.Println("apiDNSRouteAdd", err)
+	} else {
+		this.initDNSRoutes(this.client())
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// 修改域名DNS
+func (this *ui) apiDNSRouteEdit(w http.ResponseWriter, r *http.Request) {
+	rs, err := dnsRouteForm(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	err = this.store.Update(rs.ID, rs)
+	if err != nil {
+		ss.Debug.Println("apiDNSRouteEdit", err)
+	} else {
+		this.initDNSRoutes(this.client())
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// 删除域名DNS
+func (this *ui) apiDNSRouteDel(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseUint(r.FormValue("ID"), 10, 64)
+
+	err := this.store.Delete(id, DNSRoute{})
+	if err != nil {
+		ss.Debug.Println("apiDNSRouteDel", err)
+	}
+
+	this.initDNSRoutes(this.client())
+
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,128 @@
+package ui
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	ss "sshProxy/shadowsocks"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/bybzmt/bolthold"
+)
+
+var errStoreInUse = errors.New("database is in use, pass the --addr of the running clientUI")
+
+type RuleTest struct {
+	*ss.Explanation
+	//note of the matched rule
+	Note string
+}
+
+func (this *ui) ruleTest(c *ss.Client, addr, from string) (*RuleTest, error) {
+	e, err := c.Explain(addr, from)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &RuleTest{Explanation: e}
+
+	if e.Matched && e.RuleID != 0 {
+		var rs Rules
+		if err := this.store.Get(e.RuleID, &rs); err == nil {
+			t.Note = rs.Note
+		}
+	}
+
+	return t, nil
+}
+
+// 测试规则匹配
+func (this *ui) apiRuleTest(w http.ResponseWriter, r *http.Request) {
+	t, err := this.ruleTest(this.client(), r.FormValue("addr"), r.FormValue("from"))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(t)
+}
+
+// Explain asks the clientUI listening on cliAddr, with the web ui at
+// host, which route addr would take. When nothing listens there it
+// loads the client from the database file the way clientUI does.
+func Explain(file, cliAddr, host, addr, from string) (*RuleTest, error) {
+	conn, err := net.DialTimeout("tcp", cliAddr, time.Second)
+	if err != nil {
+		ss.Debug.Println("Explain", cliAddr, err)
+		return explainStore(file, addr, from)
+	}
+	conn.Close()
+
+	return explainRunning(cliAddr, host, addr, from)
+}
+
+// explainRunning queries /api/ruleTest through the socks listener, the
+// way the browser reaches the web ui
+func explainRunning(cliAddr, host, addr, from string) (*RuleTest, error) {
+	hc := http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(&url.URL{Scheme: "socks5", Host: cliAddr}),
+			DisableKeepAlives: true,
+		},
+	}
+
+	q := url.Values{"addr": {addr}, "from": {from}}
+	resp, err := hc.Get("http://" + host + "/api/ruleTest?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, errors.New(strings.TrimSpace(string(b)))
+	}
+
+	t := &RuleTest{}
+	if err := json.NewDecoder(resp.Body).Decode(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// explainStore loads the client from the database
+func explainStore(file, addr, from string) (*RuleTest, error) {
+	store, err := bolthold.Open(file, 0644, &bolthold.Options{
+		Options: &bolt.Options{
+			ReadOnly: true,
+			Timeout:  time.Second,
+		},
+	})
+	if err == bolt.ErrTimeout {
+		return nil, errStoreInUse
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	u := NewUI(file, "", "")
+	u.store = store
+	u.readOnly = true
+
+	u.initClient()
+	u.initServer()
+	u.initRules()
+	defer u.ssServer.Close()
+
+	return u.ruleTest(u.ssServer, addr, from)
+}
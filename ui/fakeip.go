@@ -0,0 +1,80 @@
+package ui
+
+import (
+	"log"
+	"net"
+	ss "sshProxy/shadowsocks"
+
+	"github.com/boltdb/bolt"
+	"github.com/bybzmt/bolthold"
+)
+
+const defaultFakeIPRange = "198.18.0.0/15"
+
+// initFakeIP enables fake ips and puts back the saved ones, so answers
+// given before a restart still work
+func (this *ui) initFakeIP(c *ss.Client, rs *ClientConfig) {
+	if rs.FakeIPRange == "" {
+		rs.FakeIPRange = defaultFakeIPRange
+	}
+
+	if err := c.SetFakeIP(rs.FakeIPRange, rs.FakeIPExclude); err != nil {
+		log.Println("FakeIP", err)
+		return
+	}
+
+	//in the order they were assigned, so the latest name of an address wins
+	var fs []FakeIP
+	err := this.store.Find(&fs, bolthold.Where("Name").Ne("").SortBy("Assigned"))
+	if err != nil {
+		ss.Debug.Println("initFakeIP", err)
+	}
+
+	for _, f := range fs {
+		if ip := net.ParseIP(f.IP); ip != nil {
+			c.RestoreFakeIP(ip, f.Name)
+		}
+	}
+}
+
+func (this *ui) runFakeIP() {
+	for range this.watcher.fakeNew {
+		this.saveFakeIPs()
+	}
+}
+
+// saveFakeIPs saves the pending fake ips in one transaction, they are
+// kept for the next save when it fails
+func (this *ui) saveFakeIPs() {
+	w := &this.watcher
+
+	w.fakeL.Lock()
+	fs := w.fakeIPs
+	w.fakeIPs = make(map[string]*FakeIP)
+	w.fakeL.Unlock()
+
+	if len(fs) == 0 {
+		return
+	}
+
+	err := this.store.Bolt().Update(func(tx *bolt.Tx) error {
+		for _, t := range fs {
+			if err := this.store.TxUpsert(tx, t.IP, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ss.Debug.Println("fakeIP save", err)
+
+		//unless assigned again meanwhile
+		w.fakeL.Lock()
+		for ip, t := range fs {
+			if _, ok := w.fakeIPs[ip]; !ok {
+				w.fakeIPs[ip] = t
+			}
+		}
+		w.fakeL.Unlock()
+	}
+}
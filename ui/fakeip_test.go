@@ -0,0 +1,70 @@
+package ui
+
+import (
+	"fmt"
+	"net"
+	ss "sshProxy/shadowsocks"
+	"testing"
+)
+
+func TestSaveFakeIPs(t *testing.T) {
+	u := newTestUI(t)
+
+	//many more than a channel would hold, none is lost
+	for i := 0; i < 3000; i++ {
+		ip := net.IPv4(10, 0, byte(i>>8), byte(i))
+		u.watcher.OnFakeIP(ip, fmt.Sprintf("n%d.example", i))
+	}
+	//the latest name of an address is saved
+	u.watcher.OnFakeIP(net.IPv4(10, 0, 0, 1), "again.example")
+
+	u.saveFakeIPs()
+
+	if n := len(u.watcher.fakeIPs); n != 0 {
+		t.Errorf("%d left pending", n)
+	}
+
+	var fs []FakeIP
+	if err := u.store.Find(&fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 3000 {
+		t.Errorf("%d saved, want 3000", len(fs))
+	}
+
+	var f FakeIP
+	if err := u.store.Get("10.0.0.1", &f); err != nil || f.Name != "again.example" {
+		t.Errorf("10.0.0.1 saved as %+v %v", f, err)
+	}
+}
+
+func TestInitFakeIP(t *testing.T) {
+	u := newTestUI(t)
+
+	u.watcher.OnFakeIP(net.IPv4(198, 18, 0, 1), "a.example")
+	u.watcher.OnFakeIP(net.IPv4(198, 18, 0, 2), "b.example")
+	//outside the range after a change of it
+	u.watcher.OnFakeIP(net.IPv4(10, 0, 0, 1), "c.example")
+	u.saveFakeIPs()
+
+	c := ss.NewClient("", 5, 5)
+	u.initFakeIP(c, &ClientConfig{FakeIP: true})
+
+	tests := []struct {
+		addr, want string
+	}{
+		{"198.18.0.1:443", "a.example:443"},
+		{"198.18.0.2:80", "b.example:80"},
+		{"10.0.0.1:80", "10.0.0.1:80"},
+	}
+	for _, tt := range tests {
+		e, err := c.Explain(tt.addr, "")
+		if err != nil || e.To != tt.want {
+			t.Errorf("%s: got %+v %v", tt.addr, e, err)
+		}
+	}
+
+	if _, err := c.Explain("198.18.0.3:80", ""); err != ss.ErrFakeIPUnknown {
+		t.Errorf("unsaved fake ip: %v", err)
+	}
+}
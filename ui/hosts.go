@@ -0,0 +1,35 @@
+package ui
+
+import (
+	ss "sshProxy/shadowsocks"
+)
+
+// initHosts sets the hosts of the active profile, then the ones of cfg
+// and its hosts file, earlier names win
+func (this *ui) initHosts(c *ss.Client, cfg *ClientConfig) {
+	var texts []string
+
+	var a ActiveProfile
+	if err := this.store.Get("ActiveProfile", &a); err == nil && a.ID != 0 {
+		var p Profile
+		if err := this.store.Get(a.ID, &p); err == nil {
+			texts = append(texts, p.Hosts)
+		}
+	}
+
+	texts = append(texts, cfg.Hosts)
+
+	if cfg.HostsFile != "" {
+		text, err := ss.LoadHostsFile(cfg.HostsFile)
+		if err != nil {
+			ss.Debug.Println("HostsFile", err)
+		}
+		texts = append(texts, text)
+	}
+
+	h := ss.ParseHosts(texts...)
+	if h.Len() == 0 {
+		h = nil
+	}
+	c.SetHosts(h)
+}
@@ -18,6 +18,9 @@ type ui_state struct {
 	ConnNum  int32
 	Incoming string
 	Outgoing string
+	//dns cache and upstream counters, nil when not set
+	LocalDNS  *ss.DNSStats
+	RemoteDNS *ss.DNSStats
 }
 
 func (this *ui) cross(fn http.HandlerFunc) http.HandlerFunc {
@@ -55,13 +58,15 @@ func (this *ui) cross(fn http.HandlerFunc) http.HandlerFunc {
 
 //读取状态
 func (this *ui) apiState(w http.ResponseWriter, r *http.Request) {
+	c := this.client()
+
 	this.l.Lock()
 	defer this.l.Unlock()
 
 	num := atomic.LoadInt32(&this.watcher.counter)
 
-	t := this.ssServer.Traffic.Clone()
-	this.ssServer.Traffic.Sub(&t)
+	t := c.Traffic.Clone()
+	c.Traffic.Sub(&t)
 
 	now := time.Now()
 	diff := now.Sub(this.now)
@@ -72,6 +77,7 @@ func (this *ui) apiState(w http.ResponseWriter, r *http.Request) {
 		Outgoing: FmtSize(diff, t.Incoming),
 		Incoming: FmtSize(diff, t.Outgoing),
 	}
+	s.LocalDNS, s.RemoteDNS = c.DNSStats()
 
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(&s)
@@ -118,6 +124,21 @@ func (this *ui) apiRules(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(&rs)
 }
 
+//检查规则的时间表和表达式
+func checkRules(rs *Rules) error {
+	loc, err := ss.ParseZone(rs.TimeZone)
+	if err != nil {
+		return err
+	}
+	if _, err := ss.ParseSchedule(rs.Days, rs.Times, loc); err != nil {
+		return err
+	}
+	if _, err := ss.CompileExpr(rs.Expr); err != nil {
+		return err
+	}
+	return nil
+}
+
 //添加规则
 func (this *ui) apiRuleAdd(w http.ResponseWriter, r *http.Request) {
 	var rs Rules
@@ -126,10 +147,26 @@ func (this *ui) apiRuleAdd(w http.ResponseWriter, r *http.Request) {
 	rs.Enable = r.FormValue("Enable") == "1"
 	rs.Items = r.FormValue("Items")
 	rs.Servers = r.FormValue("Servers")
+	rs.URL = r.FormValue("URL")
+	rs.Via = r.FormValue("Via")
+	rs.Interval, _ = strconv.Atoi(r.FormValue("Interval"))
+	rs.Resolve = r.FormValue("Resolve") == "1"
+	rs.Days = r.FormValue("Days")
+	rs.Times = r.FormValue("Times")
+	rs.TimeZone = r.FormValue("TimeZone")
+	rs.Expr = r.FormValue("Expr")
+
+	if err := checkRules(&rs); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
 	err := this.store.Insert(bolthold.NextSequence(), &rs)
 	if err != nil {
 		ss.Debug.Println("apiRuleAdd", err)
+	} else {
+		this.applyRule(&rs)
 	}
 
 	w.Write([]byte("ok"))
@@ -146,10 +183,26 @@ func (this *ui) apiRuleEdit(w http.ResponseWriter, r *http.Request) {
 	rs.Enable = r.FormValue("Enable") == "1"
 	rs.Items = r.FormValue("Items")
 	rs.Servers = r.FormValue("Servers")
+	rs.URL = r.FormValue("URL")
+	rs.Via = r.FormValue("Via")
+	rs.Interval, _ = strconv.Atoi(r.FormValue("Interval"))
+	rs.Resolve = r.FormValue("Resolve") == "1"
+	rs.Days = r.FormValue("Days")
+	rs.Times = r.FormValue("Times")
+	rs.TimeZone = r.FormValue("TimeZone")
+	rs.Expr = r.FormValue("Expr")
+
+	if err := checkRules(&rs); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
 	err := this.store.Update(rs.ID, rs)
 	if err != nil {
 		ss.Debug.Println("apiRuleEdit", err)
+	} else {
+		this.applyRule(&rs)
 	}
 
 	w.Write([]byte("ok"))
@@ -167,9 +220,81 @@ func (this *ui) apiRuleDel(w http.ResponseWriter, r *http.Request) {
 		ss.Debug.Println("apiRuleDel", err)
 	}
 
+	this.client().RemoveRules(rs.ID)
+
+	err = this.store.Delete(rs.ID, RuleList{})
+	if err != nil && err != bolthold.ErrNotFound {
+		ss.Debug.Println("apiRuleDel RuleList", err)
+	}
+
+	w.Write([]byte("ok"))
+}
+
+//读取远程规则列表状态
+func (this *ui) apiRuleLists(w http.ResponseWriter, r *http.Request) {
+	rs := make([]RuleList, 0)
+
+	err := this.store.Find(&rs, nil)
+	if err != nil {
+		ss.Debug.Println("apiRuleLists", err)
+	}
+
+	for i := range rs {
+		rs[i].Body = ""
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&rs)
+}
+
+//立即刷新远程规则列表
+func (this *ui) apiRuleListRefresh(w http.ResponseWriter, r *http.Request) {
+	var rs Rules
+
+	id, _ := strconv.Atoi(r.FormValue("ID"))
+
+	err := this.store.Get(uint64(id), &rs)
+	if err != nil {
+		ss.Debug.Println("apiRuleListRefresh", err)
+	} else if rs.Enable && rs.URL != "" {
+		this.refreshRuleList(&rs, true)
+	}
+
 	w.Write([]byte("ok"))
 }
 
+//读取或切换路由模式, 已建立的连接不受影响
+func (this *ui) apiMode(w http.ResponseWriter, r *http.Request) {
+	c := this.client()
+
+	if r.Method == "POST" {
+		var rs ModeConfig
+		rs.Mode = r.FormValue("Mode")
+		rs.Servers = r.FormValue("Servers")
+
+		mode, err := ss.ParseMode(rs.Mode)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		err = this.store.Upsert("Mode", &rs)
+		if err != nil {
+			ss.Debug.Println("apiMode", err)
+		}
+
+		c.SetMode(mode, rs.Servers)
+	}
+
+	mode, ids := c.Mode()
+
+	rs := ModeConfig{Mode: mode.String(), Servers: joinIds(ids)}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&rs)
+}
+
 //读取配置
 func (this *ui) apiClientConfig(w http.ResponseWriter, r *http.Request) {
 	var rs ClientConfig
@@ -193,6 +318,28 @@ func (this *ui) apiClientConfigSave(w http.ResponseWriter, r *http.Request) {
 	rs.LDNSEnable = r.FormValue("LDNSEnable") == "1"
 	rs.RDNS = r.FormValue("RDNS")
 	rs.RDNSEnable = r.FormValue("RDNSEnable") == "1"
+	rs.GeoIP = r.FormValue("GeoIP")
+	rs.ACL = r.FormValue("ACL")
+	rs.Auto = r.FormValue("Auto") == "1"
+	rs.AutoServer = r.FormValue("AutoServer")
+	rs.AutoWindow, _ = strconv.Atoi(r.FormValue("AutoWindow"))
+	rs.AutoExpire, _ = strconv.Atoi(r.FormValue("AutoExpire"))
+	rs.Sniff = r.FormValue("Sniff") == "1"
+	rs.SniffTimeout, _ = strconv.Atoi(r.FormValue("SniffTimeout"))
+	rs.DNSListen = r.FormValue("DNSListen")
+	rs.DNSMinTTL, _ = strconv.Atoi(r.FormValue("DNSMinTTL"))
+	rs.DNSMaxTTL, _ = strconv.Atoi(r.FormValue("DNSMaxTTL"))
+	rs.DNSNegTTL, _ = strconv.Atoi(r.FormValue("DNSNegTTL"))
+	rs.DNSStale, _ = strconv.Atoi(r.FormValue("DNSStale"))
+	rs.DNSStrategy = r.FormValue("DNSStrategy")
+	rs.DNSTimeout, _ = strconv.Atoi(r.FormValue("DNSTimeout"))
+	rs.Hosts = r.FormValue("Hosts")
+	rs.HostsFile = r.FormValue("HostsFile")
+	rs.FakeIP = r.FormValue("FakeIP") == "1"
+	rs.FakeIPRange = r.FormValue("FakeIPRange")
+	rs.FakeIPExclude = r.FormValue("FakeIPExclude")
+	rs.IPPref = r.FormValue("IPPref")
+	rs.DNSPersist = r.FormValue("DNSPersist") == "1"
 
 	err := this.store.Upsert("ClientConfig", &rs)
 	if err != nil {
@@ -228,6 +375,8 @@ func (this *ui) apiServerConfigAdd(w http.ResponseWriter, r *http.Request) {
 	err := this.store.Insert(bolthold.NextSequence(), &rs)
 	if err != nil {
 		ss.Debug.Println("apiServerConfigAdd", err)
+	} else {
+		this.applyServer(&rs)
 	}
 
 	w.Write([]byte("ok"))
@@ -249,6 +398,8 @@ func (this *ui) apiServerConfigEdit(w http.ResponseWriter, r *http.Request) {
 	err := this.store.Update(rs.ID, rs)
 	if err != nil {
 		ss.Debug.Println("apiServerConfigEdit", err)
+	} else {
+		this.applyServer(&rs)
 	}
 
 	w.Write([]byte("ok"))
@@ -265,6 +416,8 @@ func (this *ui) apiServerConfigDel(w http.ResponseWriter, r *http.Request) {
 		ss.Debug.Println("apiServerConfigDel", err)
 	}
 
+	this.client().RemoveServer(rs.ID)
+
 	w.Write([]byte("ok"))
 }
 
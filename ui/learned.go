@@ -0,0 +1,127 @@
+package ui
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	ss "sshProxy/shadowsocks"
+	"strconv"
+	"time"
+
+	"github.com/bybzmt/bolthold"
+)
+
+func (this *ui) initAuto(c *ss.Client, rs *ClientConfig) {
+	id, err := strconv.ParseUint(rs.AutoServer, 10, 64)
+	if err != nil {
+		ss.Debug.Println("AutoServer", err)
+		return
+	}
+	if rs.AutoWindow < 1 {
+		rs.AutoWindow = 500
+	}
+	if rs.AutoExpire < 1 {
+		rs.AutoExpire = 24
+	}
+
+	c.SetAuto(id, time.Duration(rs.AutoWindow)*time.Millisecond, time.Duration(rs.AutoExpire)*time.Hour)
+
+	var ls []Learned
+	err = this.store.Find(&ls, bolthold.Where("Expire").Gt(time.Now()))
+	if err != nil {
+		ss.Debug.Println("initAuto", err)
+	}
+
+	for _, l := range ls {
+		c.Learn(l.Host, l.Expire)
+	}
+}
+
+func (this *ui) runLearned() {
+	c := time.Tick(10 * time.Minute)
+
+	for {
+		select {
+		case t := <-this.watcher.learned:
+			var l Learned
+			if err := this.store.Get(t.Host, &l); err == nil {
+				t.Hits = l.Hits
+			}
+			t.Hits++
+
+			err := this.store.Upsert(t.Host, t)
+			if err != nil {
+				ss.Debug.Println("learned save", err)
+			}
+		case <-c:
+			err := this.store.DeleteMatching(Learned{}, bolthold.Where("Expire").Lt(time.Now()))
+			if err != nil {
+				ss.Debug.Println("learned gc", err)
+			}
+		}
+	}
+}
+
+// 读取自动学习列表
+func (this *ui) apiLearned(w http.ResponseWriter, r *http.Request) {
+	rs := make([]Learned, 0)
+
+	err := this.store.Find(&rs, bolthold.Where("Expire").Gt(time.Now()).SortBy("Expire").Reverse())
+	if err != nil {
+		ss.Debug.Println("apiLearned", err)
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&rs)
+}
+
+// 删除自动学习
+func (this *ui) apiLearnedDel(w http.ResponseWriter, r *http.Request) {
+	host := r.FormValue("Host")
+
+	err := this.store.Delete(host, Learned{})
+	if err != nil {
+		ss.Debug.Println("apiLearnedDel", err)
+	}
+
+	this.client().Forget(host)
+
+	w.Write([]byte("ok"))
+}
+
+// 自动学习转为规则
+func (this *ui) apiLearnedPromote(w http.ResponseWriter, r *http.Request) {
+	host := r.FormValue("Host")
+
+	var cfg ClientConfig
+	err := this.store.Get("ClientConfig", &cfg)
+	if err != nil {
+		ss.Debug.Println("apiLearnedPromote", err)
+	}
+
+	rs := Rules{
+		Note:    "learned " + host,
+		Enable:  true,
+		Items:   "full:" + host,
+		Servers: cfg.AutoServer,
+	}
+	if net.ParseIP(host) != nil {
+		rs.Items = host
+	}
+
+	err = this.store.Insert(bolthold.NextSequence(), &rs)
+	if err != nil {
+		ss.Debug.Println("apiLearnedPromote", err)
+		w.Write([]byte("ok"))
+		return
+	}
+	this.applyRule(&rs)
+
+	err = this.store.Delete(host, Learned{})
+	if err != nil {
+		ss.Debug.Println("apiLearnedPromote", err)
+	}
+	this.client().Forget(host)
+
+	w.Write([]byte("ok"))
+}
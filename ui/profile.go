@@ -0,0 +1,549 @@
+package ui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	ss "sshProxy/shadowsocks"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/bybzmt/bolthold"
+)
+
+var errProfileEmpty = errors.New("empty profile")
+var errProfilePasswd = errors.New("server exported without password is not found")
+
+type profileList struct {
+	Active   uint64
+	Profiles []Profile
+}
+
+func joinIds(ids []uint64) string {
+	s := ""
+	for i, id := range ids {
+		if i > 0 {
+			s += ","
+		}
+		s += strconv.FormatUint(id, 10)
+	}
+	return s
+}
+
+func idSet(ids string) map[uint64]bool {
+	m := make(map[uint64]bool)
+	for _, t := range ss.StrSplit(ids) {
+		if id, err := strconv.ParseUint(t, 10, 64); err == nil {
+			m[id] = true
+		}
+	}
+	return m
+}
+
+// mapIds renames ids with m, ids not in m are dropped
+func mapIds(ids string, m map[uint64]uint64) string {
+	var t []uint64
+	for _, s := range ss.StrSplit(ids) {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			continue
+		}
+		if n, ok := m[id]; ok {
+			t = append(t, n)
+		}
+	}
+	return joinIds(t)
+}
+
+// currentProfile fills p with the settings in use
+func (this *ui) currentProfile(p *Profile) error {
+	var rs []Rules
+	err := this.store.Find(&rs, bolthold.Where("Enable").Eq(true))
+	if err != nil {
+		return err
+	}
+
+	var ids []uint64
+	for _, r := range rs {
+		ids = append(ids, r.ID)
+	}
+	p.Rules = joinIds(ids)
+
+	var servers []ServerConfig
+	err = this.store.Find(&servers, bolthold.Where("Enable").Eq(true))
+	if err != nil {
+		return err
+	}
+
+	ids = nil
+	for _, s := range servers {
+		ids = append(ids, s.ID)
+	}
+	p.Servers = joinIds(ids)
+
+	var cfg ClientConfig
+	err = this.store.Get("ClientConfig", &cfg)
+	if err != nil && err != bolthold.ErrNotFound {
+		return err
+	}
+	p.LDNS = cfg.LDNS
+	p.LDNSEnable = cfg.LDNSEnable
+	p.RDNS = cfg.RDNS
+	p.RDNSEnable = cfg.RDNSEnable
+
+	err = this.store.Get("Mode", &p.Mode)
+	if err != nil && err != bolthold.ErrNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// switchProfile saves the settings of p as the ones in use and applies
+// them to the running client, established connections are kept. The
+// store is written in one transaction so a failure changes nothing.
+func (this *ui) switchProfile(p *Profile) error {
+	var changed []ServerConfig
+	var rs []Rules
+	var cfg ClientConfig
+
+	err := this.store.Bolt().Update(func(tx *bolt.Tx) error {
+		var servers []ServerConfig
+		err := this.store.TxFind(tx, &servers, nil)
+		if err != nil {
+			return err
+		}
+
+		enabled := idSet(p.Servers)
+		for i := range servers {
+			s := &servers[i]
+			if s.Enable == enabled[s.ID] {
+				continue
+			}
+			s.Enable = enabled[s.ID]
+
+			if err := this.store.TxUpdate(tx, s.ID, s); err != nil {
+				return err
+			}
+			changed = append(changed, *s)
+		}
+
+		err = this.store.TxFind(tx, &rs, nil)
+		if err != nil {
+			return err
+		}
+
+		enabled = idSet(p.Rules)
+		for i := range rs {
+			r := &rs[i]
+			if r.Enable == enabled[r.ID] {
+				continue
+			}
+			r.Enable = enabled[r.ID]
+
+			if err := this.store.TxUpdate(tx, r.ID, r); err != nil {
+				return err
+			}
+		}
+
+		err = this.store.TxGet(tx, "ClientConfig", &cfg)
+		if err != nil && err != bolthold.ErrNotFound {
+			return err
+		}
+		cfg.LDNS = p.LDNS
+		cfg.LDNSEnable = p.LDNSEnable
+		cfg.RDNS = p.RDNS
+		cfg.RDNSEnable = p.RDNSEnable
+
+		err = this.store.TxUpsert(tx, "ClientConfig", &cfg)
+		if err != nil {
+			return err
+		}
+
+		err = this.store.TxUpsert(tx, "Mode", &p.Mode)
+		if err != nil {
+			return err
+		}
+
+		return this.store.TxUpsert(tx, "ActiveProfile", &ActiveProfile{ID: p.ID})
+	})
+	if err != nil {
+		return err
+	}
+
+	c := this.client()
+
+	//servers first, so the rules find them
+	for i := range changed {
+		this.applyServer(&changed[i])
+	}
+
+	var rules []*ss.Rules
+	for i := range rs {
+		r := &rs[i]
+		if !r.Enable {
+			continue
+		}
+
+		rules = append(rules, newRules(r, this.ruleItems(r)))
+
+		if r.URL != "" {
+			go this.refreshRuleList(r, false)
+		}
+	}
+	c.ReplaceRules(rules)
+
+	if cfg.LDNSEnable {
+		c.SetLocalDNS(cfg.LDNS)
+	} else {
+		c.SetLocalDNS("")
+	}
+	if cfg.RDNSEnable {
+		c.SetRemoteDNS(cfg.RDNS)
+	} else {
+		c.SetRemoteDNS("")
+	}
+
+	mode, _ := ss.ParseMode(p.Mode.Mode)
+	c.SetMode(mode, p.Mode.Servers)
+
+	this.initHosts(c, &cfg)
+
+	return nil
+}
+
+// exportProfile bundles p with its rules and the servers they use, the
+// server passwords only when secrets is set as exports are shared
+func (this *ui) exportProfile(p *Profile, secrets bool) (*ProfileExport, error) {
+	t := &ProfileExport{Profile: *p, Secrets: secrets}
+
+	servers := idSet(p.Servers)
+	for id := range idSet(p.Mode.Servers) {
+		servers[id] = true
+	}
+
+	for id := range idSet(p.Rules) {
+		var r Rules
+		err := this.store.Get(id, &r)
+		if err == bolthold.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for id := range idSet(r.Servers) {
+			servers[id] = true
+		}
+		for id := range idSet(r.Via) {
+			servers[id] = true
+		}
+
+		t.Rules = append(t.Rules, r)
+	}
+
+	for id := range servers {
+		var s ServerConfig
+		err := this.store.Get(id, &s)
+		if err == bolthold.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !secrets {
+			s.Passwd = ""
+		}
+		t.Servers = append(t.Servers, s)
+	}
+
+	return t, nil
+}
+
+// sameRule tells if the rules differ only in their id and switch
+func sameRule(a, b *Rules) bool {
+	x, y := *a, *b
+	x.ID, y.ID = 0, 0
+	x.Enable, y.Enable = false, false
+	return x == y
+}
+
+// importProfile adds an exported profile, rules and servers equal to
+// existing ones are reused instead of added twice. A server exported
+// without its password is the existing one of the same address and user,
+// the import fails when there is none.
+func (this *ui) importProfile(t *ProfileExport) (*Profile, error) {
+	if t.Profile.Name == "" {
+		return nil, errProfileEmpty
+	}
+
+	//before anything is stored, like the rule api does
+	for i := range t.Rules {
+		if err := checkRules(&t.Rules[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	p := t.Profile
+
+	err := this.store.Bolt().Update(func(tx *bolt.Tx) error {
+		var servers []ServerConfig
+		err := this.store.TxFind(tx, &servers, nil)
+		if err != nil {
+			return err
+		}
+
+		sm := make(map[uint64]uint64)
+		for _, s := range t.Servers {
+			old := s.ID
+
+			for _, e := range servers {
+				if e.Addr == s.Addr && e.Cipher == s.Cipher && e.User == s.User && (s.Passwd == "" && !t.Secrets || e.Passwd == s.Passwd) {
+					sm[old] = e.ID
+					break
+				}
+			}
+			if _, ok := sm[old]; ok {
+				continue
+			}
+
+			if s.Passwd == "" && !t.Secrets {
+				return fmt.Errorf("%w: %s", errProfilePasswd, s.Addr)
+			}
+
+			//enabled when the profile is switched to
+			s.ID = 0
+			s.Enable = false
+			if err := this.store.TxInsert(tx, bolthold.NextSequence(), &s); err != nil {
+				return err
+			}
+			sm[old] = s.ID
+		}
+
+		var rs []Rules
+		err = this.store.TxFind(tx, &rs, nil)
+		if err != nil {
+			return err
+		}
+
+		rm := make(map[uint64]uint64)
+		for _, r := range t.Rules {
+			old := r.ID
+
+			r.Servers = mapIds(r.Servers, sm)
+			if r.Via != "" {
+				r.Via = mapIds(r.Via, sm)
+			}
+
+			for i := range rs {
+				if sameRule(&rs[i], &r) {
+					rm[old] = rs[i].ID
+					break
+				}
+			}
+			if _, ok := rm[old]; ok {
+				continue
+			}
+
+			r.ID = 0
+			r.Enable = false
+			if err := this.store.TxInsert(tx, bolthold.NextSequence(), &r); err != nil {
+				return err
+			}
+			rm[old] = r.ID
+		}
+
+		p.ID = 0
+		p.Rules = mapIds(p.Rules, rm)
+		p.Servers = mapIds(p.Servers, sm)
+		p.Mode.Servers = mapIds(p.Mode.Servers, sm)
+
+		return this.store.TxInsert(tx, bolthold.NextSequence(), &p)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func (this *ui) getProfile(r *http.Request) (*Profile, error) {
+	id, _ := strconv.ParseUint(r.FormValue("ID"), 10, 64)
+
+	var p Profile
+	if err := this.store.Get(id, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	w.WriteHeader(400)
+	w.Write([]byte(err.Error()))
+}
+
+// 读取配置方案列表
+func (this *ui) apiProfiles(w http.ResponseWriter, r *http.Request) {
+	rs := profileList{Profiles: make([]Profile, 0)}
+
+	err := this.store.Find(&rs.Profiles, nil)
+	if err != nil {
+		ss.Debug.Println("apiProfiles", err)
+	}
+
+	var a ActiveProfile
+	if err := this.store.Get("ActiveProfile", &a); err == nil {
+		rs.Active = a.ID
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&rs)
+}
+
+// 以当前设置添加配置方案
+func (this *ui) apiProfileAdd(w http.ResponseWriter, r *http.Request) {
+	p := Profile{Name: r.FormValue("Name")}
+	if p.Name == "" {
+		httpError(w, errProfileEmpty)
+		return
+	}
+
+	err := this.currentProfile(&p)
+	if err == nil {
+		err = this.store.Insert(bolthold.NextSequence(), &p)
+	}
+	if err != nil {
+		ss.Debug.Println("apiProfileAdd", err)
+		httpError(w, err)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// 以当前设置覆盖配置方案
+func (this *ui) apiProfileSave(w http.ResponseWriter, r *http.Request) {
+	p, err := this.getProfile(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	if name := r.FormValue("Name"); name != "" {
+		p.Name = name
+	}
+
+	err = this.currentProfile(p)
+	if err == nil {
+		err = this.store.Update(p.ID, p)
+	}
+	if err != nil {
+		ss.Debug.Println("apiProfileSave", err)
+		httpError(w, err)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// 删除配置方案
+func (this *ui) apiProfileDel(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseUint(r.FormValue("ID"), 10, 64)
+
+	err := this.store.Delete(id, Profile{})
+	if err != nil {
+		ss.Debug.Println("apiProfileDel", err)
+	}
+
+	var a ActiveProfile
+	if err := this.store.Get("ActiveProfile", &a); err == nil && a.ID == id {
+		this.store.Upsert("ActiveProfile", &ActiveProfile{})
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// 切换配置方案, 不需要重启
+func (this *ui) apiProfileSwitch(w http.ResponseWriter, r *http.Request) {
+	p, err := this.getProfile(r)
+	if err == nil {
+		err = this.switchProfile(p)
+	}
+	if err != nil {
+		ss.Debug.Println("apiProfileSwitch", err)
+		httpError(w, err)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// 修改配置方案的hosts
+func (this *ui) apiProfileHosts(w http.ResponseWriter, r *http.Request) {
+	p, err := this.getProfile(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	p.Hosts = r.FormValue("Hosts")
+
+	err = this.store.Update(p.ID, p)
+	if err != nil {
+		ss.Debug.Println("apiProfileHosts", err)
+		httpError(w, err)
+		return
+	}
+
+	var a ActiveProfile
+	if err := this.store.Get("ActiveProfile", &a); err == nil && a.ID == p.ID {
+		var cfg ClientConfig
+		this.store.Get("ClientConfig", &cfg)
+		this.initHosts(this.client(), &cfg)
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// 导出配置方案
+func (this *ui) apiProfileExport(w http.ResponseWriter, r *http.Request) {
+	p, err := this.getProfile(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	t, err := this.exportProfile(p, r.FormValue("Secrets") == "1")
+	if err != nil {
+		ss.Debug.Println("apiProfileExport", err)
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.Header().Add("Content-Disposition", "attachment; filename=\"profile-"+strconv.FormatUint(p.ID, 10)+".json\"")
+	json.NewEncoder(w).Encode(t)
+}
+
+// 导入配置方案
+func (this *ui) apiProfileImport(w http.ResponseWriter, r *http.Request) {
+	var t ProfileExport
+
+	err := json.Unmarshal([]byte(r.FormValue("Data")), &t)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	p, err := this.importProfile(&t)
+	if err != nil {
+		ss.Debug.Println("apiProfileImport", err)
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(p)
+}
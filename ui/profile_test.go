@@ -0,0 +1,204 @@
+package ui
+
+import (
+	"errors"
+	ss "sshProxy/shadowsocks"
+	"testing"
+
+	"github.com/bybzmt/bolthold"
+)
+
+// profileUI stores two servers, two rules and a profile using the first
+// of each, ids count per type so both are 1 and 2
+func profileUI(t *testing.T) (*ui, *Profile) {
+	u := newTestUI(t)
+	u.ssServer = ss.NewClient("", 5, 5)
+
+	items := []interface{}{
+		&ServerConfig{Addr: "1.1.1.1:1080", Cipher: "SOCKS5", User: "u", Passwd: "secret", Enable: true},
+		&ServerConfig{Addr: "2.2.2.2:22", Cipher: "SSH(Password)", User: "u", Passwd: "other"},
+		&Rules{Items: "a.example", Servers: "1", Expr: "port == 443", Enable: true},
+		&Rules{Items: "b.example", Servers: "2"},
+	}
+	for _, v := range items {
+		if err := u.store.Insert(bolthold.NextSequence(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &Profile{Name: "home", Rules: "1", Servers: "1", LDNS: "8.8.8.8:53", LDNSEnable: true, Mode: ModeConfig{Mode: "global", Servers: "1"}}
+	if err := u.store.Insert(bolthold.NextSequence(), p); err != nil {
+		t.Fatal(err)
+	}
+	return u, p
+}
+
+func TestExportProfile(t *testing.T) {
+	u, p := profileUI(t)
+
+	for _, secrets := range []bool{false, true} {
+		e, err := u.exportProfile(p, secrets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Secrets != secrets || e.Profile.Name != "home" {
+			t.Errorf("secrets %v: exported %+v", secrets, e.Profile)
+		}
+		if len(e.Rules) != 1 || e.Rules[0].Items != "a.example" {
+			t.Errorf("secrets %v: rules %+v", secrets, e.Rules)
+		}
+		if len(e.Servers) != 1 || e.Servers[0].Addr != "1.1.1.1:1080" {
+			t.Fatalf("secrets %v: servers %+v", secrets, e.Servers)
+		}
+
+		want := ""
+		if secrets {
+			want = "secret"
+		}
+		if e.Servers[0].Passwd != want {
+			t.Errorf("secrets %v: password %q", secrets, e.Servers[0].Passwd)
+		}
+	}
+}
+
+func count(t *testing.T, u *ui, v interface{}) int {
+	var n int
+	var err error
+
+	switch v.(type) {
+	case ServerConfig:
+		var l []ServerConfig
+		err = u.store.Find(&l, nil)
+		n = len(l)
+	case Rules:
+		var l []Rules
+		err = u.store.Find(&l, nil)
+		n = len(l)
+	case Profile:
+		var l []Profile
+		err = u.store.Find(&l, nil)
+		n = len(l)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestImportProfile(t *testing.T) {
+	u, p := profileUI(t)
+
+	e, err := u.exportProfile(p, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//everything equal is reused, only the profile is added
+	n, err := u.importProfile(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Rules != "1" || n.Servers != "1" || n.Mode.Servers != "1" {
+		t.Errorf("reimported as %+v", n)
+	}
+	if count(t, u, ServerConfig{}) != 2 || count(t, u, Rules{}) != 2 || count(t, u, Profile{}) != 2 {
+		t.Errorf("reimport added servers or rules")
+	}
+
+	//a rule differing in any field is added, not replaced by the local one
+	e.Rules[0].Expr = "port == 80"
+	n, err = u.importProfile(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Rules
+	if err := u.store.Get(idOf(t, n.Rules), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.ID == 1 || r.Expr != "port == 80" || r.Enable {
+		t.Errorf("changed rule imported as %+v", r)
+	}
+
+	//an unknown server without its password fails and stores nothing
+	e.Servers[0].Addr = "3.3.3.3:1080"
+	before := count(t, u, Rules{})
+	_, err = u.importProfile(e)
+	if !errors.Is(err, errProfilePasswd) {
+		t.Errorf("passwordless server: %v", err)
+	}
+	if count(t, u, ServerConfig{}) != 2 || count(t, u, Rules{}) != before || count(t, u, Profile{}) != 3 {
+		t.Errorf("failed import stored something")
+	}
+
+	//with secrets it is added, disabled until switched to
+	e.Secrets = true
+	e.Servers[0].Passwd = "new"
+	n, err = u.importProfile(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s ServerConfig
+	if err := u.store.Get(idOf(t, n.Servers), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Addr != "3.3.3.3:1080" || s.Passwd != "new" || s.Enable {
+		t.Errorf("new server imported as %+v", s)
+	}
+	if n.Mode.Servers != n.Servers {
+		t.Errorf("mode servers %q, want %q", n.Mode.Servers, n.Servers)
+	}
+}
+
+func idOf(t *testing.T, ids string) uint64 {
+	for id := range idSet(ids) {
+		return id
+	}
+	t.Fatalf("no id in %q", ids)
+	return 0
+}
+
+func TestSwitchProfile(t *testing.T) {
+	u, _ := profileUI(t)
+
+	p := &Profile{ID: 9, Rules: "2", Servers: "2", RDNS: "1.1.1.1:53", RDNSEnable: true, Mode: ModeConfig{Mode: "direct"}}
+	if err := u.switchProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	var servers []ServerConfig
+	if err := u.store.Find(&servers, nil); err != nil {
+		t.Fatal(err)
+	}
+	var rs []Rules
+	if err := u.store.Find(&rs, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		if s.Enable != (s.ID == 2) {
+			t.Errorf("server %d enabled %v", s.ID, s.Enable)
+		}
+	}
+	for _, r := range rs {
+		if r.Enable != (r.ID == 2) {
+			t.Errorf("rule %d enabled %v", r.ID, r.Enable)
+		}
+	}
+
+	var cfg ClientConfig
+	if err := u.store.Get("ClientConfig", &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LDNSEnable || !cfg.RDNSEnable || cfg.RDNS != "1.1.1.1:53" {
+		t.Errorf("dns saved as %+v", cfg)
+	}
+
+	var a ActiveProfile
+	if err := u.store.Get("ActiveProfile", &a); err != nil || a.ID != 9 {
+		t.Errorf("active profile %d %v", a.ID, err)
+	}
+
+	if m, _ := u.client().Mode(); m != ss.ModeDirect {
+		t.Errorf("client mode %v", m)
+	}
+}
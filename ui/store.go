@@ -11,6 +11,12 @@ type LogMsg struct {
 	From  string
 	To    string
 	Msg   string
+	//country of the destination when a GEOIP rule was evaluated
+	Country string
+	//local program that opened the connection
+	Process string
+	//server name sniffed from an ip destination
+	Sniffed string
 }
 
 type ClientConfig struct {
@@ -21,6 +27,47 @@ type ClientConfig struct {
 	LDNSEnable  bool
 	RDNS        string
 	RDNSEnable  bool
+	//MaxMind .mmdb file for GEOIP rules
+	GeoIP string
+	//allowed client ips or cidrs, empty allows all
+	ACL string
+	//auto mode: retry failed direct hosts through AutoServer
+	Auto       bool
+	AutoServer string
+	//ms after connect a reset counts as blocked
+	AutoWindow int
+	//hours a learned host goes through AutoServer
+	AutoExpire int
+	//read the TLS SNI or HTTP Host of ip destinations for rule matching
+	Sniff bool
+	//ms to wait for the first client bytes
+	SniffTimeout int
+	//udp and tcp addr:port of the dns inbound, empty is disabled
+	DNSListen string
+	//seconds, clamps of the record ttl, 0 is the default
+	DNSMinTTL int
+	DNSMaxTTL int
+	//seconds NXDOMAIN answers are kept
+	DNSNegTTL int
+	//seconds an expired answer is served while refreshed
+	DNSStale int
+	//sequential, race or health, how the dns servers are asked
+	DNSStrategy string
+	//ms one dns server is waited for, 0 is 5000
+	DNSTimeout int
+	//hosts file format entries, asked before the dns
+	Hosts string
+	//hosts file loaded after Hosts, like /etc/hosts
+	HostsFile string
+	//the dns inbound answers with addresses of FakeIPRange
+	FakeIP      bool
+	FakeIPRange string
+	//domains answered with real addresses
+	FakeIPExclude string
+	//ipv6, ipv4 or ipv4only, the family resolved addresses are tried first
+	IPPref string
+	//save the dns cache and load it stale at start
+	DNSPersist bool
 }
 
 type ServerConfig struct {
@@ -39,4 +86,118 @@ type Rules struct {
 	Enable  bool
 	Items   string
 	Servers string
+	//remote rule list, used instead of Items when not empty
+	URL string
+	//server id the list is fetched through, empty is direct
+	Via string
+	//refresh interval in minutes
+	Interval int
+	//match ip rules against local resolved addresses of domains
+	Resolve bool
+	//optional schedule: days like mon-fri, times like 22:00-06:00
+	//and the time zone they are in, empty is local time
+	Days     string
+	Times    string
+	TimeZone string
+	//boolean expression matched as well, e.g. port in (22, 3306)
+	Expr string
+}
+
+// last good copy of a remote rule list
+type RuleList struct {
+	ID           uint64 `bolthold:"key"`
+	URL          string
+	ETag         string
+	LastModified string
+	Body         string
+	Checked      time.Time
+	Msg          string
+}
+
+// routing mode, kept apart from ClientConfig as it changes without a restart
+type ModeConfig struct {
+	//rule, global or direct
+	Mode string
+	//servers of global mode, empty means all
+	Servers string
+}
+
+// named set of enabled rules, servers, dns settings and mode
+type Profile struct {
+	ID   uint64 `bolthold:"key"`
+	Name string
+	//comma separated ids of the enabled rules and servers
+	Rules      string
+	Servers    string
+	LDNS       string
+	LDNSEnable bool
+	RDNS       string
+	RDNSEnable bool
+	Mode       ModeConfig
+	//hosts entries over the ones of ClientConfig while active
+	Hosts string
+}
+
+type ActiveProfile struct {
+	ID uint64
+}
+
+// a profile with the rules and servers it uses, to share it
+type ProfileExport struct {
+	Profile Profile
+	Rules   []Rules
+	Servers []ServerConfig
+	//server passwords are included
+	Secrets bool
+}
+
+// dns servers of a domain and its subdomains
+type DNSRoute struct {
+	ID     uint64 `bolthold:"key"`
+	Domain string
+	DNS    string
+	//server the dns is reached through, 0 is direct
+	Via    uint64
+	Note   string
+	Enable bool
+}
+
+// a domain lookup
+type DNSLog struct {
+	ID   uint64 `bolthold:"key"`
+	Now  time.Time
+	Name string
+	//local, remote, route <domain> or system
+	Resolver string
+	IPs      string
+	//ms
+	Latency float64
+	//hit, negative, stale or miss
+	Cache string
+	Err   string
+}
+
+// name given a fake ip by the dns inbound
+type FakeIP struct {
+	IP       string `bolthold:"key"`
+	Name     string
+	Assigned time.Time
+}
+
+// cached dns answer saved across restarts
+type DNSCache struct {
+	//resolver and name
+	Key      string `bolthold:"key"`
+	Resolver string
+	Name     string
+	IPs      []string
+	Expire   time.Time
+	Hits     uint64
+}
+
+// host learned by auto mode
+type Learned struct {
+	Host   string `bolthold:"key"`
+	Expire time.Time
+	Hits   int
 }
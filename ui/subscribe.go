@@ -0,0 +1,165 @@
+package ui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ss "sshProxy/shadowsocks"
+	"strconv"
+	"time"
+
+	"github.com/bybzmt/bolthold"
+)
+
+const ruleListMaxSize = 16 * 1024 * 1024
+
+var errNotModified = errors.New("not modified")
+
+// rules of an entry, the cached remote list for subscriptions
+func (this *ui) ruleItems(r *Rules) string {
+	if r.URL == "" {
+		return r.Items
+	}
+
+	var l RuleList
+	err := this.store.Get(r.ID, &l)
+	if err != nil || l.URL != r.URL {
+		return ""
+	}
+
+	return l.Body
+}
+
+func (this *ui) runSubscribe() {
+	for _ = range time.Tick(time.Minute) {
+		this.refreshRuleLists(false)
+	}
+}
+
+func (this *ui) refreshRuleLists(force bool) {
+	var rs []Rules
+
+	err := this.store.Find(&rs, bolthold.Where("Enable").Eq(true).And("URL").Ne(""))
+	if err != nil {
+		ss.Debug.Println("refreshRuleLists", err)
+		return
+	}
+
+	for i := range rs {
+		this.refreshRuleList(&rs[i], force)
+	}
+}
+
+func (this *ui) refreshRuleList(r *Rules, force bool) {
+	var l RuleList
+
+	err := this.store.Get(r.ID, &l)
+	if err != nil || l.URL != r.URL {
+		l = RuleList{ID: r.ID, URL: r.URL}
+	}
+
+	interval := time.Duration(r.Interval) * time.Minute
+	if interval < time.Minute {
+		interval = 60 * time.Minute
+	}
+
+	if !force && time.Now().Before(l.Checked.Add(interval)) {
+		return
+	}
+
+	err = this.fetchRuleList(this.client(), r, &l)
+	l.Checked = time.Now()
+
+	//the rule may have been deleted, edited or disabled during the fetch
+	var cur Rules
+	if e := this.store.Get(r.ID, &cur); e != nil || cur.URL != r.URL {
+		ss.Debug.Println("RuleList dropped", r.ID, r.URL)
+		return
+	}
+
+	if err == nil {
+		l.Msg = "updated"
+		if cur.Enable {
+			setRules(this.client(), &cur, l.Body)
+		}
+		ss.Debug.Println("RuleList updated", r.ID, r.URL)
+	} else if err == errNotModified {
+		l.Msg = "not modified"
+	} else {
+		//keep the last good copy
+		l.Msg = err.Error()
+		ss.Debug.Println("RuleList", r.ID, r.URL, err)
+	}
+
+	err = this.store.Upsert(r.ID, &l)
+	if err != nil {
+		ss.Debug.Println("RuleList save", err)
+	}
+}
+
+func (this *ui) fetchRuleList(c *ss.Client, r *Rules, l *RuleList) error {
+	var via uint64
+	if r.Via != "" {
+		id, err := strconv.ParseUint(r.Via, 10, 64)
+		if err != nil {
+			return err
+		}
+		via = id
+	}
+
+	hc := http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			//a new transport per fetch, nothing to reuse the connection
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if r.Via == "" {
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr)
+				}
+				return c.DialServer(via, addr)
+			},
+		},
+	}
+
+	req, err := http.NewRequest("GET", r.URL, nil)
+	if err != nil {
+		return err
+	}
+	if l.Body != "" {
+		if l.ETag != "" {
+			req.Header.Set("If-None-Match", l.ETag)
+		}
+		if l.LastModified != "" {
+			req.Header.Set("If-Modified-Since", l.LastModified)
+		}
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http status %d", resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, ruleListMaxSize))
+	if err != nil {
+		return err
+	}
+
+	l.Body = string(b)
+	l.ETag = resp.Header.Get("ETag")
+	l.LastModified = resp.Header.Get("Last-Modified")
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package ui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	ss "sshProxy/shadowsocks"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ruleListServer serves body with the etag version, the status is what
+// it answers with when not 0
+type ruleListServer struct {
+	l       sync.Mutex
+	body    string
+	version string
+	status  int
+	fetches int
+	etags   []string
+}
+
+func (s *ruleListServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.fetches++
+	s.etags = append(s.etags, r.Header.Get("If-None-Match"))
+
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	if r.Header.Get("If-None-Match") == s.version {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.version)
+	w.Write([]byte(s.body))
+}
+
+func subscribeUI(t *testing.T) (*ui, *ruleListServer, *Rules) {
+	u := newTestUI(t)
+	u.ssServer = ss.NewClient("", 5, 5)
+	if err := u.ssServer.AddServer(1, "127.0.0.1:1080", "SOCKS5", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &ruleListServer{body: "a.example\n10.0.0.0/8", version: `"v1"`}
+	hs := httptest.NewServer(s)
+	t.Cleanup(hs.Close)
+
+	r := &Rules{ID: 1, Enable: true, Servers: "1", URL: hs.URL + "/list.txt", Interval: 60}
+	if err := u.store.Insert(r.ID, r); err != nil {
+		t.Fatal(err)
+	}
+
+	return u, s, r
+}
+
+func ruleList(t *testing.T, u *ui, id uint64) RuleList {
+	var l RuleList
+	if err := u.store.Get(id, &l); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// matched is the rule a.example is routed by in the client
+func matched(t *testing.T, u *ui) uint64 {
+	e, err := u.client().Explain("a.example:443", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.RuleID
+}
+
+func TestRefreshRuleList(t *testing.T) {
+	u, s, r := subscribeUI(t)
+
+	u.refreshRuleList(r, false)
+
+	l := ruleList(t, u, 1)
+	if l.Msg != "updated" || l.Body != s.body || l.ETag != s.version || l.URL != r.URL {
+		t.Errorf("first fetch %+v", l)
+	}
+	if u.ruleItems(r) != s.body {
+		t.Errorf("ruleItems %q", u.ruleItems(r))
+	}
+	if matched(t, u) != 1 {
+		t.Errorf("fetched list not applied")
+	}
+
+	//checked within the interval
+	u.refreshRuleList(r, false)
+	if s.fetches != 1 {
+		t.Errorf("fetched %d times within the interval", s.fetches)
+	}
+
+	//the etag is sent back
+	u.refreshRuleList(r, true)
+	if l := ruleList(t, u, 1); l.Msg != "not modified" || l.Body != s.body || s.etags[1] != s.version {
+		t.Errorf("not modified %+v, sent %q", l, s.etags)
+	}
+
+	//due again after the interval
+	l = ruleList(t, u, 1)
+	l.Checked = time.Now().Add(-61 * time.Minute)
+	u.store.Update(uint64(1), &l)
+	u.refreshRuleList(r, false)
+	if s.fetches != 3 {
+		t.Errorf("not fetched after the interval")
+	}
+
+	//a failed fetch keeps the last good copy
+	s.status = http.StatusInternalServerError
+	u.refreshRuleList(r, true)
+	if l := ruleList(t, u, 1); l.Msg != "http status 500" || l.Body != s.body {
+		t.Errorf("failed fetch %+v", l)
+	}
+
+	//a new url starts over
+	r.URL += "?v=2"
+	if u.ruleItems(r) != "" {
+		t.Errorf("list of the old url used")
+	}
+}
+
+func TestRefreshRuleListChanged(t *testing.T) {
+	u, _, r := subscribeUI(t)
+
+	//disabled during the fetch: saved, not applied
+	cur := *r
+	cur.Enable = false
+	u.store.Update(uint64(1), &cur)
+
+	u.refreshRuleList(r, false)
+	if l := ruleList(t, u, 1); l.Msg != "updated" {
+		t.Errorf("list of a disabled rule %+v", l)
+	}
+	if matched(t, u) != 0 {
+		t.Errorf("list of a disabled rule applied")
+	}
+
+	//deleted during the fetch: dropped
+	u.store.Delete(uint64(1), &RuleList{})
+	u.store.Delete(uint64(1), &Rules{})
+
+	u.refreshRuleList(r, true)
+	var l RuleList
+	if err := u.store.Get(uint64(1), &l); err == nil {
+		t.Errorf("list of a deleted rule saved %+v", l)
+	}
+}
+
+func TestRefreshRuleListVia(t *testing.T) {
+	u, s, r := subscribeUI(t)
+
+	r.Via = "x"
+	u.refreshRuleList(r, true)
+	if l := ruleList(t, u, 1); l.Msg == "updated" || s.fetches != 0 {
+		t.Errorf("bad server id fetched %+v", l)
+	}
+
+	//through a server that does not exist
+	r.Via = "9"
+	u.refreshRuleList(r, true)
+	if l := ruleList(t, u, 1); l.Msg == "updated" || s.fetches != 0 {
+		t.Errorf("fetched through a missing server %+v", l)
+	}
+}
@@ -24,7 +24,10 @@ type ui struct {
 
 	listener listener
 	reStart  bool
-	watcher  uiWatcher
+	closing  bool
+	//the dns cache is saved to the store
+	dnsPersist bool
+	watcher    uiWatcher
 
 	handler    *http.ServeMux
 	httpServer http.Server
@@ -34,6 +37,8 @@ type ui struct {
 	storeFile string
 	cliAddr   string
 	store     *bolthold.Store
+	//opened by explain, nothing is written or started
+	readOnly bool
 }
 
 func NewUI(cfg, addr, host string) *ui {
@@ -42,6 +47,11 @@ func NewUI(cfg, addr, host string) *ui {
 	u.listener.buf = make(chan net.Conn, 5)
 
 	u.watcher.buf = make(chan *LogMsg, 100)
+	u.watcher.learned = make(chan *Learned, 10)
+	u.watcher.fakeIPs = make(map[string]*FakeIP)
+	u.watcher.fakeNew = make(chan bool, 1)
+	u.watcher.dnsTop = make(map[string]*dnsLogTop)
+	u.watcher.dnsNew = make(chan bool, 1)
 	u.watcher.l = &u.listener
 	u.watcher.host = strings.ToLower(host)
 
@@ -67,12 +77,32 @@ func (this *ui) init() {
 	this.handler.HandleFunc("/api/ruleAdd", this.cross(this.apiRuleAdd))
 	this.handler.HandleFunc("/api/ruleEdit", this.cross(this.apiRuleEdit))
 	this.handler.HandleFunc("/api/ruleDel", this.cross(this.apiRuleDel))
+	this.handler.HandleFunc("/api/ruleTest", this.cross(this.apiRuleTest))
+	this.handler.HandleFunc("/api/ruleLists", this.cross(this.apiRuleLists))
+	this.handler.HandleFunc("/api/ruleListRefresh", this.cross(this.apiRuleListRefresh))
+	this.handler.HandleFunc("/api/mode", this.cross(this.apiMode))
+	this.handler.HandleFunc("/api/profiles", this.cross(this.apiProfiles))
+	this.handler.HandleFunc("/api/profileAdd", this.cross(this.apiProfileAdd))
+	this.handler.HandleFunc("/api/profileSave", this.cross(this.apiProfileSave))
+	this.handler.HandleFunc("/api/profileDel", this.cross(this.apiProfileDel))
+	this.handler.HandleFunc("/api/profileSwitch", this.cross(this.apiProfileSwitch))
+	this.handler.HandleFunc("/api/profileExport", this.cross(this.apiProfileExport))
+	this.handler.HandleFunc("/api/profileImport", this.cross(this.apiProfileImport))
+	this.handler.HandleFunc("/api/profileHosts", this.cross(this.apiProfileHosts))
+	this.handler.HandleFunc("/api/dnsRoutes", this.cross(this.apiDNSRoutes))
+	this.handler.HandleFunc("/api/dnsRouteAdd", this.cross(this.apiDNSRouteAdd))
+	this.handler.HandleFunc("/api/dnsRouteEdit", this.cross(this.apiDNSRouteEdit))
+	this.handler.HandleFunc("/api/dnsRouteDel", this.cross(this.apiDNSRouteDel))
+	this.handler.HandleFunc("/api/dnsLog", this.cross(this.apiDNSLog))
 	this.handler.HandleFunc("/api/clientConfig", this.cross(this.apiClientConfig))
 	this.handler.HandleFunc("/api/clientConfigSave", this.cross(this.apiClientConfigSave))
 	this.handler.HandleFunc("/api/serverConfigs", this.cross(this.apiServerConfigs))
 	this.handler.HandleFunc("/api/serverConfigAdd", this.cross(this.apiServerConfigAdd))
 	this.handler.HandleFunc("/api/serverConfigEdit", this.cross(this.apiServerConfigEdit))
 	this.handler.HandleFunc("/api/serverConfigDel", this.cross(this.apiServerConfigDel))
+	this.handler.HandleFunc("/api/learned", this.cross(this.apiLearned))
+	this.handler.HandleFunc("/api/learnedDel", this.cross(this.apiLearnedDel))
+	this.handler.HandleFunc("/api/learnedPromote", this.cross(this.apiLearnedPromote))
 	this.handler.HandleFunc("/api/restart", this.cross(this.apiRestart))
 }
 
@@ -84,6 +114,11 @@ func (this *ui) Run() error {
 	}
 
 	go this.runStore()
+	go this.runSubscribe()
+	go this.runLearned()
+	go this.runFakeIP()
+	go this.runDNSLog()
+	go this.runDNSCache()
 	go func() {
 		e := this.httpServer.Serve(&this.listener)
 		if e != nil {
@@ -95,11 +130,18 @@ func (this *ui) Run() error {
 }
 
 func (this *ui) Close() {
-	this.ssServer.Close()
+	this.closing = true
+	this.saveDNSCache()
+	this.saveFakeIPs()
+	this.saveDNSLog()
+	if c := this.client(); c != nil {
+		c.Close()
+	}
 }
 
 func (this *ui) Restart() {
 	this.reStart = true
+	this.saveDNSCache()
 	this.ssServer.Close()
 }
 
@@ -125,17 +167,75 @@ func (this *ui) initClient() {
 		rs.Addr = this.cliAddr
 	}
 
-	log.Println("Starting Client At", rs.Addr)
-	log.Println("open http://" + this.watcher.host)
+	if !this.readOnly {
+		log.Println("Starting Client At", rs.Addr)
+		log.Println("open http://" + this.watcher.host)
+	}
 
-	this.ssServer = ss.NewClient(rs.Addr, rs.Timeout, rs.IdleTimeout)
+	c := ss.NewClient(rs.Addr, rs.Timeout, rs.IdleTimeout)
+	c.SetDNSCache(ss.DNSCache{
+		MinTTL: time.Duration(rs.DNSMinTTL) * time.Second,
+		MaxTTL: time.Duration(rs.DNSMaxTTL) * time.Second,
+		NegTTL: time.Duration(rs.DNSNegTTL) * time.Second,
+		Stale:  time.Duration(rs.DNSStale) * time.Second,
+	})
+	if strategy, err := ss.ParseDNSStrategy(rs.DNSStrategy); err != nil {
+		log.Println("DNSStrategy", err)
+	} else {
+		c.SetDNSStrategy(strategy, time.Duration(rs.DNSTimeout)*time.Millisecond)
+	}
 	if rs.LDNSEnable && rs.LDNS != "" {
-		this.ssServer.SetLocalDNS(rs.LDNS)
+		c.SetLocalDNS(rs.LDNS)
 	}
 	if rs.RDNSEnable && rs.RDNS != "" {
-		this.ssServer.SetRemoteDNS(rs.RDNS)
+		c.SetRemoteDNS(rs.RDNS)
+	}
+	this.initDNSRoutes(c)
+	if pref, err := ss.ParseIPPref(rs.IPPref); err != nil {
+		log.Println("IPPref", err)
+	} else {
+		c.SetIPPref(pref)
+	}
+	this.initHosts(c, &rs)
+	if rs.ACL != "" {
+		c.SetACL(rs.ACL)
+	}
+	if rs.Auto {
+		this.initAuto(c, &rs)
+	}
+	if rs.Sniff {
+		if rs.SniffTimeout < 1 {
+			rs.SniffTimeout = 300
+		}
+		c.SetSniff(time.Duration(rs.SniffTimeout) * time.Millisecond)
+	}
+	if rs.GeoIP != "" {
+		if err := c.SetGeoIP(rs.GeoIP); err != nil {
+			log.Println("GeoIP", err)
+		}
+	}
+
+	var mc ModeConfig
+	if err := this.store.Get("Mode", &mc); err == nil {
+		mode, _ := ss.ParseMode(mc.Mode)
+		c.SetMode(mode, mc.Servers)
+	}
+	if rs.FakeIP {
+		this.initFakeIP(c, &rs)
 	}
-	this.ssServer.Watcher = &this.watcher
+	if rs.DNSListen != "" && !this.readOnly {
+		if err := c.ListenDNS(rs.DNSListen); err != nil {
+			log.Println("DNS Listen", err)
+		} else {
+			log.Println("Starting DNS At", rs.DNSListen)
+		}
+	}
+	c.Watcher = &this.watcher
+
+	this.l.Lock()
+	this.ssServer = c
+	this.dnsPersist = rs.DNSPersist
+	this.l.Unlock()
 }
 
 func (this *ui) initServer() {
@@ -163,19 +263,96 @@ func (this *ui) initRules() {
 		ss.Debug.Println("initRules", err)
 	}
 
-	for _, r := range rs {
-		this.ssServer.AddRules(r.Items, r.Servers)
+	for i, r := range rs {
+		setRules(this.ssServer, &r, this.ruleItems(&r))
+
+		if r.URL != "" && !this.readOnly {
+			go this.refreshRuleList(&rs[i], false)
+		}
+	}
+}
+
+func (this *ui) client() *ss.Client {
+	this.l.Lock()
+	defer this.l.Unlock()
+
+	return this.ssServer
+}
+
+// applyRule updates the running client after a rule was saved
+func (this *ui) applyRule(r *Rules) {
+	c := this.client()
+
+	if !r.Enable {
+		c.RemoveRules(r.ID)
+		return
+	}
+
+	setRules(c, r, this.ruleItems(r))
+
+	if r.URL != "" {
+		go this.refreshRuleList(r, false)
 	}
 }
 
+// applyServer updates the running client after a server was saved
+func (this *ui) applyServer(r *ServerConfig) {
+	c := this.client()
+
+	if !r.Enable {
+		c.RemoveServer(r.ID)
+		return
+	}
+
+	err := c.SetServer(r.ID, r.Addr, r.Cipher, r.User, r.Passwd)
+	if err != nil {
+		ss.Debug.Println("SetServer", err)
+	}
+}
+
+func newRules(r *Rules, items string) *ss.Rules {
+	t := ss.NewRules(r.ID, items, r.Servers)
+	t.Resolve = r.Resolve
+
+	//the schedule and the expr share the zone
+	loc, err := ss.ParseZone(r.TimeZone)
+	if err != nil {
+		ss.Debug.Println("Rules TimeZone", r.ID, err)
+	}
+	t.Location = loc
+
+	s, err := ss.ParseSchedule(r.Days, r.Times, loc)
+	if err != nil {
+		ss.Debug.Println("Rules Schedule", r.ID, err)
+	}
+	t.Schedule = s
+
+	x, err := ss.CompileExpr(r.Expr)
+	if err != nil {
+		ss.Debug.Println("Rules Expr", r.ID, err)
+	}
+	t.Expr = x
+
+	return t
+}
+
+func setRules(c *ss.Client, r *Rules, items string) {
+	c.SetRules(newRules(r, items))
+}
+
 func (this *ui) runClient() error {
 	for {
 		this.initClient()
 		this.initServer()
 		this.initRules()
+		this.initDNSCache()
 
 		err := this.ssServer.ListenAndServe()
 
+		if this.closing {
+			return nil
+		}
+
 		if this.reStart {
 			this.reStart = false
 
@@ -198,6 +375,11 @@ func (this *ui) gcStore() {
 	if err != nil {
 		ss.Debug.Println("gcStore LogMsg", err)
 	}
+
+	err = this.store.DeleteMatching(DNSLog{}, new(bolthold.Query).SortBy("ID").Reverse().Skip(dnsLogKeep))
+	if err != nil {
+		ss.Debug.Println("gcStore DNSLog", err)
+	}
 }
 
 func (this *ui) runStore() {
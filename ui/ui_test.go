@@ -0,0 +1,22 @@
+package ui
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bybzmt/bolthold"
+)
+
+// newTestUI returns a ui on an empty store, nothing is started
+func newTestUI(t *testing.T) *ui {
+	u := NewUI(filepath.Join(t.TempDir(), "test.db"), "", "shadowsocks")
+
+	store, err := bolthold.Open(u.storeFile, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	u.store = store
+	return u
+}
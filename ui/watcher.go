@@ -5,6 +5,7 @@ import (
 	"net"
 	ss "sshProxy/shadowsocks"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -13,6 +14,17 @@ type uiWatcher struct {
 	l       *listener
 	counter int32
 	buf     chan *LogMsg
+	learned chan *Learned
+	//fake ips not saved yet by ip, runFakeIP saves them together
+	fakeL   sync.Mutex
+	fakeIPs map[string]*FakeIP
+	fakeNew chan bool
+	//lookups not answered by the cache, runDNSLog saves them together,
+	//and the counts of every lookup by name
+	dnsL    sync.Mutex
+	dnsLogs []*DNSLog
+	dnsTop  map[string]*dnsLogTop
+	dnsNew  chan bool
 	host    string
 }
 
@@ -32,13 +44,20 @@ func (this *uiWatcher) OnShadowInvalid(from net.Addr, err error) {
 	}
 }
 
-func (this *uiWatcher) OnProxyStart(proxy bool, from, to net.Addr) {
-	this.buf <- &LogMsg{
+func (this *uiWatcher) OnProxyStart(proxy bool, from, to net.Addr, meta *ss.Meta) {
+	t := &LogMsg{
 		Now:   time.Now(),
 		Proxy: proxy,
 		From:  from.String(),
 		To:    to.String(),
 	}
+	if meta != nil {
+		t.Country = meta.Country
+		t.Process = meta.Process
+		t.Sniffed = meta.Sniffed
+	}
+
+	this.buf <- t
 
 	atomic.AddInt32(&this.counter, 1)
 }
@@ -73,3 +92,71 @@ func (this *uiWatcher) Hijacker(host string, c net.Conn) bool {
 	ss.Relay(b, c)
 	return true
 }
+
+func (this *uiWatcher) OnDNSLog(l *ss.DNSLog) {
+	t := &DNSLog{
+		Now:      time.Now(),
+		Name:     l.Name,
+		Resolver: l.Resolver,
+		Latency:  float64(l.Latency.Microseconds()) / 1000,
+		Cache:    l.Cache,
+	}
+
+	ips := make([]string, len(l.IPs))
+	for i, ip := range l.IPs {
+		ips[i] = ip.String()
+	}
+	t.IPs = strings.Join(ips, ",")
+
+	if l.Err != nil {
+		t.Err = l.Err.Error()
+	}
+
+	//lookups do not wait for the store, cached answers are only counted
+	this.dnsL.Lock()
+	this.countDNS(t)
+	if t.Cache == "" || t.Cache == "miss" {
+		if len(this.dnsLogs) >= dnsLogKeep {
+			this.dnsLogs = this.dnsLogs[1:]
+		}
+		this.dnsLogs = append(this.dnsLogs, t)
+	}
+	this.dnsL.Unlock()
+
+	select {
+	case this.dnsNew <- true:
+	default:
+	}
+}
+
+func (this *uiWatcher) OnFakeIP(ip net.IP, name string) {
+	t := &FakeIP{
+		IP:       ip.String(),
+		Name:     name,
+		Assigned: time.Now(),
+	}
+
+	//answers do not wait for the store, nor are they lost when it is slow
+	this.fakeL.Lock()
+	this.fakeIPs[t.IP] = t
+	this.fakeL.Unlock()
+
+	select {
+	case this.fakeNew <- true:
+	default:
+	}
+}
+
+func (this *uiWatcher) OnAutoLearn(host string, expire time.Time) {
+	t := &Learned{
+		Host:   host,
+		Expire: expire,
+	}
+
+	//the next failure learns it again
+	select {
+	case this.learned <- t:
+	default:
+		ss.Debug.Println("learned save dropped", host)
+	}
+}
@@ -16,5 +16,14 @@ export default {
         "/server": {
             page: () => import('./pages/server.svelte'),
         },
+        "/learned": {
+            page: () => import('./pages/learned.svelte'),
+        },
+        "/dns": {
+            page: () => import('./pages/dns.svelte'),
+        },
+        "/profiles": {
+            page: () => import('./pages/profiles.svelte'),
+        },
     }
 }